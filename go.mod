@@ -8,15 +8,17 @@ require (
 	github.com/gorilla/mux v1.7.1
 	github.com/hashicorp/terraform v0.11.13
 	github.com/jessevdk/go-flags v1.4.0
+	github.com/lib/pq v1.1.1
 	github.com/rs/cors v1.6.0
 	github.com/sirupsen/logrus v1.4.1
 	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c // indirect
 	github.com/xdg/stringprep v1.0.0 // indirect
+	go.etcd.io/bbolt v1.3.5
 	go.mongodb.org/mongo-driver v1.0.0
-	golang.org/x/crypto v0.0.0-20190506204251-e1dfcc566284 // indirect
+	golang.org/x/crypto v0.0.0-20190506204251-e1dfcc566284
 	golang.org/x/lint v0.0.0-20190409202823-959b441ac422 // indirect
 	golang.org/x/net v0.0.0-20190503192946-f4e77d36d62c // indirect
-	golang.org/x/sys v0.0.0-20190507053917-2953c62de483 // indirect
+	golang.org/x/sys v0.7.0 // indirect
 	golang.org/x/text v0.3.2 // indirect
 	golang.org/x/tools v0.0.0-20190506145303-2d16b83fe98c // indirect
 	labix.org/v2/mgo v0.0.0-20140701140051-000000000287 // indirect
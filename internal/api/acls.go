@@ -0,0 +1,334 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/camptocamp/terradb/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// aclCacheTTL is how long the ACLs are cached,
+// so that the changes made by other instances are seen
+const aclCacheTTL = 30 * time.Second
+
+// aclPageSize is the page size used to load the ACLs
+const aclPageSize = 100
+
+// aclScopes are the scopes ACLs can grant
+var aclScopes = []string{scopeRead, scopeWrite, scopeLock, scopeAdmin, scopeReadSecrets}
+
+// aclSubjectKinds are the kinds of principals ACLs can be granted to
+var aclSubjectKinds = []string{"user", "token", "group", "jwt", "cert"}
+
+// aclCache caches the ACLs, which are checked on every request
+type aclCache struct {
+	st storage.Storage
+
+	mutex  sync.Mutex
+	acls   []*storage.ACL
+	loaded time.Time
+}
+
+// match returns the ACLs granted to any of subjects
+func (c *aclCache) match(ctx context.Context, subjects []string) (acls []*storage.ACL, err error) {
+	if len(subjects) == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if time.Since(c.loaded) > aclCacheTTL {
+		var all []*storage.ACL
+		for page := 1; ; page++ {
+			coll, err := c.st.ListACLs(ctx, page, aclPageSize)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, coll.Data...)
+			if len(coll.Data) < aclPageSize {
+				break
+			}
+		}
+		c.acls = all
+		c.loaded = time.Now()
+	}
+
+	for _, acl := range c.acls {
+		for _, subject := range subjects {
+			if acl.Principal == subject {
+				acls = append(acls, acl)
+				break
+			}
+		}
+	}
+	return
+}
+
+// invalidate forces the ACLs to be loaded again
+func (c *aclCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.loaded = time.Time{}
+}
+
+// matchPattern tells whether a state name matches an ACL pattern.
+// Patterns are globs, where * does not match slashes, and a final
+// /** matches all the states below a path, e.g. team/** or team-*/**.
+func matchPattern(pattern, name string) bool {
+	if pattern == "**" {
+		return true
+	}
+
+	if strings.HasSuffix(pattern, "/**") {
+		head := strings.TrimSuffix(pattern, "/**")
+		n := strings.Count(head, "/") + 1
+		elems := strings.SplitN(name, "/", n+1)
+		if len(elems) <= n {
+			return false
+		}
+		name = strings.Join(elems[:n], "/")
+		pattern = head
+	}
+
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// newACL checks an ACL, and sets its ID,
+// which is derived from its principal and pattern
+func newACL(acl storage.ACL) (*storage.ACL, error) {
+	kind := strings.SplitN(acl.Principal, ":", 2)
+	if len(kind) != 2 || kind[1] == "" || !newScopes(aclSubjectKinds...)[kind[0]] {
+		return nil, fmt.Errorf("invalid principal %q, expected user:<name>, token:<id>, group:<name>, jwt:<issuer>/<name> or cert:<name>", acl.Principal)
+	}
+
+	if acl.Pattern == "" {
+		return nil, fmt.Errorf("a pattern is required")
+	}
+	if _, err := path.Match(strings.TrimSuffix(acl.Pattern, "/**"), ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %v", acl.Pattern, err)
+	}
+
+	if len(acl.Scopes) == 0 {
+		return nil, fmt.Errorf("at least one scope is required")
+	}
+	valid := newScopes(aclScopes...)
+	for _, scope := range acl.Scopes {
+		if !valid[scope] {
+			return nil, fmt.Errorf("unknown scope %s, expected one of %s", scope, strings.Join(aclScopes, ", "))
+		}
+	}
+
+	sum := sha256.Sum256([]byte(acl.Principal + "\x00" + acl.Pattern))
+	acl.ID = hex.EncodeToString(sum[:8])
+	return &acl, nil
+}
+
+// ListACLs lists the ACLs. It is restricted to admins.
+func (s *server) ListACLs(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, scopeAdmin, "") {
+		return
+	}
+
+	page, pageSize, err := s.parsePagination(r)
+	if err != nil {
+		err500(err, "", w)
+		return
+	}
+
+	coll, err := s.st.ListACLs(r.Context(), page, pageSize)
+	if err != nil {
+		errStorage(r.Context(), err, "failed to retrieve ACLs", w)
+		return
+	}
+
+	data, err := json.Marshal(coll)
+	if err != nil {
+		err500(err, "failed to marshal ACLs", w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+// InsertACL grants scopes on a pattern to a principal,
+// replacing the scopes it was granted on the same pattern.
+// It is restricted to admins.
+func (s *server) InsertACL(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, scopeAdmin, "") {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err500(err, "failed to read body", w)
+		return
+	}
+
+	var req storage.ACL
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400 - Bad request: %s", err)))
+		return
+	}
+
+	acl, err := newACL(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400 - Bad request: %s", err)))
+		return
+	}
+
+	err = s.st.InsertACL(r.Context(), *acl)
+	if err != nil {
+		errStorage(r.Context(), err, "failed to insert ACL", w)
+		return
+	}
+	s.acls.invalidate()
+
+	log.WithFields(log.Fields{
+		"id":         acl.ID,
+		"principal":  acl.Principal,
+		"pattern":    acl.Pattern,
+		"scopes":     acl.Scopes,
+		"granted_by": getPrincipal(r).Name,
+	}).Info("Granted ACL")
+
+	data, err := json.Marshal(acl)
+	if err != nil {
+		err500(err, "failed to marshal ACL", w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+// RemoveACL removes an ACL. It is restricted to admins.
+func (s *server) RemoveACL(w http.ResponseWriter, r *http.Request) {
+	params := pathVars(r)
+	if !authorize(w, r, scopeAdmin, "") {
+		return
+	}
+
+	err := s.st.RemoveACL(r.Context(), params["id"])
+	if err == storage.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		errStorage(r.Context(), err, "failed to remove ACL", w)
+		return
+	}
+	s.acls.invalidate()
+
+	log.WithFields(log.Fields{
+		"id":         params["id"],
+		"removed_by": getPrincipal(r).Name,
+	}).Info("Removed ACL")
+
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+// seedACLs inserts the ACLs of a JSON file,
+// replacing the ACLs with the same principal and pattern
+func (s *server) seedACLs(file string) (err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read ACL file: %v", err)
+	}
+
+	var acls []storage.ACL
+	err = json.Unmarshal(data, &acls)
+	if err != nil {
+		return fmt.Errorf("failed to parse ACL file %s: %v", file, err)
+	}
+
+	for _, req := range acls {
+		acl, err := newACL(req)
+		if err != nil {
+			return fmt.Errorf("invalid ACL in %s: %v", file, err)
+		}
+
+		ctx, cancel := s.storageContext()
+		err = s.st.InsertACL(ctx, *acl)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to insert ACL: %v", err)
+		}
+	}
+
+	log.Infof("Inserted %d ACLs from %s", len(acls), file)
+	return
+}
+
+// listReadableStates lists the states whose names start with prefix
+// which the caller of a request can read, when it cannot read all of them.
+// All the states are filtered, then paginated.
+func (s *server) listReadableStates(r *http.Request, prefix string, page, pageSize int) (coll storage.StateCollection, err error) {
+	p := getPrincipal(r)
+
+	var states []*storage.State
+	for n := 1; ; n++ {
+		c, err := s.st.ListStates(r.Context(), prefix, n, s.pageSize)
+		if err != nil {
+			return coll, err
+		}
+		for _, state := range c.Data {
+			if p.can(scopeRead, state.Name) {
+				states = append(states, state)
+			}
+		}
+		if len(c.Data) < s.pageSize {
+			break
+		}
+	}
+
+	var start, end int
+	coll.Metadata, start, end = storage.Paginate(len(states), page, pageSize)
+	coll.Data = states[start:end]
+	return
+}
+
+// listReadableTrash lists the deleted states which the caller
+// of a request can read, when it cannot read all of them.
+func (s *server) listReadableTrash(r *http.Request, page, pageSize int) (coll storage.DeletedStateCollection, err error) {
+	p := getPrincipal(r)
+
+	var deleted []*storage.DeletedState
+	for n := 1; ; n++ {
+		c, err := s.st.ListTrash(r.Context(), n, s.pageSize)
+		if err != nil {
+			return coll, err
+		}
+		for _, d := range c.Data {
+			if p.can(scopeRead, d.Name) {
+				deleted = append(deleted, d)
+			}
+		}
+		if len(c.Data) < s.pageSize {
+			break
+		}
+	}
+
+	var start, end int
+	coll.Metadata, start, end = storage.Paginate(len(deleted), page, pageSize)
+	coll.Data = deleted[start:end]
+	return
+}
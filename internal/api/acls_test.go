@@ -0,0 +1,92 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/camptocamp/terradb/internal/storage"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"**", "team/app/prod", true},
+		{"team/app", "team/app", true},
+		{"team/app", "team/app/prod", false},
+		{"team/*", "team/app", true},
+		{"team/*", "team/app/prod", false},
+		{"team/**", "team/app", true},
+		{"team/**", "team/app/prod", true},
+		{"team/**", "team", false},
+		{"team/**", "team-b/app", false},
+		{"team-*/**", "team-b/app", true},
+		{"team-*/**", "team/app", false},
+	}
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.name); got != tt.match {
+			t.Errorf("expected matchPattern(%q, %q) to be %v", tt.pattern, tt.name, tt.match)
+		}
+	}
+}
+
+func TestNewACL(t *testing.T) {
+	tests := []struct {
+		desc  string
+		acl   storage.ACL
+		valid bool
+	}{
+		{"a user ACL", storage.ACL{Principal: "user:alice", Pattern: "team/**", Scopes: []string{scopeWrite}}, true},
+		{"a group ACL", storage.ACL{Principal: "group:ops", Pattern: "**", Scopes: []string{scopeReadSecrets}}, true},
+		{"an unknown principal kind", storage.ACL{Principal: "robot:r2", Pattern: "**", Scopes: []string{scopeRead}}, false},
+		{"an empty principal name", storage.ACL{Principal: "user:", Pattern: "**", Scopes: []string{scopeRead}}, false},
+		{"no pattern", storage.ACL{Principal: "user:alice", Scopes: []string{scopeRead}}, false},
+		{"no scopes", storage.ACL{Principal: "user:alice", Pattern: "**"}, false},
+		{"an unknown scope", storage.ACL{Principal: "user:alice", Pattern: "**", Scopes: []string{"delete"}}, false},
+	}
+	for _, tt := range tests {
+		_, err := newACL(tt.acl)
+		if tt.valid && err != nil {
+			t.Errorf("expected %s to be valid, got %v", tt.desc, err)
+		} else if !tt.valid && err == nil {
+			t.Errorf("expected %s to be invalid", tt.desc)
+		}
+	}
+}
+
+func TestACLAuthorization(t *testing.T) {
+	s := newTestServer(t)
+	reader := basicAuth("reader", "reader-password")
+
+	grant(t, s, `{"principal": "user:reader", "pattern": "team/**", "scopes": ["write"]}`)
+
+	if code, body := do(t, s, "POST", "/v1/states/team%2Fapp", reader, testState); code != http.StatusOK {
+		t.Errorf("expected the ACL to grant pushes to team/app, got %d %s", code, body)
+	}
+	if code, body := do(t, s, "POST", "/v1/states/other%2Fapp", reader, testState); code != http.StatusForbidden {
+		t.Errorf("expected pushes to other/app to be forbidden, got %d %s", code, body)
+	}
+	if code, body := do(t, s, "LOCK", "/v1/states/team%2Fapp", reader, `{"ID": "lock-id"}`); code != http.StatusForbidden {
+		t.Errorf("expected the ACL not to grant the lock scope, got %d %s", code, body)
+	}
+
+	// ACLs granting the admin scope imply the other scopes on their states
+	grant(t, s, `{"principal": "user:reader", "pattern": "ops/*", "scopes": ["admin"]}`)
+
+	if code, body := do(t, s, "LOCK", "/v1/states/ops%2Fapp", reader, `{"ID": "lock-id"}`); code != http.StatusOK {
+		t.Errorf("expected the admin ACL to grant locks on ops/app, got %d %s", code, body)
+	}
+	if code, body := do(t, s, "GET", "/v1/tokens", reader, ""); code != http.StatusForbidden {
+		t.Errorf("expected ACLs not to grant server-wide scopes, got %d %s", code, body)
+	}
+}
+
+// grant inserts an ACL through the API
+func grant(t *testing.T, s *server, acl string) {
+	code, body := do(t, s, "POST", "/v1/acls", basicAuth("admin", "admin-password"), acl)
+	if code != http.StatusOK {
+		t.Fatalf("failed to insert ACL: %d %s", code, body)
+	}
+}
@@ -1,10 +1,16 @@
 package api
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
@@ -16,76 +22,450 @@ import (
 
 // API defines an API struct
 type API struct {
-	Address  string
-	Port     string
-	Username string
-	Password string
-	PageSize int
+	Address     string
+	Port        string
+	Username    string
+	Password    string
+	PageSize    int
+	Timeout     time.Duration
+	RequireLock bool
+
+	// TrashRetention is how long deleted states are kept
+	// before being purged. They are kept forever if it is 0.
+	TrashRetention time.Duration
+
+	// CompactionInterval is how often the serials are compacted,
+	// when the storage stores deltas. They are never compacted if it is 0.
+	CompactionInterval time.Duration
+
+	// RedactPatterns are the patterns of the attribute names
+	// redacted for the callers which cannot read secrets
+	RedactPatterns []string
+
+	// ReaderUsername and ReaderPassword grant read-only access,
+	// with secrets redacted, along with Username and Password
+	ReaderUsername string
+	ReaderPassword string
+
+	// ACLFile is a JSON file of ACLs inserted on start
+	ACLFile string
+
+	// HtpasswdFile authenticates users with basic auth,
+	// along with Username and Password
+	HtpasswdFile string
+
+	// JWT configures the authentication with JWTs
+	JWT JWTConfig
+
+	// TLS configures HTTPS and the client certificates
+	TLS TLSConfig
+
+	// AuditFile mirrors the audit records to a JSON-lines file
+	AuditFile string
 }
 
 type server struct {
-	st       storage.Storage
-	pageSize int
-	username string
-	password string
+	st          storage.Storage
+	pageSize    int
+	username    string
+	password    string
+	timeout     time.Duration
+	requireLock bool
+	redactor    *redactor
+
+	readerUsername string
+	readerPassword string
+
+	acls     *aclCache
+	jwt      *jwtAuthenticator
+	htpasswd *htpasswdFile
+
+	clientCerts *clientCertAuthenticator
+
+	auditFile *auditFile
+
+	// webhookWake wakes the delivery of the webhooks up
+	// when an event was queued
+	webhooks    *webhookCache
+	webhookWake chan struct{}
+
+	// compacting is set while a compaction is running
+	compacting int32
 }
 
+// principal is the authenticated caller of a request
+type principal struct {
+	Name string
+
+	// Scopes are the permissions granted to the principal,
+	// on the states whose names start with Prefix
+	Scopes map[string]bool
+	Prefix string
+
+	// Subjects identify the principal in ACLs, such as user:alice,
+	// token:<id> or group:ops, and acls are the ACLs granted to them
+	Subjects []string
+	acls     []*storage.ACL
+}
+
+// Scopes of the principals
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeLock  = "lock"
+	scopeAdmin = "admin"
+	// scopeReadSecrets allows to read states and resources unredacted
+	scopeReadSecrets = "read-secrets"
+)
+
+// scopes lists the valid scopes
+var scopes = []string{scopeRead, scopeWrite, scopeLock, scopeAdmin, scopeReadSecrets}
+
+// roles are named sets of scopes,
+// granted to the users of identity providers
+var roles = map[string][]string{
+	"reader": {scopeRead},
+	"writer": {scopeRead, scopeReadSecrets, scopeWrite, scopeLock},
+	"admin":  scopes,
+}
+
+// grant grants the scopes of a role to the principal
+func (p *principal) grant(role string) {
+	for _, scope := range roles[role] {
+		p.Scopes[scope] = true
+	}
+}
+
+// newScopes returns a set of scopes
+func newScopes(names ...string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// hasScope tells whether a set of scopes includes a scope.
+// The admin scope implies all the other scopes.
+func hasScope(set map[string]bool, scope string) bool {
+	switch scope {
+	case scopeRead, scopeWrite, scopeLock, scopeReadSecrets:
+		return set[scope] || set[scopeAdmin]
+	}
+	return set[scope]
+}
+
+// can tells whether the principal has a scope on a state,
+// or on the whole server when name is empty,
+// either by its own scopes or by an ACL.
+func (p *principal) can(scope, name string) bool {
+	if p.canAll(scope, name) {
+		return true
+	}
+	if name == "" {
+		return false
+	}
+	for _, acl := range p.acls {
+		if matchPattern(acl.Pattern, name) && hasScope(newScopes(acl.Scopes...), scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAll tells whether the principal has a scope by its own scopes
+// on all the states whose names start with prefix,
+// or on the whole server when prefix is empty.
+func (p *principal) canAll(scope, prefix string) bool {
+	return strings.HasPrefix(prefix, p.Prefix) && hasScope(p.Scopes, scope)
+}
+
+type contextKey int
+
+const principalKey contextKey = iota
+
+// statusClientClosedRequest is the non-standard status code
+// used when the client went away before the response was sent
+const statusClientClosedRequest = 499
+
 // StartServer starts the API server
 func StartServer(cfg *API, st storage.Storage) {
 	s := server{
-		st:       st,
-		pageSize: cfg.PageSize,
-		username: cfg.Username,
-		password: cfg.Password,
+		st:          st,
+		pageSize:    cfg.PageSize,
+		username:    cfg.Username,
+		password:    cfg.Password,
+		timeout:     cfg.Timeout,
+		requireLock: cfg.RequireLock,
+
+		readerUsername: cfg.ReaderUsername,
+		readerPassword: cfg.ReaderPassword,
+
+		acls: &aclCache{st: st},
+
+		webhooks:    &webhookCache{st: st},
+		webhookWake: make(chan struct{}, 1),
+	}
+
+	var err error
+	s.redactor, err = newRedactor(cfg.RedactPatterns)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.ACLFile != "" {
+		err = s.seedACLs(cfg.ACLFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.HtpasswdFile != "" {
+		s.htpasswd, err = newHtpasswdFile(cfg.HtpasswdFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go s.htpasswd.watch(htpasswdPollInterval)
+	}
+
+	if cfg.JWT.JWKS != "" {
+		s.jwt, err = newJWTAuthenticator(cfg.JWT)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go s.jwt.refreshKeys(jwksRefreshInterval)
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLS.CertFile != "" {
+		tlsConfig, err = serverTLSConfig(cfg.TLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cfg.TLS.ClientCAFile != "" {
+			s.clientCerts, err = newClientCertAuthenticator(cfg.TLS)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 
-	if !authenticationRequired(s.username, s.password) {
+	if cfg.AuditFile != "" {
+		s.auditFile, err = newAuditFile(cfg.AuditFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if !s.authEnabled() {
 		log.Warning("Authentication disabled: empty username or password.")
 	}
 
-	router := mux.NewRouter().StrictSlash(true)
+	if cfg.TrashRetention > 0 {
+		go s.purgeExpiredStates(cfg.TrashRetention)
+	}
+
+	if ds, ok := storage.Deltas(st); ok && cfg.CompactionInterval > 0 {
+		go s.compactSerials(ds, cfg.CompactionInterval)
+	}
+
+	go s.deliverWebhooks(webhookPollInterval)
+
+	srv := &http.Server{
+		Addr:      fmt.Sprintf("%s:%s", cfg.Address, cfg.Port),
+		Handler:   s.routes(),
+		TLSConfig: tlsConfig,
+	}
+
+	if tlsConfig != nil {
+		log.Infof("Listening on %s:%s with TLS", cfg.Address, cfg.Port)
+		// The certificate is served by the TLS config
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+		return
+	}
+
+	log.Infof("Listening on %s:%s", cfg.Address, cfg.Port)
+	log.Fatal(srv.ListenAndServe())
+	return
+}
+
+// routes returns the handler of the API
+func (s *server) routes() http.Handler {
+	// State names may contain slashes, which are escaped in paths
+	router := mux.NewRouter().StrictSlash(true).UseEncodedPath()
 
 	router.Use(s.handleAPIRequest)
 
+	// The mutating calls are audited under the name of their route
 	apiRtr := router.PathPrefix("/v1").Subrouter()
 	apiRtr.HandleFunc("/states", s.ListStates).Methods("GET")
-	apiRtr.HandleFunc("/states/{name}", s.InsertState).Methods("POST")
+	apiRtr.HandleFunc("/states/{name}", s.audited(s.InsertState)).Methods("POST").Name("insert_state")
 	apiRtr.HandleFunc("/states/{name}", s.GetState).Methods("GET")
-	apiRtr.HandleFunc("/states/{name}", s.RemoveState).Methods("DELETE")
-	apiRtr.HandleFunc("/states/{name}", s.LockState).Methods("LOCK")
-	apiRtr.HandleFunc("/states/{name}", s.UnlockState).Methods("UNLOCK")
+	apiRtr.HandleFunc("/states/{name}", s.audited(s.RemoveState)).Methods("DELETE").Name("remove_state")
+	apiRtr.HandleFunc("/states/{name}", s.audited(s.LockState)).Methods("LOCK").Name("lock_state")
+	apiRtr.HandleFunc("/states/{name}", s.audited(s.UnlockState)).Methods("UNLOCK").Name("unlock_state")
 	apiRtr.HandleFunc("/states/{name}/serials", s.ListStateSerials).Methods("GET")
+	apiRtr.HandleFunc("/states/{name}/lock", s.audited(s.ForceUnlockState)).Methods("DELETE").Name("force_unlock_state")
 	apiRtr.HandleFunc("/resources/{state}/{module}/{name}", s.GetResource).Methods("GET")
 	apiRtr.HandleFunc("/resources/{state}/{name}", s.GetResource).Methods("GET")
+	apiRtr.HandleFunc("/trash", s.ListTrash).Methods("GET")
+	apiRtr.HandleFunc("/trash/{name}", s.audited(s.PurgeState)).Methods("DELETE").Name("purge_state")
+	apiRtr.HandleFunc("/trash/{name}/restore", s.audited(s.RestoreState)).Methods("POST").Name("restore_state")
+	apiRtr.HandleFunc("/admin/deltas", s.DeltaStats).Methods("GET")
+	apiRtr.HandleFunc("/admin/compact", s.audited(s.Compact)).Methods("POST").Name("compact")
+	apiRtr.HandleFunc("/tokens", s.ListTokens).Methods("GET")
+	apiRtr.HandleFunc("/tokens", s.audited(s.CreateToken)).Methods("POST").Name("create_token")
+	apiRtr.HandleFunc("/tokens/{id}", s.audited(s.RevokeToken)).Methods("DELETE").Name("revoke_token")
+	apiRtr.HandleFunc("/acls", s.ListACLs).Methods("GET")
+	apiRtr.HandleFunc("/acls", s.audited(s.InsertACL)).Methods("POST").Name("insert_acl")
+	apiRtr.HandleFunc("/acls/{id}", s.audited(s.RemoveACL)).Methods("DELETE").Name("remove_acl")
+	apiRtr.HandleFunc("/audit", s.ListAuditRecords).Methods("GET")
+	apiRtr.HandleFunc("/webhooks", s.ListWebhooks).Methods("GET")
+	apiRtr.HandleFunc("/webhooks", s.audited(s.CreateWebhook)).Methods("POST").Name("create_webhook")
+	apiRtr.HandleFunc("/webhooks/{id}", s.audited(s.RemoveWebhook)).Methods("DELETE").Name("remove_webhook")
+	apiRtr.HandleFunc("/webhooks/{id}/deliveries", s.ListDeliveries).Methods("GET")
 
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
 	})
 
-	handler := c.Handler(router)
-
-	log.Infof("Listening on %s:%s", cfg.Address, cfg.Port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%s", cfg.Address, cfg.Port), handler))
-	return
+	return c.Handler(router)
 }
 
 func (s *server) handleAPIRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "application/json")
 
-		if authenticationRequired(s.username, s.password) {
+		if s.timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		// Without authentication, everyone has full access
+		p := &principal{
+			Name:   "anonymous",
+			Scopes: newScopes(scopes...),
+		}
+
+		var err error
+		auth := r.Header.Get("Authorization")
+		if s.authEnabled() {
 			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			if !isAuthorized(r.Header.Get("Authorization"), s.username, s.password) {
+			if s.jwt != nil {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="Restricted"`)
+			}
+		}
+		token := bearerToken(auth)
+		switch {
+		case strings.HasPrefix(token, tokenPrefix):
+			// API tokens are checked even without authentication,
+			// since their caller expects their restrictions
+			p, err = s.tokenPrincipal(r.Context(), token)
+			if err == errInvalidToken {
+				s.auditUnauthorized(r)
 				w.WriteHeader(http.StatusUnauthorized)
-				w.Write([]byte("401 - Not authorized"))
+				w.Write([]byte(fmt.Sprintf("401 - Not authorized: %s", err)))
+				return
+			} else if err != nil {
+				errStorage(r.Context(), err, "failed to retrieve token", w)
 				return
 			}
+		case s.jwt != nil && isJWT(token):
+			p, err = s.jwt.principal(token)
+			if err != nil {
+				log.Infof("rejected JWT: %s", err)
+				s.auditUnauthorized(r)
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(fmt.Sprintf("401 - Not authorized: %s", err)))
+				return
+			}
+		case auth == "" && s.clientCerts != nil:
+			p = s.clientCerts.principal(r)
+		case !s.authEnabled():
+			// anonymous
+		case authenticationRequired(s.username, s.password) &&
+			isAuthorized(auth, s.username, s.password):
+			p.Name = s.username
+			p.Subjects = []string{"user:" + s.username}
+		case authenticationRequired(s.readerUsername, s.readerPassword) &&
+			isAuthorized(auth, s.readerUsername, s.readerPassword):
+			p = &principal{
+				Name:     s.readerUsername,
+				Scopes:   newScopes(scopeRead),
+				Subjects: []string{"user:" + s.readerUsername},
+			}
+		case s.htpasswd != nil:
+			p = s.htpasswd.principal(auth)
+		default:
+			p = nil
+		}
+		if p == nil {
+			s.auditUnauthorized(r)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("401 - Not authorized"))
+			return
 		}
 
+		p.acls, err = s.acls.match(r.Context(), p.Subjects)
+		if err != nil {
+			errStorage(r.Context(), err, "failed to retrieve ACLs", w)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), principalKey, p))
+
 		next.ServeHTTP(w, r)
 	})
 }
 
+// pathVars returns the unescaped route variables of a request.
+// Routes are matched against escaped paths, so that the state names
+// containing slashes (escaped as %2F) match a single variable.
+func pathVars(r *http.Request) map[string]string {
+	vars := make(map[string]string)
+	for k, v := range mux.Vars(r) {
+		if u, err := url.PathUnescape(v); err == nil {
+			v = u
+		}
+		vars[k] = v
+	}
+	return vars
+}
+
+// getPrincipal returns the authenticated caller of a request
+func getPrincipal(r *http.Request) *principal {
+	p, ok := r.Context().Value(principalKey).(*principal)
+	if !ok {
+		return &principal{}
+	}
+	return p
+}
+
+// authorize checks that the caller of a request has a scope on a state,
+// or on the whole server when name is empty, and replies 403 otherwise.
+func authorize(w http.ResponseWriter, r *http.Request, scope, name string) bool {
+	if getPrincipal(r).can(scope, name) {
+		return true
+	}
+
+	w.WriteHeader(http.StatusForbidden)
+	if name == "" {
+		w.Write([]byte(fmt.Sprintf("403 - Forbidden: %s scope required", scope)))
+	} else {
+		w.Write([]byte(fmt.Sprintf("403 - Forbidden: %s scope required on %s", scope, name)))
+	}
+	return false
+}
+
+// storageContext returns a context for storage operations
+// which are not tied to a request, bounded by the storage timeout
+func (s *server) storageContext() (context.Context, context.CancelFunc) {
+	if s.timeout > 0 {
+		return context.WithTimeout(context.Background(), s.timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
 func err500(err error, msg string, w http.ResponseWriter) {
 	log.Errorf("%s: %s", msg, err)
 	w.WriteHeader(http.StatusInternalServerError)
@@ -93,6 +473,30 @@ func err500(err error, msg string, w http.ResponseWriter) {
 	return
 }
 
+// errStorage reports a storage error, distinguishing operations
+// which timed out or were canceled by the client from server errors.
+func errStorage(ctx context.Context, err error, msg string, w http.ResponseWriter) {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		log.Warnf("%s: %s", msg, ctx.Err())
+		w.WriteHeader(http.StatusGatewayTimeout)
+		w.Write([]byte(fmt.Sprintf("504 - Gateway timeout: %s", msg)))
+	case context.Canceled:
+		log.Infof("%s: %s", msg, ctx.Err())
+		w.WriteHeader(statusClientClosedRequest)
+	default:
+		err500(err, msg, w)
+	}
+	return
+}
+
+// authEnabled tells whether the callers must authenticate,
+// with basic auth, a JWT or a client certificate
+func (s *server) authEnabled() bool {
+	return authenticationRequired(s.username, s.password) || s.htpasswd != nil ||
+		s.jwt != nil || s.clientCerts != nil
+}
+
 func authenticationRequired(username, password string) bool {
 	if username == "" || password == "" {
 		return false
@@ -116,8 +520,10 @@ func isAuthorized(authorizationHeader, username, password string) bool {
 		return false
 	}
 
-	if pair[0] != username || pair[1] != password {
-		return false
-	}
-	return true
+	// Compare digests in constant time, which does not leak
+	// the credentials through their lengths or contents
+	gotUser, wantUser := sha256.Sum256([]byte(pair[0])), sha256.Sum256([]byte(username))
+	gotPass, wantPass := sha256.Sum256([]byte(pair[1])), sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(gotUser[:], wantUser[:])&
+		subtle.ConstantTimeCompare(gotPass[:], wantPass[:]) == 1
 }
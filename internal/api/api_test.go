@@ -0,0 +1,280 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terradb/internal/storage"
+)
+
+// testState is a version 4 state holding a sensitive output
+// and an attribute matched by the redaction patterns of newTestServer
+const testState = `{
+	"version": 4,
+	"terraform_version": "1.5.7",
+	"serial": 1,
+	"lineage": "lineage",
+	"outputs": {
+		"password": {"value": "hunter2", "type": "string", "sensitive": true}
+	},
+	"resources": [{
+		"mode": "managed",
+		"type": "null_resource",
+		"name": "foo",
+		"provider": "provider[\"registry.terraform.io/hashicorp/null\"]",
+		"instances": [{
+			"attributes": {"id": "1234", "db_password": "hunter2"},
+			"sensitive_attributes": []
+		}]
+	}]
+}`
+
+// newTestServer returns a server on a memory storage,
+// with the admin and reader basic auth users
+func newTestServer(t *testing.T) *server {
+	st := storage.NewMemory()
+	rd, err := newRedactor([]string{"*password"})
+	if err != nil {
+		t.Fatalf("failed to create redactor: %v", err)
+	}
+
+	return &server{
+		st:       st,
+		pageSize: 100,
+		username: "admin",
+		password: "admin-password",
+		redactor: rd,
+
+		readerUsername: "reader",
+		readerPassword: "reader-password",
+
+		acls:        &aclCache{st: st},
+		webhooks:    &webhookCache{st: st},
+		webhookWake: make(chan struct{}, 1),
+	}
+}
+
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// do sends a request to the API and returns the response status and body
+func do(t *testing.T, s *server, method, path, auth, body string) (int, string) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, r)
+
+	data, err := ioutil.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return w.Code, string(data)
+}
+
+// createToken creates an API token and returns its secret
+func createToken(t *testing.T, s *server, req tokenRequest) string {
+	token, secret, err := newToken(req, "admin")
+	if err != nil {
+		t.Fatalf("failed to create token: %v", err)
+	}
+	err = s.st.InsertToken(context.Background(), *token)
+	if err != nil {
+		t.Fatalf("failed to insert token: %v", err)
+	}
+	return "Bearer " + secret
+}
+
+func TestPrincipalResolution(t *testing.T) {
+	s := newTestServer(t)
+	if code, body := do(t, s, "POST", "/v1/states/team%2Fapp", basicAuth("admin", "admin-password"), testState); code != http.StatusOK {
+		t.Fatalf("failed to push state: %d %s", code, body)
+	}
+
+	admin := basicAuth("admin", "admin-password")
+	reader := basicAuth("reader", "reader-password")
+	team := createToken(t, s, tokenRequest{Name: "team", Scopes: []string{scopeRead, scopeWrite}, Prefix: "team/"})
+
+	tests := []struct {
+		desc   string
+		method string
+		path   string
+		auth   string
+		status int
+	}{
+		{"no credentials", "GET", "/v1/states", "", http.StatusUnauthorized},
+		{"a wrong password", "GET", "/v1/states", basicAuth("admin", "wrong"), http.StatusUnauthorized},
+		{"an unknown user", "GET", "/v1/states", basicAuth("nobody", "admin-password"), http.StatusUnauthorized},
+		{"an unknown token", "GET", "/v1/states", "Bearer tdb_unknown_secret", http.StatusUnauthorized},
+		{"the admin reading", "GET", "/v1/states/team%2Fapp", admin, http.StatusOK},
+		{"the admin listing tokens", "GET", "/v1/tokens", admin, http.StatusOK},
+		{"the reader reading", "GET", "/v1/states/team%2Fapp", reader, http.StatusOK},
+		{"the reader pushing", "POST", "/v1/states/team%2Fapp", reader, http.StatusForbidden},
+		{"the reader listing tokens", "GET", "/v1/tokens", reader, http.StatusForbidden},
+		{"a token in its prefix", "GET", "/v1/states/team%2Fapp", team, http.StatusOK},
+		{"a token out of its prefix", "GET", "/v1/states/other%2Fapp", team, http.StatusForbidden},
+		{"a token without the lock scope", "LOCK", "/v1/states/team%2Fapp", team, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if code, body := do(t, s, tt.method, tt.path, tt.auth, testState); code != tt.status {
+			t.Errorf("expected %d for %s, got %d %s", tt.status, tt.desc, code, body)
+		}
+	}
+}
+
+func TestAuthenticationDisabled(t *testing.T) {
+	s := newTestServer(t)
+	s.username, s.password = "", ""
+
+	if code, body := do(t, s, "GET", "/v1/tokens", "", ""); code != http.StatusOK {
+		t.Errorf("expected anonymous callers to be admins without authentication, got %d %s", code, body)
+	}
+
+	// API tokens keep their restrictions without authentication
+	token := createToken(t, s, tokenRequest{Name: "reader", Scopes: []string{scopeRead}})
+	if code, body := do(t, s, "GET", "/v1/tokens", token, ""); code != http.StatusForbidden {
+		t.Errorf("expected tokens to keep their scopes without authentication, got %d %s", code, body)
+	}
+}
+
+// testCA is a certificate authority issuing client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %v", err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a client certificate with the common name cn
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate client key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create client certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertName(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.com/ci")
+	tests := []struct {
+		cert     x509.Certificate
+		expected string
+	}{
+		{x509.Certificate{Subject: pkix.Name{CommonName: "ci"}, DNSNames: []string{"ci.example.com"}}, "ci"},
+		{x509.Certificate{DNSNames: []string{"ci.example.com", "other.example.com"}}, "ci.example.com"},
+		{x509.Certificate{EmailAddresses: []string{"ci@example.com"}}, "ci@example.com"},
+		{x509.Certificate{URIs: []*url.URL{uri}}, "spiffe://example.com/ci"},
+		{x509.Certificate{}, ""},
+	}
+	for _, tt := range tests {
+		if name := certName(&tt.cert); name != tt.expected {
+			t.Errorf("expected certificate name %q, got %q", tt.expected, name)
+		}
+	}
+}
+
+func TestClientCertAuthentication(t *testing.T) {
+	s := newTestServer(t)
+	ca := newTestCA(t)
+	var err error
+	s.clientCerts, err = newClientCertAuthenticator(TLSConfig{ClientRoleMappings: []string{"deploy-*:writer"}})
+	if err != nil {
+		t.Fatalf("failed to create client certificate authenticator: %v", err)
+	}
+	if code, body := do(t, s, "POST", "/v1/states/app", basicAuth("admin", "admin-password"), testState); code != http.StatusOK {
+		t.Fatalf("failed to push state: %d %s", code, body)
+	}
+
+	ts := httptest.NewUnstartedServer(s.routes())
+	ts.TLS = &tls.Config{
+		ClientCAs:  x509.NewCertPool(),
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	ts.TLS.ClientCAs.AddCert(ca.cert)
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	// Each request opens its own connection, with its own certificate
+	get := func(certs ...tls.Certificate) int {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+		resp, err := client.Get(ts.URL + "/v1/states/app")
+		if err != nil {
+			t.Fatalf("failed to get state: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get(); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a client certificate, got %d", code)
+	}
+	if code := get(ca.issue(t, "deploy-1")); code != http.StatusOK {
+		t.Errorf("expected the role mapping to grant read, got %d", code)
+	}
+
+	// A certificate named after a basic auth user does not get its ACLs
+	admin := ca.issue(t, "admin")
+	grant(t, s, `{"principal": "user:admin", "pattern": "**", "scopes": ["read"]}`)
+	if code := get(admin); code != http.StatusForbidden {
+		t.Errorf("expected user:admin ACLs not to apply to the certificate, got %d", code)
+	}
+	grant(t, s, `{"principal": "cert:admin", "pattern": "**", "scopes": ["read"]}`)
+	if code := get(admin); code != http.StatusOK {
+		t.Errorf("expected the certificate ACL to apply, got %d", code)
+	}
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/camptocamp/terradb/internal/storage"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Outcomes of the audited calls, derived from their status codes
+const (
+	auditSuccess  = "success"
+	auditDenied   = "denied"
+	auditConflict = "conflict"
+	auditInvalid  = "invalid"
+	auditError    = "error"
+)
+
+// auditFile mirrors the audit records to a JSON-lines file
+type auditFile struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func newAuditFile(path string) (f *auditFile, err error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %v", err)
+	}
+	return &auditFile{file: file}, nil
+}
+
+func (f *auditFile) write(record storage.AuditRecord) (err error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %v", err)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	_, err = f.file.Write(append(data, '\n'))
+	return
+}
+
+// statusRecorder records the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// audited records the calls to a mutating handler in the audit log,
+// as the action named by their route, along with the serial and lock ID
+// they carry, and their outcome
+func (s *server) audited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		record := newAuditRecord(r)
+		if record == nil {
+			handler(w, r)
+			return
+		}
+		record.Principal = getPrincipal(r).Name
+
+		if record.Name != "" {
+			// States carry their serial, and locks their ID.
+			// The body is read again by the handler.
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				err500(err, "failed to read body", w)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			var fields struct {
+				Serial int64  `json:"serial"`
+				ID     string `json:"id"`
+			}
+			json.Unmarshal(body, &fields)
+			record.Serial = fields.Serial
+			record.LockID = fields.ID
+			if id := r.URL.Query().Get("ID"); id != "" {
+				// Terraform sends the ID of its lock along with the states
+				record.LockID = id
+			}
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, r)
+
+		record.Status = rec.status
+		record.Outcome = auditOutcome(rec.status)
+		s.audit(*record)
+		return
+	}
+}
+
+// newAuditRecord returns the audit record of a call to an audited route,
+// or nil for the other routes
+func newAuditRecord(r *http.Request) *storage.AuditRecord {
+	route := mux.CurrentRoute(r)
+	if route == nil || route.GetName() == "" {
+		return nil
+	}
+
+	return &storage.AuditRecord{
+		Time:      time.Now().UTC(),
+		Action:    route.GetName(),
+		SourceIP:  sourceIP(r),
+		UserAgent: r.UserAgent(),
+		Name:      pathVars(r)["name"],
+		// Force-unlocks require a reason
+		Reason: r.URL.Query().Get("reason"),
+	}
+}
+
+// auditUnauthorized records the calls to the audited routes
+// rejected for lack of valid credentials, without a principal
+func (s *server) auditUnauthorized(r *http.Request) {
+	record := newAuditRecord(r)
+	if record == nil {
+		return
+	}
+	record.Status = http.StatusUnauthorized
+	record.Outcome = auditOutcome(record.Status)
+	s.audit(*record)
+}
+
+// audit stores an audit record, and mirrors it to the audit file.
+// Failures are logged, since the call was already answered.
+func (s *server) audit(record storage.AuditRecord) {
+	record.ID = timeID(record.Time)
+
+	ctx, cancel := s.storageContext()
+	defer cancel()
+
+	err := s.st.InsertAuditRecord(ctx, record)
+	if err != nil {
+		log.Errorf("failed to store audit record: %s", err)
+	}
+
+	if s.auditFile != nil {
+		err = s.auditFile.write(record)
+		if err != nil {
+			log.Errorf("failed to write audit record: %s", err)
+		}
+	}
+}
+
+// timeID returns a unique ID starting with a time,
+// so that the IDs sort in chronological order
+func timeID(t time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%016x%s", t.UnixNano(), hex.EncodeToString(suffix))
+}
+
+// auditOutcome returns the outcome of a call from its status code
+func auditOutcome(status int) string {
+	switch {
+	case status < 400:
+		return auditSuccess
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return auditDenied
+	case status == http.StatusConflict || status == http.StatusLocked ||
+		status == http.StatusPreconditionRequired:
+		return auditConflict
+	case status < 499:
+		return auditInvalid
+	}
+	return auditError
+}
+
+// sourceIP returns the IP address of the caller of a request
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ListAuditRecords lists the audit records, most recent first,
+// optionally filtered by state name, principal, action, outcome and time.
+// It is restricted to admins.
+func (s *server) ListAuditRecords(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, scopeAdmin, "") {
+		return
+	}
+
+	page, pageSize, err := s.parsePagination(r)
+	if err != nil {
+		err500(err, "", w)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := storage.AuditFilter{
+		Name:      query.Get("name"),
+		Principal: query.Get("principal"),
+		Action:    query.Get("action"),
+		Outcome:   query.Get("outcome"),
+	}
+	for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		v := query.Get(param)
+		if v == "" {
+			continue
+		}
+		*t, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("400 - Bad request: failed to parse %s: %s", param, err)))
+			return
+		}
+	}
+
+	coll, err := s.st.ListAuditRecords(r.Context(), filter, page, pageSize)
+	if err != nil {
+		errStorage(r.Context(), err, "failed to retrieve audit records", w)
+		return
+	}
+
+	data, err := json.Marshal(coll)
+	if err != nil {
+		err500(err, "failed to marshal audit records", w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
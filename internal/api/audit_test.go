@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/camptocamp/terradb/internal/storage"
+)
+
+func TestAuditRecords(t *testing.T) {
+	s := newTestServer(t)
+	admin := basicAuth("admin", "admin-password")
+
+	do(t, s, "POST", "/v1/states/app", basicAuth("admin", "wrong"), testState)
+	do(t, s, "POST", "/v1/states/app", "Bearer tdb_unknown_secret", testState)
+	do(t, s, "GET", "/v1/states/app", basicAuth("admin", "wrong"), "")
+	do(t, s, "POST", "/v1/states/app", basicAuth("reader", "reader-password"), testState)
+	do(t, s, "LOCK", "/v1/states/app", admin, `{"ID": "lock-id"}`)
+	if code, body := do(t, s, "DELETE", "/v1/states/app/lock?force=true&reason=stale", admin, ""); code != http.StatusOK {
+		t.Fatalf("failed to force-unlock state: %d %s", code, body)
+	}
+
+	coll, err := s.st.ListAuditRecords(context.Background(), storage.AuditFilter{}, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit records: %v", err)
+	}
+
+	expected := []storage.AuditRecord{
+		{Action: "force_unlock_state", Outcome: auditSuccess, Status: http.StatusOK, Principal: "admin", Reason: "stale"},
+		{Action: "lock_state", Outcome: auditSuccess, Status: http.StatusOK, Principal: "admin", LockID: "lock-id"},
+		{Action: "insert_state", Outcome: auditDenied, Status: http.StatusForbidden, Principal: "reader", Serial: 1},
+		// Calls without valid credentials are recorded,
+		// but only on the audited routes
+		{Action: "insert_state", Outcome: auditDenied, Status: http.StatusUnauthorized},
+		{Action: "insert_state", Outcome: auditDenied, Status: http.StatusUnauthorized},
+	}
+	if len(coll.Data) != len(expected) {
+		t.Fatalf("expected %d audit records, got %d", len(expected), len(coll.Data))
+	}
+	for i, want := range expected {
+		got := coll.Data[i]
+		if got.Action != want.Action || got.Outcome != want.Outcome || got.Status != want.Status ||
+			got.Principal != want.Principal || got.Reason != want.Reason ||
+			got.LockID != want.LockID || got.Serial != want.Serial || got.Name != "app" {
+			t.Errorf("record %d: expected %+v, got %+v", i, want, *got)
+		}
+	}
+}
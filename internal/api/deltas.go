@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/camptocamp/terradb/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// DeltaStats returns the space saved by delta-encoded serials.
+// It is restricted to admins.
+func (s *server) DeltaStats(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, scopeAdmin, "") {
+		return
+	}
+
+	ds, ok := storage.Deltas(s.st)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("501 - Not implemented: the storage does not support deltas"))
+		return
+	}
+
+	stats, err := ds.DeltaStats(r.Context())
+	if err != nil {
+		errStorage(r.Context(), err, "failed to retrieve delta statistics", w)
+		return
+	}
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		err500(err, "failed to marshal delta statistics", w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+// Compact starts a compaction of the serials in the background.
+// It is restricted to admins.
+func (s *server) Compact(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, scopeAdmin, "") {
+		return
+	}
+
+	ds, ok := storage.Deltas(s.st)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("501 - Not implemented: the storage does not support deltas"))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"started_by": getPrincipal(r).Name,
+	}).Info("Starting compaction")
+	go s.compact(ds)
+
+	w.WriteHeader(http.StatusAccepted)
+	return
+}
+
+// compactSerials periodically compacts the serials
+func (s *server) compactSerials(ds storage.DeltaStorage, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		s.compact(ds)
+	}
+}
+
+// compact compacts the serials, unless a compaction is already running.
+// Compactions are not bounded by the storage timeout,
+// since they go through all the serials.
+func (s *server) compact(ds storage.DeltaStorage) {
+	if !atomic.CompareAndSwapInt32(&s.compacting, 0, 1) {
+		log.Info("Compaction already running")
+		return
+	}
+	defer atomic.StoreInt32(&s.compacting, 0)
+
+	start := time.Now()
+	err := ds.Compact(context.Background())
+	if err != nil {
+		log.Errorf("failed to compact serials: %s", err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"duration": time.Since(start),
+	}).Info("Compacted serials")
+}
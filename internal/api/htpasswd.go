@@ -0,0 +1,234 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdPollInterval is how often the htpasswd file is checked for changes
+const htpasswdPollInterval = 5 * time.Second
+
+// htpasswdCacheTTL is how long a successful verification is cached,
+// not to compare a bcrypt hash on every request of a user
+const htpasswdCacheTTL = time.Minute
+
+// htpasswdUser is a user of an htpasswd file
+type htpasswdUser struct {
+	hash  []byte
+	roles []string
+}
+
+// htpasswdFile authenticates the callers with basic auth
+// against the bcrypt hashes of an htpasswd file, whose lines
+// are <user>:<hash>, optionally followed by :<role>[,<role>...].
+type htpasswdFile struct {
+	path string
+
+	// dummyHash is compared to the passwords of unknown users,
+	// so that they take as long to reject as the known users
+	dummyHash []byte
+
+	mutex   sync.RWMutex
+	users   map[string]*htpasswdUser
+	modTime time.Time
+	size    int64
+
+	// verified holds the expiry of the successful verifications,
+	// by the SHA-256 checksum of the user and password.
+	// It is emptied when the file is loaded again.
+	verified map[[sha256.Size]byte]time.Time
+}
+
+func newHtpasswdFile(path string) (h *htpasswdFile, err error) {
+	h = &htpasswdFile{path: path}
+
+	secret := make([]byte, 16)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return h, fmt.Errorf("failed to generate dummy password: %v", err)
+	}
+	h.dummyHash, err = bcrypt.GenerateFromPassword(secret, bcrypt.DefaultCost)
+	if err != nil {
+		return h, fmt.Errorf("failed to hash dummy password: %v", err)
+	}
+
+	err = h.load()
+	return
+}
+
+// load reads the htpasswd file. On error, the users are kept as they were,
+// and the file is only read again once it changes.
+func (h *htpasswdFile) load() (err error) {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %v", err)
+	}
+	data, err := ioutil.ReadFile(h.path)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %v", err)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+
+	users, err := parseHtpasswd(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse htpasswd file %s: %v", h.path, err)
+	}
+	h.users = users
+	h.verified = make(map[[sha256.Size]byte]time.Time)
+	return
+}
+
+func parseHtpasswd(data []byte) (users map[string]*htpasswdUser, err error) {
+	users = make(map[string]*htpasswdUser)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("line %d: expected <user>:<hash>[:<roles>]", n)
+		}
+
+		user := &htpasswdUser{hash: []byte(fields[1])}
+		if _, err = bcrypt.Cost(user.hash); err != nil {
+			return nil, fmt.Errorf("line %d: only bcrypt hashes are supported: %v", n, err)
+		}
+		if len(fields) == 3 && fields[2] != "" {
+			for _, role := range strings.Split(fields[2], ",") {
+				if _, ok := roles[role]; !ok {
+					return nil, fmt.Errorf("line %d: unknown role %s", n, role)
+				}
+				user.roles = append(user.roles, role)
+			}
+		}
+		users[fields[0]] = user
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// watch loads the htpasswd file again on SIGHUP,
+// or when its modification time or size changes
+func (h *htpasswdFile) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			info, err := os.Stat(h.path)
+			if err != nil {
+				log.Errorf("failed to check htpasswd file: %s", err)
+				continue
+			}
+			h.mutex.RLock()
+			changed := !info.ModTime().Equal(h.modTime) || info.Size() != h.size
+			h.mutex.RUnlock()
+			if !changed {
+				continue
+			}
+		}
+
+		err := h.load()
+		if err != nil {
+			log.Errorf("failed to reload htpasswd file: %s", err)
+			continue
+		}
+
+		h.mutex.RLock()
+		log.Infof("Reloaded %d users from %s", len(h.users), h.path)
+		h.mutex.RUnlock()
+	}
+}
+
+// principal returns the principal authenticated by a basic auth
+// Authorization header, or nil if the credentials are invalid
+func (h *htpasswdFile) principal(authorizationHeader string) *principal {
+	s := strings.SplitN(authorizationHeader, " ", 2)
+	if len(s) != 2 || strings.ToLower(s[0]) != "basic" {
+		return nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s[1])
+	if err != nil {
+		return nil
+	}
+	pair := strings.SplitN(string(b), ":", 2)
+	if len(pair) != 2 {
+		return nil
+	}
+
+	key := sha256.Sum256([]byte(pair[0] + "\x00" + pair[1]))
+	h.mutex.RLock()
+	user, ok := h.users[pair[0]]
+	expires, cached := h.verified[key]
+	h.mutex.RUnlock()
+
+	if !ok {
+		bcrypt.CompareHashAndPassword(h.dummyHash, []byte(pair[1]))
+		return nil
+	}
+	if !cached || time.Now().After(expires) {
+		if bcrypt.CompareHashAndPassword(user.hash, []byte(pair[1])) != nil {
+			return nil
+		}
+		h.remember(pair[0], user, key)
+	}
+
+	p := &principal{
+		Name:     pair[0],
+		Scopes:   newScopes(),
+		Subjects: []string{"user:" + pair[0]},
+	}
+	for _, role := range user.roles {
+		p.grant(role)
+	}
+	return p
+}
+
+// remember caches the successful verification of a user's password,
+// unless the file was loaded again meanwhile. The expired verifications
+// are removed at the same time.
+func (h *htpasswdFile) remember(name string, user *htpasswdUser, key [sha256.Size]byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.users[name] != user {
+		return
+	}
+
+	now := time.Now()
+	for k, expires := range h.verified {
+		if now.After(expires) {
+			delete(h.verified, k)
+		}
+	}
+	h.verified[key] = now.Add(htpasswdCacheTTL)
+}
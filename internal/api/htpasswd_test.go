@@ -0,0 +1,72 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeHtpasswd writes an htpasswd file with a single user
+func writeHtpasswd(t *testing.T, path, user, password, roles string) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	err = ioutil.WriteFile(path, []byte(user+":"+string(hash)+":"+roles+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write htpasswd file: %v", err)
+	}
+}
+
+func TestHtpasswdVerificationCache(t *testing.T) {
+	f, err := ioutil.TempFile("", "terradb-htpasswd")
+	if err != nil {
+		t.Fatalf("failed to create htpasswd file: %v", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	writeHtpasswd(t, f.Name(), "alice", "old-password", "writer")
+	h, err := newHtpasswdFile(f.Name())
+	if err != nil {
+		t.Fatalf("failed to load htpasswd file: %v", err)
+	}
+
+	if p := h.principal(basicAuth("alice", "wrong")); p != nil {
+		t.Errorf("expected a wrong password to be rejected")
+	}
+	if len(h.verified) != 0 {
+		t.Errorf("expected failed verifications not to be cached")
+	}
+
+	for i := 0; i < 2; i++ {
+		p := h.principal(basicAuth("alice", "old-password"))
+		if p == nil {
+			t.Fatalf("expected alice to be authenticated")
+		}
+		if !p.Scopes[scopeWrite] {
+			t.Errorf("expected alice to be granted the writer role, got %v", p.Scopes)
+		}
+	}
+	if len(h.verified) != 1 {
+		t.Errorf("expected the successful verification to be cached, got %d entries", len(h.verified))
+	}
+
+	// Changing the password invalidates the cached verifications
+	writeHtpasswd(t, f.Name(), "alice", "new-password", "reader")
+	if err = h.load(); err != nil {
+		t.Fatalf("failed to reload htpasswd file: %v", err)
+	}
+	if p := h.principal(basicAuth("alice", "old-password")); p != nil {
+		t.Errorf("expected the former password to be rejected after a reload")
+	}
+	p := h.principal(basicAuth("alice", "new-password"))
+	if p == nil {
+		t.Fatalf("expected the new password to be accepted")
+	}
+	if p.Scopes[scopeWrite] {
+		t.Errorf("expected alice to lose the writer role, got %v", p.Scopes)
+	}
+}
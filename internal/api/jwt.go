@@ -0,0 +1,487 @@
+package api
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// jwksRefreshInterval is how often the JWKS is loaded again,
+// to follow the rotations of the signing keys
+const jwksRefreshInterval = time.Hour
+
+// jwksMinRefreshInterval limits the loads of the JWKS
+// triggered by JWTs signed with unknown keys
+const jwksMinRefreshInterval = time.Minute
+
+// jwtLeeway is the clock skew tolerated on the exp and nbf claims
+const jwtLeeway = time.Minute
+
+// JWTConfig configures the authentication with JWTs,
+// such as the OIDC tokens of CI runners or the tokens of an SSO.
+type JWTConfig struct {
+	// JWKS is the file or URL of the JSON Web Key Set which verifies
+	// the JWTs. JWTs are not accepted if it is empty.
+	JWKS string
+	// Issuer and Audience are the expected iss and aud claims,
+	// which are required
+	Issuer   string
+	Audience string
+
+	// UserClaim names the principal, and GroupClaims
+	// are the claims whose values are its groups
+	UserClaim   string
+	GroupClaims []string
+
+	// RoleMappings grant roles to the principals with a claim
+	// matching a pattern, as <claim>=<pattern>:<role>
+	RoleMappings []string
+}
+
+// roleMapping grants a role to the principals
+// whose claim has a value matching pattern
+type roleMapping struct {
+	claim   string
+	pattern string
+	role    string
+}
+
+// jwtAuthenticator authenticates the callers with JWTs
+type jwtAuthenticator struct {
+	cfg      JWTConfig
+	mappings []roleMapping
+	client   *http.Client
+
+	mutex  sync.RWMutex
+	keys   map[string]crypto.PublicKey
+	loaded time.Time
+}
+
+// jwtHeader is the header of a JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwk is a JSON Web Key, either RSA or EC
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newJWTAuthenticator(cfg JWTConfig) (a *jwtAuthenticator, err error) {
+	a = &jwtAuthenticator{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout:       10 * time.Second,
+			CheckRedirect: httpsRedirect,
+		},
+	}
+	if a.cfg.UserClaim == "" {
+		a.cfg.UserClaim = "sub"
+	}
+
+	// Without them, the JWTs issued by other issuers sharing the keys,
+	// or for other services, would be accepted
+	if cfg.Issuer == "" {
+		return a, fmt.Errorf("a JWT issuer is required")
+	}
+	if cfg.Audience == "" {
+		return a, fmt.Errorf("a JWT audience is required")
+	}
+
+	// Keys fetched in clear could be replaced on the way,
+	// to sign any JWT
+	if strings.Contains(cfg.JWKS, "://") && !strings.HasPrefix(cfg.JWKS, "https://") {
+		return a, fmt.Errorf("the JWKS %s must be a file or an HTTPS URL", cfg.JWKS)
+	}
+
+	for _, m := range cfg.RoleMappings {
+		mapping, err := parseRoleMapping(m)
+		if err != nil {
+			return a, err
+		}
+		a.mappings = append(a.mappings, mapping)
+	}
+
+	err = a.loadKeys()
+	return
+}
+
+// parseRoleMapping parses a <claim>=<pattern>:<role> role mapping.
+// The pattern may contain colons, as GitHub's sub claims do.
+func parseRoleMapping(m string) (mapping roleMapping, err error) {
+	eq := strings.Index(m, "=")
+	colon := strings.LastIndex(m, ":")
+	if eq <= 0 || colon < eq {
+		return mapping, fmt.Errorf("invalid role mapping %q, expected <claim>=<pattern>:<role>", m)
+	}
+
+	mapping = roleMapping{
+		claim:   m[:eq],
+		pattern: m[eq+1 : colon],
+		role:    m[colon+1:],
+	}
+	if _, ok := roles[mapping.role]; !ok {
+		return mapping, fmt.Errorf("unknown role %s in role mapping %q", mapping.role, m)
+	}
+	if _, err = path.Match(mapping.pattern, ""); err != nil {
+		return mapping, fmt.Errorf("invalid pattern in role mapping %q: %v", m, err)
+	}
+	return
+}
+
+// refreshKeys periodically loads the JWKS again
+func (a *jwtAuthenticator) refreshKeys(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		err := a.loadKeys()
+		if err != nil {
+			log.Errorf("failed to refresh JWKS: %s", err)
+		}
+	}
+}
+
+// loadKeys loads the JWKS from its file or URL.
+// The keys which cannot verify ES256 or RS256 signatures are ignored.
+func (a *jwtAuthenticator) loadKeys() (err error) {
+	var data []byte
+	if strings.HasPrefix(a.cfg.JWKS, "https://") {
+		data, err = a.fetchKeys()
+	} else {
+		data, err = ioutil.ReadFile(a.cfg.JWKS)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load JWKS: %v", err)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return fmt.Errorf("failed to parse JWKS %s: %v", a.cfg.JWKS, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("invalid key %s in JWKS %s: %v", k.Kid, a.cfg.JWKS, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no RSA or P-256 signing key in JWKS %s", a.cfg.JWKS)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.keys = keys
+	a.loaded = time.Now()
+	return
+}
+
+func (a *jwtAuthenticator) fetchKeys() (data []byte, err error) {
+	resp, err := a.client.Get(a.cfg.JWKS)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// httpsRedirect refuses the redirections of the JWKS URL to plain HTTP
+func httpsRedirect(req *http.Request, via []*http.Request) error {
+	if req.URL.Scheme != "https" {
+		return fmt.Errorf("refusing to follow the redirection to %s", req.URL)
+	}
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// publicKey returns the key of a JWK,
+// or nil for the key types which are not supported
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode modulus: %v", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode exponent: %v", err)
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 || exp.Int64() < 3 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode x: %v", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode y: %v", err)
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point not on curve")
+		}
+		return key, nil
+	}
+	return nil, nil
+}
+
+// key returns the key verifying a JWT. Unknown keys load the JWKS again,
+// at most once every jwksMinRefreshInterval, in case the keys were rotated.
+func (a *jwtAuthenticator) key(kid string) (key crypto.PublicKey, err error) {
+	for retry := true; ; retry = false {
+		var ok bool
+		a.mutex.RLock()
+		key, ok = a.keys[kid]
+		if !ok && kid == "" && len(a.keys) == 1 {
+			for _, k := range a.keys {
+				key, ok = k, true
+			}
+		}
+		stale := time.Since(a.loaded) > jwksMinRefreshInterval
+		a.mutex.RUnlock()
+
+		if ok {
+			return key, nil
+		}
+		if !retry || !stale {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		err = a.loadKeys()
+		if err != nil {
+			log.Errorf("failed to refresh JWKS: %s", err)
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+	}
+}
+
+// isJWT tells whether a token looks like a JWT,
+// so that other credentials are not checked as JWTs
+func isJWT(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	var header jwtHeader
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil {
+		return false
+	}
+	return header.Alg != ""
+}
+
+// verify checks the signature, expiry, issuer and audience of a JWT,
+// and returns its claims
+func (a *jwtAuthenticator) verify(token string) (claims map[string]interface{}, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header jwtHeader
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(data, &header)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed header: %v", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %v", err)
+	}
+
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return
+	}
+
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("unexpected algorithm %s for an RSA key", header.Alg)
+		}
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) != nil {
+			return nil, fmt.Errorf("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" {
+			return nil, fmt.Errorf("unexpected algorithm %s for an EC key", header.Alg)
+		}
+		if len(sig) != 64 {
+			return nil, fmt.Errorf("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, sum[:], r, s) {
+			return nil, fmt.Errorf("invalid signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key")
+	}
+
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err = dec.Decode(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+
+	now := time.Now()
+	exp, ok := timeClaim(claims, "exp")
+	if !ok {
+		return nil, fmt.Errorf("missing exp claim")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := timeClaim(claims, "nbf"); ok && now.Before(nbf.Add(-jwtLeeway)) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+
+	if claims["iss"] != a.cfg.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if !containsString(claimValues(claims, "aud"), a.cfg.Audience) {
+		return nil, fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+	return
+}
+
+// principal returns the principal of a JWT, named by the user claim,
+// with the groups and roles of its claims. Its subject is qualified
+// by the issuer, not to be granted the ACLs of the other users.
+func (a *jwtAuthenticator) principal(token string) (p *principal, err error) {
+	claims, err := a.verify(token)
+	if err != nil {
+		return
+	}
+
+	users := claimValues(claims, a.cfg.UserClaim)
+	if len(users) != 1 || users[0] == "" {
+		return nil, fmt.Errorf("missing %s claim", a.cfg.UserClaim)
+	}
+
+	p = &principal{
+		Name:     users[0],
+		Scopes:   newScopes(),
+		Subjects: []string{jwtSubject(a.cfg.Issuer, users[0])},
+	}
+	for _, claim := range a.cfg.GroupClaims {
+		for _, group := range claimValues(claims, claim) {
+			p.Subjects = append(p.Subjects, "group:"+group)
+		}
+	}
+	for _, m := range a.mappings {
+		for _, v := range claimValues(claims, m.claim) {
+			if ok, _ := path.Match(m.pattern, v); ok {
+				p.grant(m.role)
+				break
+			}
+		}
+	}
+	return
+}
+
+// jwtSubject returns the ACL subject of a JWT user
+func jwtSubject(issuer, user string) string {
+	return "jwt:" + issuer + "/" + user
+}
+
+// claimValues returns the values of a claim,
+// which may be a single value or a list
+func claimValues(claims map[string]interface{}, name string) (values []string) {
+	switch v := claims[name].(type) {
+	case nil:
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+	case string:
+		values = append(values, v)
+	default:
+		values = append(values, fmt.Sprint(v))
+	}
+	return
+}
+
+// timeClaim returns a NumericDate claim
+func timeClaim(claims map[string]interface{}, name string) (t time.Time, ok bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return t, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://sso.example.com"
+	testAudience = "terradb"
+)
+
+// newTestJWT returns an authenticator trusting a new RSA key,
+// and a function signing claims with it
+func newTestJWT(t *testing.T) (*jwtAuthenticator, func(claims map[string]interface{}) string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	jwks, err := json.Marshal(map[string][]jwk{"keys": {{
+		Kty: "RSA",
+		Kid: "test",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	if err != nil {
+		t.Fatalf("failed to marshal JWKS: %v", err)
+	}
+	f, err := ioutil.TempFile("", "terradb-jwks")
+	if err != nil {
+		t.Fatalf("failed to create JWKS file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(jwks)
+	f.Close()
+
+	a, err := newJWTAuthenticator(JWTConfig{
+		JWKS:        f.Name(),
+		Issuer:      testIssuer,
+		Audience:    testAudience,
+		GroupClaims: []string{"groups"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create JWT authenticator: %v", err)
+	}
+
+	sign := func(claims map[string]interface{}) string {
+		header, _ := json.Marshal(jwtHeader{Alg: "RS256", Kid: "test"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		sum := sha256.Sum256([]byte(signed))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatalf("failed to sign JWT: %v", err)
+		}
+		return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+	return a, sign
+}
+
+func TestJWTConfigRefused(t *testing.T) {
+	for _, cfg := range []JWTConfig{
+		{JWKS: "jwks.json", Audience: testAudience},
+		{JWKS: "jwks.json", Issuer: testIssuer},
+		{JWKS: "http://sso.example.com/jwks.json", Issuer: testIssuer, Audience: testAudience},
+		{JWKS: "ftp://sso.example.com/jwks.json", Issuer: testIssuer, Audience: testAudience},
+	} {
+		if _, err := newJWTAuthenticator(cfg); err == nil {
+			t.Errorf("expected %+v to be refused", cfg)
+		}
+	}
+}
+
+func TestJWTPrincipal(t *testing.T) {
+	a, sign := newTestJWT(t)
+	exp := time.Now().Add(time.Hour).Unix()
+
+	p, err := a.principal(sign(map[string]interface{}{
+		"iss": testIssuer, "aud": testAudience, "exp": exp, "sub": "alice", "groups": []string{"ops"},
+	}))
+	if err != nil {
+		t.Fatalf("expected a valid JWT to be accepted, got %v", err)
+	}
+	if p.Name != "alice" {
+		t.Errorf("expected the principal to be named alice, got %s", p.Name)
+	}
+	expected := []string{"jwt:" + testIssuer + "/alice", "group:ops"}
+	if len(p.Subjects) != len(expected) || p.Subjects[0] != expected[0] || p.Subjects[1] != expected[1] {
+		t.Errorf("expected subjects %v, got %v", expected, p.Subjects)
+	}
+
+	tests := []struct {
+		desc   string
+		claims map[string]interface{}
+	}{
+		{"another issuer", map[string]interface{}{"iss": "https://other.example.com", "aud": testAudience, "exp": exp, "sub": "alice"}},
+		{"no issuer", map[string]interface{}{"aud": testAudience, "exp": exp, "sub": "alice"}},
+		{"another audience", map[string]interface{}{"iss": testIssuer, "aud": "other", "exp": exp, "sub": "alice"}},
+		{"no audience", map[string]interface{}{"iss": testIssuer, "exp": exp, "sub": "alice"}},
+		{"an expired token", map[string]interface{}{"iss": testIssuer, "aud": testAudience, "exp": time.Now().Add(-time.Hour).Unix(), "sub": "alice"}},
+	}
+	for _, tt := range tests {
+		if _, err := a.principal(sign(tt.claims)); err == nil {
+			t.Errorf("expected a JWT with %s to be rejected", tt.desc)
+		}
+	}
+}
+
+func TestJWTACLs(t *testing.T) {
+	s := newTestServer(t)
+	a, sign := newTestJWT(t)
+	s.jwt = a
+	alice := "Bearer " + sign(map[string]interface{}{
+		"iss": testIssuer, "aud": testAudience, "exp": time.Now().Add(time.Hour).Unix(), "sub": "alice",
+	})
+
+	if code, body := do(t, s, "POST", "/v1/states/app", basicAuth("admin", "admin-password"), testState); code != http.StatusOK {
+		t.Fatalf("failed to push state: %d %s", code, body)
+	}
+
+	// The ACLs of the basic auth user alice are not granted to the JWT user
+	grant(t, s, `{"principal": "user:alice", "pattern": "**", "scopes": ["read"]}`)
+	if code, body := do(t, s, "GET", "/v1/states/app", alice, ""); code != http.StatusForbidden {
+		t.Errorf("expected user:alice ACLs not to apply to the JWT user, got %d %s", code, body)
+	}
+
+	grant(t, s, `{"principal": "jwt:`+testIssuer+`/alice", "pattern": "**", "scopes": ["read"]}`)
+	if code, body := do(t, s, "GET", "/v1/states/app", alice, ""); code != http.StatusOK {
+		t.Errorf("expected the JWT user ACL to apply, got %d %s", code, body)
+	}
+}
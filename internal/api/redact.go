@@ -0,0 +1,248 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// redactedValue replaces the values of sensitive outputs and attributes
+const redactedValue = "(sensitive value)"
+
+// redactor masks the secrets of states and resources returned
+// to the callers which cannot read secrets
+//
+// Patterns are glob patterns matched case-insensitively against
+// attribute names, e.g. password or *_token. Patterns with dots are
+// matched against the whole attribute path, where * matches one
+// path element, e.g. *.secret matches tags.secret but not secret.
+type redactor struct {
+	patterns []string
+}
+
+func newRedactor(patterns []string) (rd *redactor, err error) {
+	rd = &redactor{}
+	for _, pattern := range patterns {
+		p := strings.ToLower(strings.Replace(pattern, ".", "/", -1))
+		_, err = path.Match(p, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %s: %v", pattern, err)
+		}
+		rd.patterns = append(rd.patterns, p)
+	}
+	return
+}
+
+// canReadSecrets tells whether the caller of a request
+// gets a state and its resources unredacted,
+// either by its own scopes or by an ACL
+func canReadSecrets(r *http.Request, name string) bool {
+	return getPrincipal(r).can(scopeReadSecrets, name)
+}
+
+// hasRedactedValues tells whether a pushed state holds redacted values,
+// which means that it was built from a redacted state
+func hasRedactedValues(body []byte) bool {
+	placeholder, _ := json.Marshal(redactedValue)
+	return bytes.Contains(body, placeholder)
+}
+
+// redactJSON applies redact to a JSON object.
+// Numbers are kept as is, but keys are sorted.
+func redactJSON(data []byte, redact func(map[string]interface{})) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var doc interface{}
+	err := dec.Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode document: %v", err)
+	}
+
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return data, nil
+	}
+	redact(m)
+	return json.Marshal(m)
+}
+
+// collection returns a function which redacts the states of a paginated
+// collection whose secrets the caller of a request cannot read
+func (rd *redactor) collection(r *http.Request) func(map[string]interface{}) {
+	return func(coll map[string]interface{}) {
+		for _, s := range asList(coll["data"]) {
+			m, ok := s.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if name, _ := m["name"].(string); !canReadSecrets(r, name) {
+				rd.state(m)
+			}
+		}
+	}
+}
+
+// state redacts a version 3 or 4 state
+func (rd *redactor) state(s map[string]interface{}) {
+	// Backend configurations often hold credentials
+	for _, k := range []string{"backend", "remote"} {
+		if b, ok := s[k].(map[string]interface{}); ok {
+			rd.attributes(b["config"], nil)
+		}
+	}
+
+	redactOutputs(s["outputs"])
+	for _, r := range asList(s["resources"]) {
+		if m, ok := r.(map[string]interface{}); ok {
+			rd.resource(m)
+		}
+	}
+
+	for _, mod := range asList(s["modules"]) {
+		m, ok := mod.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		redactOutputs(m["outputs"])
+		resources, _ := m["resources"].(map[string]interface{})
+		for _, r := range resources {
+			if rm, ok := r.(map[string]interface{}); ok {
+				rd.resource(rm)
+			}
+		}
+	}
+}
+
+// resource redacts the instances of a version 3 or 4 resource
+func (rd *redactor) resource(r map[string]interface{}) {
+	// Version 4 resources have their instances in a list
+	if instances, ok := r["instances"]; ok {
+		for _, i := range asList(instances) {
+			inst, ok := i.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if attrs, ok := inst["attributes"]; ok {
+				for _, p := range asList(inst["sensitive_attributes"]) {
+					attrs = redactPath(attrs, asList(p))
+				}
+				inst["attributes"] = rd.attributes(attrs, nil)
+			}
+			rd.flatAttributes(inst["attributes_flat"])
+		}
+		return
+	}
+
+	instances := append([]interface{}{r["primary"]}, asList(r["deposed"])...)
+	for _, i := range instances {
+		if inst, ok := i.(map[string]interface{}); ok {
+			rd.flatAttributes(inst["attributes"])
+		}
+	}
+}
+
+// attributes redacts the nested attributes matching the patterns
+func (rd *redactor) attributes(v interface{}, p []string) interface{} {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		for k, child := range c {
+			cp := append(append([]string{}, p...), k)
+			if rd.match(cp) {
+				c[k] = redactedValue
+				continue
+			}
+			c[k] = rd.attributes(child, cp)
+		}
+	case []interface{}:
+		for i, child := range c {
+			c[i] = rd.attributes(child, append(append([]string{}, p...), strconv.Itoa(i)))
+		}
+	}
+	return v
+}
+
+// flatAttributes redacts the flatmapped attributes matching the patterns
+func (rd *redactor) flatAttributes(v interface{}) {
+	attrs, _ := v.(map[string]interface{})
+	for k := range attrs {
+		if rd.match(strings.Split(k, ".")) {
+			attrs[k] = redactedValue
+		}
+	}
+}
+
+// match tells whether an attribute path matches any pattern
+func (rd *redactor) match(p []string) bool {
+	if len(p) == 0 {
+		return false
+	}
+	full := strings.ToLower(strings.Join(p, "/"))
+	name := strings.ToLower(p[len(p)-1])
+
+	for _, pattern := range rd.patterns {
+		target := name
+		if strings.Contains(pattern, "/") {
+			target = full
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// redactOutputs redacts the outputs flagged as sensitive
+func redactOutputs(v interface{}) {
+	outputs, _ := v.(map[string]interface{})
+	for _, o := range outputs {
+		out, ok := o.(map[string]interface{})
+		if ok && out["sensitive"] == true {
+			out["value"] = redactedValue
+		}
+	}
+}
+
+// redactPath redacts the attribute at a path of version 4
+// sensitive_attributes, made of get_attr and index steps
+func redactPath(v interface{}, steps []interface{}) interface{} {
+	if len(steps) == 0 {
+		return redactedValue
+	}
+	step, _ := steps[0].(map[string]interface{})
+
+	switch step["type"] {
+	case "get_attr":
+		name, _ := step["value"].(string)
+		if m, ok := v.(map[string]interface{}); ok {
+			if child, ok := m[name]; ok {
+				m[name] = redactPath(child, steps[1:])
+			}
+		}
+	case "index":
+		key, _ := step["value"].(map[string]interface{})
+		switch c := v.(type) {
+		case map[string]interface{}:
+			k, _ := key["value"].(string)
+			if child, ok := c[k]; ok {
+				c[k] = redactPath(child, steps[1:])
+			}
+		case []interface{}:
+			n, _ := key["value"].(json.Number)
+			i, err := n.Int64()
+			if err == nil && i >= 0 && i < int64(len(c)) {
+				c[i] = redactPath(c[i], steps[1:])
+			}
+		}
+	}
+	return v
+}
+
+func asList(v interface{}) []interface{} {
+	l, _ := v.([]interface{})
+	return l
+}
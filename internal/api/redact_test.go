@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	s := newTestServer(t)
+	admin := basicAuth("admin", "admin-password")
+	reader := basicAuth("reader", "reader-password")
+
+	if code, body := do(t, s, "POST", "/v1/states/team%2Fapp", admin, testState); code != http.StatusOK {
+		t.Fatalf("failed to push state: %d %s", code, body)
+	}
+
+	paths := []string{
+		"/v1/states/team%2Fapp",
+		"/v1/states/team%2Fapp?metadata=true",
+		"/v1/states",
+		"/v1/states/team%2Fapp/serials",
+		"/v1/resources/team%2Fapp/null_resource.foo",
+	}
+	for _, path := range paths {
+		code, body := do(t, s, "GET", path, admin, "")
+		if code != http.StatusOK {
+			t.Fatalf("failed to get %s: %d %s", path, code, body)
+		}
+		if strings.Contains(body, redactedValue) {
+			t.Errorf("expected %s not to be redacted for the admin, got %s", path, body)
+		}
+
+		code, body = do(t, s, "GET", path, reader, "")
+		if code != http.StatusOK {
+			t.Fatalf("failed to get %s: %d %s", path, code, body)
+		}
+		if strings.Contains(body, "hunter2") || !strings.Contains(body, redactedValue) {
+			t.Errorf("expected %s to be redacted for the reader, got %s", path, body)
+		}
+	}
+
+	// The read-secrets scope can be granted by an ACL
+	grant(t, s, `{"principal": "user:reader", "pattern": "team/**", "scopes": ["read-secrets"]}`)
+
+	for _, path := range paths {
+		if _, body := do(t, s, "GET", path, reader, ""); strings.Contains(body, redactedValue) {
+			t.Errorf("expected %s not to be redacted with the ACL, got %s", path, body)
+		}
+	}
+}
+
+func TestPushRedactedState(t *testing.T) {
+	s := newTestServer(t)
+	admin := basicAuth("admin", "admin-password")
+
+	redacted := strings.Replace(testState, `"hunter2"`, `"`+redactedValue+`"`, -1)
+	if code, body := do(t, s, "POST", "/v1/states/team%2Fapp", admin, redacted); code != http.StatusBadRequest {
+		t.Errorf("expected pushing a redacted state to be rejected, got %d %s", code, body)
+	}
+	if code, _ := do(t, s, "GET", "/v1/states/team%2Fapp", admin, ""); code != http.StatusNotFound {
+		t.Errorf("expected the redacted state not to be written, got %d", code)
+	}
+}
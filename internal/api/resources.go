@@ -5,11 +5,10 @@ import (
 	"net/http"
 
 	"github.com/camptocamp/terradb/internal/storage"
-	"github.com/gorilla/mux"
 )
 
 func (s *server) GetResource(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
+	params := pathVars(r)
 
 	state := params["state"]
 	module, ok := params["module"]
@@ -18,12 +17,16 @@ func (s *server) GetResource(w http.ResponseWriter, r *http.Request) {
 	}
 	name := params["name"]
 
-	document, err := s.st.GetResource(state, module, name)
+	if !authorize(w, r, scopeRead, state) {
+		return
+	}
+
+	document, err := s.st.GetResource(r.Context(), state, module, name)
 	if err == storage.ErrNoDocuments {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	} else if err != nil {
-		err500(err, "failed to retrieve latest state", w)
+		errStorage(r.Context(), err, "failed to retrieve latest state", w)
 		return
 	}
 
@@ -33,6 +36,14 @@ func (s *server) GetResource(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !canReadSecrets(r, state) {
+		data, err = redactJSON(data, s.redactor.resource)
+		if err != nil {
+			err500(err, "failed to redact resource", w)
+			return
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 	return
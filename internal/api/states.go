@@ -1,19 +1,32 @@
 package api
 
 import (
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/camptocamp/terradb/internal/storage"
-	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
 )
 
 func (s *server) InsertState(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
+	params := pathVars(r)
+	if !authorize(w, r, scopeWrite, params["name"]) {
+		return
+	}
+
+	err := storage.CheckName(params["name"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400 - Bad request: %s", err)))
+		return
+	}
 
 	timestamp, ok := params["timestamp"]
 	if !ok {
@@ -25,20 +38,100 @@ func (s *server) InsertState(w http.ResponseWriter, r *http.Request) {
 		source = "direct"
 	}
 
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err500(err, "failed to read body", w)
+		return
+	}
+
+	// Terraform sends the checksum of the state it pushes
+	sum := md5.Sum(body)
+	checksum := base64.StdEncoding.EncodeToString(sum[:])
+	if v := r.Header.Get("Content-MD5"); v != "" && v != checksum {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400 - Bad request: Content-MD5 %s does not match the body checksum %s", v, checksum)))
+		return
+	}
+
 	var document storage.State
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&document)
+	err = json.Unmarshal(body, &document)
 	if err != nil {
 		err500(err, "failed to decode body", w)
 		return
 	}
 
-	err = s.st.InsertState(document, timestamp, source, params["name"])
+	// A state built from a redacted one would overwrite the secrets
+	// with the placeholders
+	if hasRedactedValues(body) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400 - Bad request: the state holds redacted values %s, it was read without the %s scope", redactedValue, scopeReadSecrets)))
+		return
+	}
+
+	// Keep the document as pushed, so that it can be served back as is
+	document.Raw = body
+	document.MD5 = checksum
+
+	// Both version 3 (Terraform < 0.12) and version 4 states are stored
+	err = document.CheckVersion()
 	if err != nil {
-		err500(err, "failed to insert state", w)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400 - Bad request: %s", err)))
 		return
 	}
 
+	// The storage checks the lock and the history along with the write,
+	// so that concurrent pushes cannot both pass the checks.
+	// Terraform sends the ID of its lock when locking is enabled.
+	force := r.URL.Query().Get("force") == "true"
+	cond := storage.InsertConditions{
+		CheckLock:    true,
+		LockID:       r.URL.Query().Get("ID"),
+		RequireLock:  s.requireLock,
+		CheckHistory: !force,
+	}
+	if force {
+		log.WithFields(log.Fields{
+			"name":   params["name"],
+			"serial": document.Serial,
+		}).Warning("Forcing state push")
+	}
+
+	err = s.st.InsertState(r.Context(), document, timestamp, source, params["name"], cond)
+	if conflict, ok := err.(*storage.ConflictError); ok {
+		d, _ := json.Marshal(conflict)
+		w.WriteHeader(http.StatusConflict)
+		w.Write(d)
+		return
+	}
+	switch err {
+	case nil:
+	case storage.ErrLocked:
+		// The lock may have changed since, it is only informational
+		lock, _ := s.st.GetLockStatus(r.Context(), params["name"])
+		d, _ := json.Marshal(lock)
+		w.WriteHeader(http.StatusLocked)
+		w.Write(d)
+		return
+	case storage.ErrNotLocked:
+		w.WriteHeader(http.StatusPreconditionRequired)
+		w.Write([]byte("428 - Precondition required: the state must be locked before it is written"))
+		return
+	case storage.ErrStateDeleted:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409 - Conflict: the state is in the trash, restore or purge it first"))
+		return
+	default:
+		errStorage(r.Context(), err, "failed to insert state", w)
+		return
+	}
+
+	s.notify(r, webhookEvent{
+		Event: eventStatePushed,
+		Name:  params["name"],
+		State: summarizeState(document),
+	})
+
 	w.WriteHeader(http.StatusOK)
 	return
 }
@@ -50,9 +143,21 @@ func (s *server) ListStates(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	coll, err := s.st.ListStates(page, pageSize)
+	// Principals restricted to a prefix only list the states under it
+	prefix := r.URL.Query().Get("prefix")
+	p := getPrincipal(r)
+	if len(p.acls) == 0 && strings.HasPrefix(p.Prefix, prefix) {
+		prefix = p.Prefix
+	}
+
+	var coll storage.StateCollection
+	if p.canAll(scopeRead, prefix) {
+		coll, err = s.st.ListStates(r.Context(), prefix, page, pageSize)
+	} else {
+		coll, err = s.listReadableStates(r, prefix, page, pageSize)
+	}
 	if err != nil {
-		err500(err, "failed to retrieve states", w)
+		errStorage(r.Context(), err, "failed to retrieve states", w)
 		return
 	}
 
@@ -69,13 +174,26 @@ func (s *server) ListStates(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !p.canAll(scopeReadSecrets, prefix) {
+		data, err = redactJSON(data, s.redactor.collection(r))
+		if err != nil {
+			err500(err, "failed to redact states", w)
+			return
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 	return
 }
 
+// GetState returns a state as Terraform pushed it,
+// or along with TerraDB's metadata with ?metadata=true.
 func (s *server) GetState(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
+	params := pathVars(r)
+	if !authorize(w, r, scopeRead, params["name"]) {
+		return
+	}
 
 	var serial int
 	if v := r.URL.Query().Get("serial"); v != "" {
@@ -87,41 +205,80 @@ func (s *server) GetState(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	document, err := s.st.GetState(params["name"], serial)
+	document, err := s.st.GetState(r.Context(), params["name"], serial)
 	if err == storage.ErrNoDocuments {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	} else if err != nil {
-		err500(err, "failed to retrieve latest state", w)
+		errStorage(r.Context(), err, "failed to retrieve latest state", w)
 		return
 	}
 
-	data, err := json.Marshal(document)
+	var data []byte
+	if r.URL.Query().Get("metadata") == "true" {
+		data, err = json.Marshal(document)
+	} else {
+		data, err = document.Document()
+	}
 	if err != nil {
 		err500(err, "failed to marshal state", w)
 		return
 	}
 
+	if !canReadSecrets(r, params["name"]) {
+		data, err = redactJSON(data, s.redactor.state)
+		if err != nil {
+			err500(err, "failed to redact state", w)
+			return
+		}
+	} else if document.MD5 != "" && r.URL.Query().Get("metadata") != "true" {
+		w.Header().Set("Content-MD5", document.MD5)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 	return
 }
 
+// RemoveState moves a state to the trash, from which it can be restored
+// until it is purged.
 func (s *server) RemoveState(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
+	params := pathVars(r)
+	if !authorize(w, r, scopeWrite, params["name"]) {
+		return
+	}
 
-	err := s.st.RemoveState(params["name"])
-	if err != nil {
-		err500(err, "failed to remove state", w)
+	// The removed state is summarized in the webhook payloads
+	event := webhookEvent{Event: eventStateDeleted, Name: params["name"]}
+	current, err := s.st.GetState(r.Context(), params["name"], 0)
+	if err == nil {
+		event.State = summarizeState(current)
+	}
+
+	err = s.st.RemoveState(r.Context(), params["name"])
+	if err == storage.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		errStorage(r.Context(), err, "failed to remove state", w)
 		return
 	}
 
+	log.WithFields(log.Fields{
+		"name":       params["name"],
+		"removed_by": getPrincipal(r).Name,
+	}).Info("Moved state to the trash")
+	s.notify(r, event)
+
 	w.WriteHeader(http.StatusOK)
 	return
 }
 
 func (s *server) LockState(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
+	params := pathVars(r)
+	if !authorize(w, r, scopeLock, params["name"]) {
+		return
+	}
 
 	var currentLock, remoteLock storage.LockInfo
 
@@ -137,18 +294,14 @@ func (s *server) LockState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	remoteLock, err = s.st.GetLockStatus(params["name"])
-	if err == storage.ErrNoDocuments {
-		err = s.st.LockState(params["name"], currentLock)
-		if err != nil {
-			err500(err, "failed to lock state", w)
-			return
-		}
-
+	// Locking is atomic: on conflict, the storage returns the current lock
+	remoteLock, err = s.st.LockState(r.Context(), params["name"], currentLock)
+	if err == nil {
+		s.notify(r, webhookEvent{Event: eventLockAcquired, Name: params["name"], Lock: &currentLock})
 		w.WriteHeader(http.StatusOK)
 		return
-	} else if err != nil {
-		err500(err, "failed to get lock status", w)
+	} else if err != storage.ErrLocked {
+		errStorage(r.Context(), err, "failed to lock state", w)
 		return
 	}
 
@@ -167,7 +320,10 @@ func (s *server) LockState(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) UnlockState(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
+	params := pathVars(r)
+	if !authorize(w, r, scopeLock, params["name"]) {
+		return
+	}
 
 	var lockData storage.LockInfo
 
@@ -183,27 +339,107 @@ func (s *server) UnlockState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.st.UnlockState(params["name"], lockData)
+	remoteLock, err := s.st.UnlockState(r.Context(), params["name"], lockData)
+	if err == storage.ErrLockIDMismatch {
+		d, _ := json.Marshal(remoteLock)
+		w.WriteHeader(http.StatusConflict)
+		w.Write(d)
+		return
+	} else if err != nil {
+		errStorage(r.Context(), err, "failed to unlock state", w)
+		return
+	}
+
+	s.notify(r, webhookEvent{Event: eventLockReleased, Name: params["name"], Lock: &lockData})
+
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+// forceUnlockResponse is returned when a lock was forcibly removed
+type forceUnlockResponse struct {
+	Lock     storage.LockInfo `json:"lock"`
+	ForcedBy string           `json:"forced_by"`
+	Reason   string           `json:"reason"`
+}
+
+// ForceUnlockState removes the lock of a state, whoever holds it,
+// like `terraform force-unlock`. It is restricted to admins,
+// and requires a reason.
+func (s *server) ForceUnlockState(w http.ResponseWriter, r *http.Request) {
+	params := pathVars(r)
+	p := getPrincipal(r)
+
+	if !authorize(w, r, scopeAdmin, params["name"]) {
+		return
+	}
+
+	if r.URL.Query().Get("force") != "true" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad request: force=true is required"))
+		return
+	}
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad request: a reason is required"))
+		return
+	}
+
+	lock, err := s.st.ForceUnlockState(r.Context(), params["name"])
+	if err == storage.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		errStorage(r.Context(), err, "failed to force-unlock state", w)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"name":      params["name"],
+		"lock_id":   lock.ID,
+		"lock_who":  lock.Who,
+		"forced_by": p.Name,
+		"reason":    reason,
+	}).Warning("Forced unlock of state")
+	s.notify(r, webhookEvent{
+		Event:  eventLockForced,
+		Name:   params["name"],
+		Lock:   &lock,
+		Reason: reason,
+	})
+
+	data, err := json.Marshal(&forceUnlockResponse{
+		Lock:     lock,
+		ForcedBy: p.Name,
+		Reason:   reason,
+	})
 	if err != nil {
-		err500(err, "failed to unlock state", w)
+		err500(err, "failed to marshal lock", w)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
+	w.Write(data)
 	return
 }
 
 func (s *server) ListStateSerials(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
+	params := pathVars(r)
+	if !authorize(w, r, scopeRead, params["name"]) {
+		return
+	}
+
 	page, pageSize, err := s.parsePagination(r)
 	if err != nil {
 		err500(err, "", w)
 		return
 	}
 
-	coll, err := s.st.ListStateSerials(params["name"], page, pageSize)
+	coll, err := s.st.ListStateSerials(r.Context(), params["name"], page, pageSize)
 	if err != nil {
-		err500(err, "failed to retrieve state serials", w)
+		errStorage(r.Context(), err, "failed to retrieve state serials", w)
 		return
 	}
 
@@ -213,6 +449,14 @@ func (s *server) ListStateSerials(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !canReadSecrets(r, params["name"]) {
+		data, err = redactJSON(data, s.redactor.collection(r))
+		if err != nil {
+			err500(err, "failed to redact state serials", w)
+			return
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 	return
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/camptocamp/terradb/internal/storage"
+)
+
+func TestInsertStateConditions(t *testing.T) {
+	s := newTestServer(t)
+	admin := basicAuth("admin", "admin-password")
+	serial2 := strings.Replace(testState, `"serial": 1`, `"serial": 2`, 1)
+
+	s.requireLock = true
+	if code, body := do(t, s, "POST", "/v1/states/app", admin, testState); code != http.StatusPreconditionRequired {
+		t.Errorf("expected 428 when pushing an unlocked state, got %d %s", code, body)
+	}
+	s.requireLock = false
+
+	if code, body := do(t, s, "POST", "/v1/states/app", admin, testState); code != http.StatusOK {
+		t.Fatalf("failed to push state: %d %s", code, body)
+	}
+
+	if code, body := do(t, s, "LOCK", "/v1/states/app", admin, `{"ID": "lock-id"}`); code != http.StatusOK {
+		t.Fatalf("failed to lock state: %d %s", code, body)
+	}
+	code, body := do(t, s, "POST", "/v1/states/app?ID=other-id", admin, serial2)
+	if code != http.StatusLocked {
+		t.Errorf("expected 423 when pushing with another lock ID, got %d %s", code, body)
+	} else if !strings.Contains(body, "lock-id") {
+		t.Errorf("expected the current lock in the response, got %s", body)
+	}
+	if code, body := do(t, s, "POST", "/v1/states/app?ID=lock-id", admin, serial2); code != http.StatusOK {
+		t.Errorf("expected the lock holder to push, got %d %s", code, body)
+	}
+
+	code, body = do(t, s, "POST", "/v1/states/app?ID=lock-id", admin, testState)
+	if code != http.StatusConflict {
+		t.Fatalf("expected 409 when pushing an older serial, got %d %s", code, body)
+	}
+	var conflict storage.ConflictError
+	if err := json.Unmarshal([]byte(body), &conflict); err != nil || conflict.Reason != storage.ConflictSerialRegression {
+		t.Errorf("expected a %s conflict, got %s", storage.ConflictSerialRegression, body)
+	}
+	if code, body := do(t, s, "POST", "/v1/states/app?ID=lock-id&force=true", admin, testState); code != http.StatusOK {
+		t.Errorf("expected forced pushes to bypass the history checks, got %d %s", code, body)
+	}
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certPollInterval is how often the certificate files are checked for changes
+const certPollInterval = 10 * time.Second
+
+// TLSConfig configures HTTPS, and the authentication
+// of the callers with client certificates.
+type TLSConfig struct {
+	// CertFile and KeyFile are the certificate of the server,
+	// which serves plain HTTP if they are empty. KeyFile may be
+	// empty if CertFile holds both the certificate and the key.
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile verifies the client certificates, whose
+	// common name or first SAN names the principal
+	ClientCAFile string
+	// RequireClientCert rejects the connections without
+	// a client certificate
+	RequireClientCert bool
+	// ClientRoleMappings grant roles to the client certificates
+	// whose principal name matches a pattern, as <pattern>:<role>
+	ClientRoleMappings []string
+}
+
+// certReloader serves a certificate, loaded again when its files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (c *certReloader, err error) {
+	c = &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	err = c.load()
+	return
+}
+
+// load loads the certificate.
+// On error, the previous certificate is kept.
+func (c *certReloader) load() (err error) {
+	var modTimes [2]time.Time
+	for i, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to read certificate: %v", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %v", err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.cert = &cert
+	c.modTimes = modTimes
+	return
+}
+
+// changed tells whether the certificate files changed since they were loaded
+func (c *certReloader) changed() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for i, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err == nil && !info.ModTime().Equal(c.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch loads the certificate again when its files change.
+// Both files may not be replaced at once, so failed loads are retried.
+func (c *certReloader) watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if !c.changed() {
+			continue
+		}
+
+		err := c.load()
+		if err != nil {
+			log.Errorf("failed to reload certificate: %s", err)
+			continue
+		}
+		log.Infof("Reloaded certificate from %s", c.certFile)
+	}
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.cert, nil
+}
+
+// clientCertAuthenticator authenticates the callers
+// with their verified client certificates
+type clientCertAuthenticator struct {
+	mappings []roleMapping
+}
+
+func newClientCertAuthenticator(cfg TLSConfig) (a *clientCertAuthenticator, err error) {
+	a = &clientCertAuthenticator{}
+	for _, m := range cfg.ClientRoleMappings {
+		colon := strings.LastIndex(m, ":")
+		if colon < 0 {
+			return a, fmt.Errorf("invalid client role mapping %q, expected <pattern>:<role>", m)
+		}
+		mapping := roleMapping{
+			pattern: m[:colon],
+			role:    m[colon+1:],
+		}
+		if _, ok := roles[mapping.role]; !ok {
+			return a, fmt.Errorf("unknown role %s in client role mapping %q", mapping.role, m)
+		}
+		if _, err = path.Match(mapping.pattern, ""); err != nil {
+			return a, fmt.Errorf("invalid pattern in client role mapping %q: %v", m, err)
+		}
+		a.mappings = append(a.mappings, mapping)
+	}
+	return
+}
+
+// principal returns the principal of the verified client certificate
+// of a request, or nil if there is none
+func (a *clientCertAuthenticator) principal(r *http.Request) *principal {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+
+	name := certName(r.TLS.VerifiedChains[0][0])
+	if name == "" {
+		return nil
+	}
+
+	// Certificates have their own subjects, since the client CA
+	// may issue certificates named after the basic auth users
+	p := &principal{
+		Name:     name,
+		Scopes:   newScopes(),
+		Subjects: []string{"cert:" + name},
+	}
+	for _, m := range a.mappings {
+		if ok, _ := path.Match(m.pattern, name); ok {
+			p.grant(m.role)
+		}
+	}
+	return p
+}
+
+// certName returns the name of a client certificate:
+// its common name, or else its first DNS, email or URI SAN
+func certName(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// serverTLSConfig returns the TLS configuration of the server,
+// whose certificate is reloaded when it changes
+func serverTLSConfig(cfg TLSConfig) (tlsConfig *tls.Config, err error) {
+	keyFile := cfg.KeyFile
+	if keyFile == "" {
+		keyFile = cfg.CertFile
+	}
+	certs, err := newCertReloader(cfg.CertFile, keyFile)
+	if err != nil {
+		return
+	}
+	go certs.watch(certPollInterval)
+
+	tlsConfig = &tls.Config{
+		GetCertificate: certs.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in client CA file %s", cfg.ClientCAFile)
+		}
+
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/camptocamp/terradb/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// tokenPrefix starts the API tokens, which are tdb_<id>_<secret>
+const tokenPrefix = "tdb_"
+
+// errInvalidToken is returned for unknown, revoked or expired tokens
+var errInvalidToken = errors.New("invalid or expired token")
+
+// tokenRequest is the body of a token creation
+type tokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	Prefix string   `json:"prefix"`
+	// ExpiresIn is a duration such as 720h, the token never expires if empty
+	ExpiresIn string `json:"expires_in"`
+}
+
+// createdToken is returned once on creation, with the token secret
+type createdToken struct {
+	*storage.Token
+	Secret string `json:"token"`
+}
+
+// CreateToken creates an API token. It is restricted to admins.
+func (s *server) CreateToken(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, scopeAdmin, "") {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err500(err, "failed to read body", w)
+		return
+	}
+
+	var req tokenRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400 - Bad request: %s", err)))
+		return
+	}
+
+	token, secret, err := newToken(req, getPrincipal(r).Name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400 - Bad request: %s", err)))
+		return
+	}
+
+	err = s.st.InsertToken(r.Context(), *token)
+	if err != nil {
+		errStorage(r.Context(), err, "failed to insert token", w)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":         token.ID,
+		"name":       token.Name,
+		"scopes":     token.Scopes,
+		"prefix":     token.Prefix,
+		"created_by": token.CreatedBy,
+	}).Info("Created API token")
+
+	token.Hash = ""
+	data, err := json.Marshal(&createdToken{token, secret})
+	if err != nil {
+		err500(err, "failed to marshal token", w)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+	return
+}
+
+// ListTokens lists the API tokens, without their hashes.
+// It is restricted to admins.
+func (s *server) ListTokens(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, scopeAdmin, "") {
+		return
+	}
+
+	page, pageSize, err := s.parsePagination(r)
+	if err != nil {
+		err500(err, "", w)
+		return
+	}
+
+	coll, err := s.st.ListTokens(r.Context(), page, pageSize)
+	if err != nil {
+		errStorage(r.Context(), err, "failed to retrieve tokens", w)
+		return
+	}
+	for _, token := range coll.Data {
+		token.Hash = ""
+	}
+
+	data, err := json.Marshal(coll)
+	if err != nil {
+		err500(err, "failed to marshal tokens", w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+// RevokeToken removes an API token. It is restricted to admins.
+func (s *server) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	params := pathVars(r)
+	if !authorize(w, r, scopeAdmin, "") {
+		return
+	}
+
+	err := s.st.RemoveToken(r.Context(), params["id"])
+	if err == storage.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		errStorage(r.Context(), err, "failed to revoke token", w)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":         params["id"],
+		"revoked_by": getPrincipal(r).Name,
+	}).Info("Revoked API token")
+
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+// newToken generates a token from a creation request,
+// and returns it along with its secret
+func newToken(req tokenRequest, createdBy string) (token *storage.Token, secret string, err error) {
+	if req.Name == "" {
+		return nil, "", fmt.Errorf("a name is required")
+	}
+	if len(req.Scopes) == 0 {
+		return nil, "", fmt.Errorf("at least one scope is required")
+	}
+	valid := newScopes(scopes...)
+	for _, scope := range req.Scopes {
+		if !valid[scope] {
+			return nil, "", fmt.Errorf("unknown scope %s, expected one of %s", scope, strings.Join(scopes, ", "))
+		}
+	}
+
+	token = &storage.Token{
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		Prefix:    req.Prefix,
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: createdBy,
+	}
+
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to parse expires_in: %v", err)
+		}
+		if d <= 0 {
+			return nil, "", fmt.Errorf("expires_in must be positive")
+		}
+		expiresAt := token.CreatedAt.Add(d)
+		token.ExpiresAt = &expiresAt
+	}
+
+	id := make([]byte, 8)
+	key := make([]byte, 32)
+	for _, b := range [][]byte{id, key} {
+		_, err = rand.Read(b)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to generate token: %v", err)
+		}
+	}
+	token.ID = hex.EncodeToString(id)
+	token.Hash = hashToken(hex.EncodeToString(key))
+
+	secret = tokenPrefix + token.ID + "_" + hex.EncodeToString(key)
+	return
+}
+
+// hashToken returns the hash stored for a token secret
+func hashToken(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken returns the token of an Authorization header, such as
+// an API token or a JWT, sent either as a Bearer token or as the basic
+// auth password, which is how Terraform's http backend sends it.
+// It returns an empty string if there is none.
+func bearerToken(authorizationHeader string) string {
+	s := strings.SplitN(authorizationHeader, " ", 2)
+	if len(s) != 2 {
+		return ""
+	}
+
+	var token string
+	switch strings.ToLower(s[0]) {
+	case "bearer":
+		token = s[1]
+	case "basic":
+		b, err := base64.StdEncoding.DecodeString(s[1])
+		if err != nil {
+			return ""
+		}
+		pair := strings.SplitN(string(b), ":", 2)
+		if len(pair) != 2 {
+			return ""
+		}
+		token = pair[1]
+	}
+	return token
+}
+
+// tokenPrincipal returns the principal of an API token.
+// It returns errInvalidToken if the token is unknown or expired.
+func (s *server) tokenPrincipal(ctx context.Context, secret string) (p *principal, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(secret, tokenPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidToken
+	}
+
+	token, err := s.st.GetToken(ctx, parts[0])
+	if err == storage.ErrNoDocuments {
+		return nil, errInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(parts[1])), []byte(token.Hash)) != 1 {
+		return nil, errInvalidToken
+	}
+	if token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt) {
+		return nil, errInvalidToken
+	}
+
+	p = &principal{
+		Name:     "token:" + token.ID,
+		Scopes:   newScopes(token.Scopes...),
+		Prefix:   token.Prefix,
+		Subjects: []string{"token:" + token.ID},
+	}
+	return
+}
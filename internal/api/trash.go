@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/camptocamp/terradb/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// trashPurgeInterval is how often expired states are purged from the trash
+const trashPurgeInterval = time.Hour
+
+func (s *server) ListTrash(w http.ResponseWriter, r *http.Request) {
+	page, pageSize, err := s.parsePagination(r)
+	if err != nil {
+		err500(err, "", w)
+		return
+	}
+
+	var coll storage.DeletedStateCollection
+	if getPrincipal(r).canAll(scopeRead, "") {
+		coll, err = s.st.ListTrash(r.Context(), page, pageSize)
+	} else {
+		coll, err = s.listReadableTrash(r, page, pageSize)
+	}
+	if err != nil {
+		errStorage(r.Context(), err, "failed to retrieve deleted states", w)
+		return
+	}
+
+	data, err := json.Marshal(coll)
+	if err != nil {
+		err500(err, "failed to marshal deleted states", w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+func (s *server) RestoreState(w http.ResponseWriter, r *http.Request) {
+	params := pathVars(r)
+	if !authorize(w, r, scopeWrite, params["name"]) {
+		return
+	}
+
+	err := s.st.RestoreState(r.Context(), params["name"])
+	if err == storage.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		errStorage(r.Context(), err, "failed to restore state", w)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"name":        params["name"],
+		"restored_by": getPrincipal(r).Name,
+	}).Info("Restored state from the trash")
+
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+// PurgeState permanently removes a state from the trash,
+// with all its serials and its lock. It is restricted to admins.
+func (s *server) PurgeState(w http.ResponseWriter, r *http.Request) {
+	params := pathVars(r)
+	p := getPrincipal(r)
+
+	if !authorize(w, r, scopeAdmin, params["name"]) {
+		return
+	}
+
+	err := s.st.PurgeState(r.Context(), params["name"])
+	if err == storage.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		errStorage(r.Context(), err, "failed to purge state", w)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"name":      params["name"],
+		"purged_by": p.Name,
+	}).Warning("Purged state")
+
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+// purgeExpiredStates periodically purges the states
+// which have been in the trash for longer than retention.
+func (s *server) purgeExpiredStates(retention time.Duration) {
+	interval := trashPurgeInterval
+	if retention < interval {
+		interval = retention
+	}
+
+	for {
+		err := s.purgeTrash(time.Now().Add(-retention))
+		if err != nil {
+			log.Errorf("failed to purge expired states: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// purgeTrash purges the states deleted before a given date
+func (s *server) purgeTrash(before time.Time) (err error) {
+	var expired []string
+	for page := 1; ; page++ {
+		ctx, cancel := s.storageContext()
+		coll, err := s.st.ListTrash(ctx, page, s.pageSize)
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, d := range coll.Data {
+			if d.DeletedAt.Before(before) {
+				expired = append(expired, d.Name)
+			}
+		}
+		if len(coll.Data) < s.pageSize {
+			break
+		}
+	}
+
+	for _, name := range expired {
+		ctx, cancel := s.storageContext()
+		err = s.st.PurgeState(ctx, name)
+		cancel()
+		if err == storage.ErrNoDocuments {
+			// Restored or purged in the meantime
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"name": name,
+		}).Info("Purged expired state from the trash")
+	}
+	return nil
+}
@@ -0,0 +1,598 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/camptocamp/terradb/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Webhook events
+const (
+	eventStatePushed  = "state.pushed"
+	eventStateDeleted = "state.deleted"
+	eventLockAcquired = "lock.acquired"
+	eventLockReleased = "lock.released"
+	eventLockForced   = "lock.forced"
+)
+
+// webhookEvents lists the events webhooks can subscribe to
+var webhookEvents = []string{eventStatePushed, eventStateDeleted, eventLockAcquired, eventLockReleased, eventLockForced}
+
+const (
+	// webhookCacheTTL is how long the webhooks are cached,
+	// so that the changes made by other instances are seen
+	webhookCacheTTL = 30 * time.Second
+
+	// webhookPollInterval is how often the pending deliveries are checked,
+	// besides right after an event
+	webhookPollInterval = 10 * time.Second
+
+	// webhookTimeout bounds each delivery attempt
+	webhookTimeout = 10 * time.Second
+
+	// webhookWorkers bounds how many webhooks are delivered at once
+	webhookWorkers = 4
+
+	// Failed deliveries are retried after webhookRetryDelay, doubled
+	// after each attempt up to webhookMaxRetryDelay, and abandoned
+	// after webhookMaxAttempts attempts
+	webhookRetryDelay    = 30 * time.Second
+	webhookMaxRetryDelay = time.Hour
+	webhookMaxAttempts   = 10
+)
+
+// webhookRequest is the body of a webhook creation
+type webhookRequest struct {
+	URL      string   `json:"url"`
+	Patterns []string `json:"patterns"`
+	Events   []string `json:"events"`
+	// Secret is generated if empty
+	Secret string `json:"secret"`
+}
+
+// webhookEvent is the payload of the deliveries
+type webhookEvent struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Name      string    `json:"name"`
+	Principal string    `json:"principal"`
+
+	State  *stateSummary     `json:"state,omitempty"`
+	Lock   *storage.LockInfo `json:"lock,omitempty"`
+	Reason string            `json:"reason,omitempty"`
+}
+
+// stateSummary summarizes a state in the payloads.
+// Resources only counts the managed resources, by type in ResourceTypes.
+type stateSummary struct {
+	Serial           int64          `json:"serial"`
+	Lineage          string         `json:"lineage"`
+	TerraformVersion string         `json:"terraform_version,omitempty"`
+	Resources        int            `json:"resources"`
+	ResourceTypes    map[string]int `json:"resource_types"`
+	Outputs          int            `json:"outputs"`
+}
+
+func summarizeState(state storage.State) *stateSummary {
+	summary := &stateSummary{
+		Serial:           state.Serial,
+		Lineage:          state.Lineage,
+		TerraformVersion: state.TFVersion,
+		ResourceTypes:    make(map[string]int),
+		Outputs:          len(state.Outputs),
+	}
+
+	for _, r := range state.Resources {
+		if r.Mode == "managed" {
+			summary.ResourceTypes[r.Type]++
+			summary.Resources++
+		}
+	}
+	for _, m := range state.Modules {
+		for key, r := range m.Resources {
+			if !strings.HasPrefix(key, "data.") {
+				summary.ResourceTypes[r.Type]++
+				summary.Resources++
+			}
+		}
+		summary.Outputs += len(m.Outputs)
+	}
+	return summary
+}
+
+// webhookCache caches the webhooks, which are checked on every event
+type webhookCache struct {
+	st storage.Storage
+
+	mutex    sync.Mutex
+	webhooks []*storage.Webhook
+	loaded   time.Time
+}
+
+// all returns all the webhooks
+func (c *webhookCache) all(ctx context.Context) (webhooks []*storage.Webhook, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if time.Since(c.loaded) > webhookCacheTTL {
+		var all []*storage.Webhook
+		for page := 1; ; page++ {
+			coll, err := c.st.ListWebhooks(ctx, page, aclPageSize)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, coll.Data...)
+			if len(coll.Data) < aclPageSize {
+				break
+			}
+		}
+		c.webhooks = all
+		c.loaded = time.Now()
+	}
+	return c.webhooks, nil
+}
+
+// invalidate forces the webhooks to be loaded again
+func (c *webhookCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.loaded = time.Time{}
+}
+
+// matches tells whether a webhook subscribes to an event on a state
+func (c *webhookCache) matches(webhook *storage.Webhook, event, name string) bool {
+	if !containsString(webhook.Events, event) {
+		return false
+	}
+	for _, pattern := range webhook.Patterns {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// notify queues the deliveries of an event to the webhooks subscribed to it.
+// Failures are logged, since the event already happened.
+func (s *server) notify(r *http.Request, event webhookEvent) {
+	event.Time = time.Now().UTC()
+	event.Principal = getPrincipal(r).Name
+
+	ctx, cancel := s.storageContext()
+	defer cancel()
+
+	webhooks, err := s.webhooks.all(ctx)
+	if err != nil {
+		log.Errorf("failed to retrieve webhooks: %s", err)
+		return
+	}
+
+	var payload []byte
+	queued := 0
+	for _, webhook := range webhooks {
+		if !s.webhooks.matches(webhook, event.Event, event.Name) {
+			continue
+		}
+
+		if payload == nil {
+			payload, err = json.Marshal(event)
+			if err != nil {
+				log.Errorf("failed to marshal webhook payload: %s", err)
+				return
+			}
+		}
+
+		err = s.st.InsertDelivery(ctx, storage.Delivery{
+			ID:          timeID(event.Time),
+			WebhookID:   webhook.ID,
+			Event:       event.Event,
+			Payload:     payload,
+			CreatedAt:   event.Time,
+			Status:      storage.DeliveryPending,
+			NextAttempt: event.Time,
+		})
+		if err != nil {
+			log.Errorf("failed to queue webhook delivery: %s", err)
+			continue
+		}
+		queued++
+	}
+
+	if queued > 0 {
+		select {
+		case s.webhookWake <- struct{}{}:
+		default:
+			// The deliveries are already being checked
+		}
+	}
+}
+
+// deliverWebhooks delivers the pending deliveries as they are queued,
+// and retries the failed ones.
+// Deliveries are sent at least once: instances sharing the storage
+// may send the same delivery, and receivers should ignore duplicates.
+func (s *server) deliverWebhooks(interval time.Duration) {
+	client := &http.Client{Timeout: webhookTimeout}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.webhookWake:
+		}
+		s.deliverPending(client)
+	}
+}
+
+// deliverPending attempts the pending deliveries which are due.
+// The deliveries of each webhook are sent in order, by up to
+// webhookWorkers webhooks at once, and the deliveries following
+// a failed one wait for the next pass, so that a webhook which
+// does not respond only delays its own deliveries.
+func (s *server) deliverPending(client *http.Client) {
+	ctx, cancel := s.storageContext()
+	var pending []*storage.Delivery
+	for page := 1; ; page++ {
+		coll, err := s.st.ListDeliveries(ctx, storage.DeliveryFilter{Status: storage.DeliveryPending}, page, s.pageSize)
+		if err != nil {
+			log.Errorf("failed to retrieve pending deliveries: %s", err)
+			break
+		}
+		pending = append(pending, coll.Data...)
+		if len(coll.Data) < s.pageSize {
+			break
+		}
+	}
+	cancel()
+
+	// Deliveries are listed most recent first
+	var webhooks []string
+	due := make(map[string][]*storage.Delivery)
+	for i := len(pending) - 1; i >= 0; i-- {
+		d := pending[i]
+		if d.NextAttempt.After(time.Now()) {
+			continue
+		}
+		if _, ok := due[d.WebhookID]; !ok {
+			webhooks = append(webhooks, d.WebhookID)
+		}
+		due[d.WebhookID] = append(due[d.WebhookID], d)
+	}
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, webhookWorkers)
+	for _, id := range webhooks {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(deliveries []*storage.Delivery) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			for _, d := range deliveries {
+				if !s.deliver(client, d) {
+					break
+				}
+			}
+		}(due[id])
+	}
+	wg.Wait()
+}
+
+// deliver attempts a delivery, and records its outcome.
+// It returns false if the webhook failed, so that its next
+// deliveries can be postponed.
+func (s *server) deliver(client *http.Client, delivery *storage.Delivery) (ok bool) {
+	ctx, cancel := s.storageContext()
+	defer cancel()
+
+	webhooks, err := s.webhooks.all(ctx)
+	if err != nil {
+		log.Errorf("failed to retrieve webhooks: %s", err)
+		return false
+	}
+	var webhook *storage.Webhook
+	for _, w := range webhooks {
+		if w.ID == delivery.WebhookID {
+			webhook = w
+		}
+	}
+
+	now := time.Now().UTC()
+	ok = true
+	switch {
+	case webhook == nil:
+		delivery.Status = storage.DeliveryFailed
+		delivery.LastError = "webhook removed"
+	default:
+		delivery.Attempts++
+		delivery.LastStatus, err = postWebhook(client, webhook, delivery)
+		if err == nil {
+			delivery.Status = storage.DeliveryDelivered
+			delivery.LastError = ""
+			delivery.DeliveredAt = &now
+			break
+		}
+
+		ok = false
+
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= webhookMaxAttempts {
+			delivery.Status = storage.DeliveryFailed
+			log.WithFields(log.Fields{
+				"id":       delivery.ID,
+				"webhook":  webhook.ID,
+				"event":    delivery.Event,
+				"attempts": delivery.Attempts,
+			}).Warningf("Abandoned webhook delivery: %s", err)
+			break
+		}
+		delivery.NextAttempt = now.Add(webhookBackoff(delivery.Attempts))
+	}
+
+	err = s.st.InsertDelivery(ctx, *delivery)
+	if err != nil {
+		log.Errorf("failed to update webhook delivery: %s", err)
+	}
+	return
+}
+
+// webhookBackoff returns the delay before the next attempt of a delivery
+func webhookBackoff(attempts int) time.Duration {
+	delay := webhookRetryDelay
+	for i := 1; i < attempts && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxRetryDelay {
+		delay = webhookMaxRetryDelay
+	}
+	return delay
+}
+
+// postWebhook sends a delivery, signed with the secret of its webhook
+// in the X-TerraDB-Signature header, as sha256=<hex HMAC of the body>.
+// It returns the status code of the response, if any.
+func postWebhook(client *http.Client, webhook *storage.Webhook, delivery *storage.Delivery) (status int, err error) {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write(delivery.Payload)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "TerraDB")
+	req.Header.Set("X-TerraDB-Event", delivery.Event)
+	req.Header.Set("X-TerraDB-Delivery", delivery.ID)
+	req.Header.Set("X-TerraDB-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// newWebhook checks a webhook creation request,
+// and returns the webhook with its ID, and its secret if needed
+func newWebhook(req webhookRequest, createdBy string) (webhook *storage.Webhook, err error) {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q, expected an http or https URL", req.URL)
+	}
+
+	if len(req.Patterns) == 0 {
+		return nil, fmt.Errorf("at least one pattern is required")
+	}
+	for _, pattern := range req.Patterns {
+		if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+
+	if len(req.Events) == 0 {
+		return nil, fmt.Errorf("at least one event is required")
+	}
+	for _, event := range req.Events {
+		if !containsString(webhookEvents, event) {
+			return nil, fmt.Errorf("unknown event %s, expected one of %s", event, strings.Join(webhookEvents, ", "))
+		}
+	}
+
+	webhook = &storage.Webhook{
+		URL:       req.URL,
+		Patterns:  req.Patterns,
+		Events:    req.Events,
+		Secret:    req.Secret,
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: createdBy,
+	}
+
+	id := make([]byte, 8)
+	key := make([]byte, 32)
+	for _, b := range [][]byte{id, key} {
+		_, err = rand.Read(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate webhook: %v", err)
+		}
+	}
+	webhook.ID = hex.EncodeToString(id)
+	if webhook.Secret == "" {
+		webhook.Secret = hex.EncodeToString(key)
+	}
+	return
+}
+
+// CreateWebhook subscribes a URL to events, and returns the webhook
+// along with its secret. It is restricted to admins.
+func (s *server) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, scopeAdmin, "") {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err500(err, "failed to read body", w)
+		return
+	}
+
+	var req webhookRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400 - Bad request: %s", err)))
+		return
+	}
+
+	webhook, err := newWebhook(req, getPrincipal(r).Name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400 - Bad request: %s", err)))
+		return
+	}
+
+	err = s.st.InsertWebhook(r.Context(), *webhook)
+	if err != nil {
+		errStorage(r.Context(), err, "failed to insert webhook", w)
+		return
+	}
+	s.webhooks.invalidate()
+
+	log.WithFields(log.Fields{
+		"id":         webhook.ID,
+		"url":        webhook.URL,
+		"patterns":   webhook.Patterns,
+		"events":     webhook.Events,
+		"created_by": webhook.CreatedBy,
+	}).Info("Created webhook")
+
+	data, err := json.Marshal(webhook)
+	if err != nil {
+		err500(err, "failed to marshal webhook", w)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+	return
+}
+
+// ListWebhooks lists the webhooks, without their secrets.
+// It is restricted to admins.
+func (s *server) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, scopeAdmin, "") {
+		return
+	}
+
+	page, pageSize, err := s.parsePagination(r)
+	if err != nil {
+		err500(err, "", w)
+		return
+	}
+
+	coll, err := s.st.ListWebhooks(r.Context(), page, pageSize)
+	if err != nil {
+		errStorage(r.Context(), err, "failed to retrieve webhooks", w)
+		return
+	}
+	for _, webhook := range coll.Data {
+		webhook.Secret = ""
+	}
+
+	data, err := json.Marshal(coll)
+	if err != nil {
+		err500(err, "failed to marshal webhooks", w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+// RemoveWebhook removes a webhook. Its pending deliveries are abandoned.
+// It is restricted to admins.
+func (s *server) RemoveWebhook(w http.ResponseWriter, r *http.Request) {
+	params := pathVars(r)
+	if !authorize(w, r, scopeAdmin, "") {
+		return
+	}
+
+	err := s.st.RemoveWebhook(r.Context(), params["id"])
+	if err == storage.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		errStorage(r.Context(), err, "failed to remove webhook", w)
+		return
+	}
+	s.webhooks.invalidate()
+
+	log.WithFields(log.Fields{
+		"id":         params["id"],
+		"removed_by": getPrincipal(r).Name,
+	}).Info("Removed webhook")
+
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+// ListDeliveries lists the deliveries of a webhook, most recent first,
+// optionally filtered by status. It is restricted to admins.
+func (s *server) ListDeliveries(w http.ResponseWriter, r *http.Request) {
+	params := pathVars(r)
+	if !authorize(w, r, scopeAdmin, "") {
+		return
+	}
+
+	page, pageSize, err := s.parsePagination(r)
+	if err != nil {
+		err500(err, "", w)
+		return
+	}
+
+	filter := storage.DeliveryFilter{
+		WebhookID: params["id"],
+		Status:    r.URL.Query().Get("status"),
+	}
+	coll, err := s.st.ListDeliveries(r.Context(), filter, page, pageSize)
+	if err != nil {
+		errStorage(r.Context(), err, "failed to retrieve deliveries", w)
+		return
+	}
+
+	data, err := json.Marshal(coll)
+	if err != nil {
+		err500(err, "failed to marshal deliveries", w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
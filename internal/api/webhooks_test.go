@@ -0,0 +1,280 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terradb/internal/storage"
+)
+
+// testReceiver records the webhook requests it receives,
+// and answers them with its status
+type testReceiver struct {
+	mutex    sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rcv *testReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	rcv.mutex.Lock()
+	defer rcv.mutex.Unlock()
+	rcv.requests = append(rcv.requests, r)
+	rcv.bodies = append(rcv.bodies, body)
+	w.WriteHeader(rcv.status)
+}
+
+func (rcv *testReceiver) count() int {
+	rcv.mutex.Lock()
+	defer rcv.mutex.Unlock()
+	return len(rcv.requests)
+}
+
+// createWebhook subscribes url to the pushes of all the states
+func createWebhook(t *testing.T, s *server, url string) storage.Webhook {
+	req := fmt.Sprintf(`{"url": %q, "patterns": ["**"], "events": ["state.pushed"], "secret": "webhook-secret"}`, url)
+	code, body := do(t, s, "POST", "/v1/webhooks", basicAuth("admin", "admin-password"), req)
+	if code != http.StatusCreated {
+		t.Fatalf("failed to create webhook: %d %s", code, body)
+	}
+	var webhook storage.Webhook
+	if err := json.Unmarshal([]byte(body), &webhook); err != nil {
+		t.Fatalf("failed to unmarshal webhook: %v", err)
+	}
+	return webhook
+}
+
+// listDeliveries returns the deliveries of a webhook, oldest first
+func listDeliveries(t *testing.T, s *server, id string) []*storage.Delivery {
+	code, body := do(t, s, "GET", "/v1/webhooks/"+id+"/deliveries", basicAuth("admin", "admin-password"), "")
+	if code != http.StatusOK {
+		t.Fatalf("failed to list deliveries: %d %s", code, body)
+	}
+	var coll storage.DeliveryCollection
+	if err := json.Unmarshal([]byte(body), &coll); err != nil {
+		t.Fatalf("failed to unmarshal deliveries: %v", err)
+	}
+	for i, j := 0, len(coll.Data)-1; i < j; i, j = i+1, j-1 {
+		coll.Data[i], coll.Data[j] = coll.Data[j], coll.Data[i]
+	}
+	return coll.Data
+}
+
+// pushSerials pushes the serials 1 to n of the app state
+func pushSerials(t *testing.T, s *server, n int) {
+	for serial := 1; serial <= n; serial++ {
+		state := strings.Replace(testState, `"serial": 1`, fmt.Sprintf(`"serial": %d`, serial), 1)
+		if code, body := do(t, s, "POST", "/v1/states/app", basicAuth("admin", "admin-password"), state); code != http.StatusOK {
+			t.Fatalf("failed to push state: %d %s", code, body)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	s := newTestServer(t)
+	admin := basicAuth("admin", "admin-password")
+	rcv := &testReceiver{status: http.StatusOK}
+	ts := httptest.NewServer(rcv)
+	defer ts.Close()
+
+	if code, body := do(t, s, "POST", "/v1/webhooks", admin, `{"url": "ftp://example.com", "patterns": ["**"], "events": ["state.pushed"]}`); code != http.StatusBadRequest {
+		t.Errorf("expected an invalid URL to be refused, got %d %s", code, body)
+	}
+	webhook := createWebhook(t, s, ts.URL)
+	if webhook.Secret != "webhook-secret" {
+		t.Errorf("expected the secret to be returned on creation, got %q", webhook.Secret)
+	}
+
+	if code, body := do(t, s, "GET", "/v1/webhooks", basicAuth("reader", "reader-password"), ""); code != http.StatusForbidden {
+		t.Errorf("expected webhooks to be restricted to admins, got %d %s", code, body)
+	}
+	code, body := do(t, s, "GET", "/v1/webhooks", admin, "")
+	if code != http.StatusOK || !strings.Contains(body, webhook.ID) {
+		t.Errorf("expected the webhook to be listed, got %d %s", code, body)
+	} else if strings.Contains(body, "webhook-secret") {
+		t.Errorf("expected the secret not to be listed, got %s", body)
+	}
+
+	pushSerials(t, s, 1)
+	s.deliverPending(http.DefaultClient)
+
+	if rcv.count() != 1 {
+		t.Fatalf("expected 1 request, got %d", rcv.count())
+	}
+	req, payload := rcv.requests[0], rcv.bodies[0]
+	mac := hmac.New(sha256.New, []byte("webhook-secret"))
+	mac.Write(payload)
+	if sig := req.Header.Get("X-TerraDB-Signature"); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("expected the payload to be signed with the webhook secret, got %s", sig)
+	}
+	if event := req.Header.Get("X-TerraDB-Event"); event != eventStatePushed {
+		t.Errorf("expected a %s event, got %s", eventStatePushed, event)
+	}
+	var event webhookEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.Name != "app" || event.Principal != "admin" {
+		t.Errorf("expected the push of app by admin, got %s", payload)
+	}
+
+	deliveries := listDeliveries(t, s, webhook.ID)
+	if len(deliveries) != 1 || deliveries[0].Status != storage.DeliveryDelivered || deliveries[0].DeliveredAt == nil {
+		t.Fatalf("expected the delivery to be delivered, got %+v", deliveries)
+	}
+	if id := req.Header.Get("X-TerraDB-Delivery"); id != deliveries[0].ID {
+		t.Errorf("expected delivery ID %s, got %s", deliveries[0].ID, id)
+	}
+
+	if code, body := do(t, s, "DELETE", "/v1/webhooks/"+webhook.ID, admin, ""); code != http.StatusOK {
+		t.Errorf("failed to remove webhook: %d %s", code, body)
+	}
+	if code, _ := do(t, s, "DELETE", "/v1/webhooks/"+webhook.ID, admin, ""); code != http.StatusNotFound {
+		t.Errorf("expected 404 when removing a removed webhook, got %d", code)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	rcv := &testReceiver{status: http.StatusInternalServerError}
+	ts := httptest.NewServer(rcv)
+	defer ts.Close()
+
+	webhook := createWebhook(t, s, ts.URL)
+	pushSerials(t, s, 1)
+
+	before := time.Now()
+	s.deliverPending(http.DefaultClient)
+	deliveries := listDeliveries(t, s, webhook.ID)
+	if len(deliveries) != 1 {
+		t.Fatalf("expected 1 delivery, got %d", len(deliveries))
+	}
+	d := deliveries[0]
+	if d.Status != storage.DeliveryPending || d.Attempts != 1 || d.LastStatus != http.StatusInternalServerError || d.LastError == "" {
+		t.Errorf("expected a pending delivery after a failed attempt, got %+v", d)
+	}
+	if d.NextAttempt.Before(before.Add(webhookRetryDelay)) || d.NextAttempt.After(time.Now().Add(webhookRetryDelay)) {
+		t.Errorf("expected the next attempt in %s, got %s", webhookRetryDelay, d.NextAttempt)
+	}
+
+	// The delivery is not retried before its next attempt
+	s.deliverPending(http.DefaultClient)
+	if rcv.count() != 1 {
+		t.Errorf("expected the delivery not to be retried yet, got %d requests", rcv.count())
+	}
+
+	// The delivery is abandoned after the last attempt
+	d.Attempts = webhookMaxAttempts - 1
+	d.NextAttempt = time.Now().Add(-time.Second)
+	if err := s.st.InsertDelivery(ctx, *d); err != nil {
+		t.Fatalf("failed to update delivery: %v", err)
+	}
+	s.deliverPending(http.DefaultClient)
+	d = listDeliveries(t, s, webhook.ID)[0]
+	if d.Status != storage.DeliveryFailed || d.Attempts != webhookMaxAttempts {
+		t.Errorf("expected the delivery to be abandoned, got %+v", d)
+	}
+
+	// The deliveries of removed webhooks are abandoned without being sent
+	err := s.st.InsertDelivery(ctx, storage.Delivery{
+		ID:          timeID(time.Now()),
+		WebhookID:   "removed",
+		Event:       eventStatePushed,
+		Payload:     json.RawMessage(`{}`),
+		Status:      storage.DeliveryPending,
+		NextAttempt: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("failed to insert delivery: %v", err)
+	}
+	s.deliverPending(http.DefaultClient)
+	d = listDeliveries(t, s, "removed")[0]
+	if d.Status != storage.DeliveryFailed || d.Attempts != 0 {
+		t.Errorf("expected the delivery of a removed webhook to be abandoned, got %+v", d)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, webhookRetryDelay},
+		{2, 2 * webhookRetryDelay},
+		{3, 4 * webhookRetryDelay},
+		{7, 64 * webhookRetryDelay},
+		{8, webhookMaxRetryDelay},
+		{webhookMaxAttempts, webhookMaxRetryDelay},
+	}
+	for _, tt := range tests {
+		if delay := webhookBackoff(tt.attempts); delay != tt.expected {
+			t.Errorf("expected a %s delay after %d attempts, got %s", tt.expected, tt.attempts, delay)
+		}
+	}
+}
+
+func TestWebhookHangingReceiver(t *testing.T) {
+	s := newTestServer(t)
+
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	hanging := 0
+	hangingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		hanging++
+		mutex.Unlock()
+		<-release
+	}))
+	defer hangingServer.Close()
+	defer close(release)
+
+	rcv := &testReceiver{status: http.StatusOK}
+	ts := httptest.NewServer(rcv)
+	defer ts.Close()
+
+	slow := createWebhook(t, s, hangingServer.URL)
+	fast := createWebhook(t, s, ts.URL)
+	pushSerials(t, s, 3)
+
+	s.deliverPending(&http.Client{Timeout: 100 * time.Millisecond})
+
+	if rcv.count() != 3 {
+		t.Errorf("expected the 3 deliveries of the responding webhook, got %d", rcv.count())
+	}
+	mutex.Lock()
+	if hanging != 1 {
+		t.Errorf("expected a single attempt on the hanging webhook, got %d", hanging)
+	}
+	mutex.Unlock()
+
+	// The deliveries following the failed one wait for the next pass
+	deliveries := listDeliveries(t, s, slow.ID)
+	if len(deliveries) != 3 {
+		t.Fatalf("expected 3 deliveries, got %d", len(deliveries))
+	}
+	for i, d := range deliveries {
+		attempts := 0
+		if i == 0 {
+			attempts = 1
+		}
+		if d.Status != storage.DeliveryPending || d.Attempts != attempts {
+			t.Errorf("expected delivery %d to be pending after %d attempts, got %+v", i, attempts, d)
+		}
+	}
+	for _, d := range listDeliveries(t, s, fast.ID) {
+		if d.Status != storage.DeliveryDelivered {
+			t.Errorf("expected the deliveries of the responding webhook to be delivered, got %+v", d)
+		}
+	}
+}
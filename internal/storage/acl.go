@@ -0,0 +1,16 @@
+package storage
+
+// ACL grants scopes on the states whose names match Pattern
+// to a principal, such as user:alice, token:<id> or group:ops.
+type ACL struct {
+	ID        string   `json:"id"`
+	Principal string   `json:"principal"`
+	Pattern   string   `json:"pattern"`
+	Scopes    []string `json:"scopes"`
+}
+
+// ACLCollection is a collection of ACL, with metadata
+type ACLCollection struct {
+	Metadata []*Metadata `json:"metadata"`
+	Data     []*ACL      `json:"data"`
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"time"
+)
+
+// AuditRecord records a mutating API call
+type AuditRecord struct {
+	// ID starts with the time of the record,
+	// so that IDs sort in chronological order
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+
+	// Action is the API call, such as insert_state or lock_state,
+	// and Outcome its result: success, denied, conflict, invalid or error
+	Action  string `json:"action"`
+	Outcome string `json:"outcome"`
+	Status  int    `json:"status"`
+
+	Principal string `json:"principal"`
+	SourceIP  string `json:"source_ip"`
+	UserAgent string `json:"user_agent,omitempty"`
+
+	Name   string `json:"name,omitempty"`
+	Serial int64  `json:"serial,omitempty"`
+	LockID string `json:"lock_id,omitempty"`
+	// Reason is given by the admins forcing an unlock
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditCollection is a collection of AuditRecord, with metadata
+type AuditCollection struct {
+	Metadata []*Metadata    `json:"metadata"`
+	Data     []*AuditRecord `json:"data"`
+}
+
+// AuditFilter selects audit records.
+// Empty fields select all the records.
+type AuditFilter struct {
+	Name      string
+	Principal string
+	Action    string
+	Outcome   string
+
+	// Since and Until bound the time of the records, inclusively
+	Since time.Time
+	Until time.Time
+}
+
+// Match tells whether an audit record is selected by the filter
+func (f AuditFilter) Match(record *AuditRecord) bool {
+	switch {
+	case f.Name != "" && record.Name != f.Name:
+		return false
+	case f.Principal != "" && record.Principal != f.Principal:
+		return false
+	case f.Action != "" && record.Action != f.Action:
+		return false
+	case f.Outcome != "" && record.Outcome != f.Outcome:
+		return false
+	case !f.Since.IsZero() && record.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && record.Time.After(f.Until):
+		return false
+	}
+	return true
+}
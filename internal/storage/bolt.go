@@ -0,0 +1,721 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltConfig stores the informations required to open a Bolt database.
+type BoltConfig struct {
+	Path string
+}
+
+// BoltStorage stores Terraform states in a single local Bolt file.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// Bolt buckets:
+// - states holds one nested bucket per state, keyed by serial
+// - latest indexes the latest serial of each state
+// - locks holds the Terraform locks
+// - trash holds the deleted states, which are removed from latest
+// - tokens holds the API tokens
+// - acls holds the ACLs
+// - audit holds the audit records
+// - webhooks and deliveries hold the webhooks and their deliveries
+var (
+	boltStatesBucket = []byte("states")
+	boltLatestBucket = []byte("latest")
+	boltLocksBucket  = []byte("locks")
+	boltTrashBucket  = []byte("trash")
+	boltTokensBucket = []byte("tokens")
+	boltACLsBucket   = []byte("acls")
+	boltAuditBucket  = []byte("audit")
+
+	boltWebhooksBucket   = []byte("webhooks")
+	boltDeliveriesBucket = []byte("deliveries")
+)
+
+type boltDoc struct {
+	Timestamp string `json:"timestamp"`
+	Source    string `json:"source"`
+	State     *State `json:"state"`
+	Raw       []byte `json:"raw,omitempty"`
+}
+
+// NewBolt opens (or creates) the Bolt database file.
+func NewBolt(config *BoltConfig) (st *BoltStorage, err error) {
+	st = &BoltStorage{}
+
+	st.db, err = bolt.Open(config.Path, 0600, &bolt.Options{
+		Timeout: 10 * time.Second,
+	})
+	if err != nil {
+		return st, fmt.Errorf("failed to open %s: %v", config.Path, err)
+	}
+
+	err = st.db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{
+			boltStatesBucket, boltLatestBucket, boltLocksBucket, boltTrashBucket,
+			boltTokensBucket, boltACLsBucket, boltAuditBucket, boltWebhooksBucket, boltDeliveriesBucket,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return fmt.Errorf("failed to create bucket %s: %v", b, err)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// GetName returns the storage's name.
+func (*BoltStorage) GetName() string {
+	return "bolt"
+}
+
+// GetLockStatus returns a Terraform lock.
+func (st *BoltStorage) GetLockStatus(ctx context.Context, name string) (lockStatus LockInfo, err error) {
+	err = st.db.View(func(tx *bolt.Tx) (err error) {
+		lockStatus, err = boltGetLock(tx, name)
+		return
+	})
+	return
+}
+
+// LockState locks a Terraform state.
+// Checking for an existing lock and taking it is done in a single transaction.
+// If the state is already locked, it returns ErrLocked
+// along with the current lock.
+func (st *BoltStorage) LockState(ctx context.Context, name string, lockData LockInfo) (lockStatus LockInfo, err error) {
+	// State file uses the same key as lock
+	lockData.Path = name
+
+	data, err := json.Marshal(lockData)
+	if err != nil {
+		return lockStatus, fmt.Errorf("failed to marshal lock: %v", err)
+	}
+
+	err = st.db.Update(func(tx *bolt.Tx) (err error) {
+		lockStatus, err = boltGetLock(tx, name)
+		if err == nil {
+			return ErrLocked
+		} else if err != ErrNoDocuments {
+			return fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+		}
+
+		lockStatus = lockData
+		return tx.Bucket(boltLocksBucket).Put([]byte(name), data)
+	})
+	return
+}
+
+// UnlockState unlocks a Terraform state.
+// If the state is locked with another lock ID, it returns ErrLockIDMismatch
+// along with the current lock.
+func (st *BoltStorage) UnlockState(ctx context.Context, name string, lockData LockInfo) (lockStatus LockInfo, err error) {
+	err = st.db.Update(func(tx *bolt.Tx) (err error) {
+		lockStatus, err = boltGetLock(tx, name)
+		if err == ErrNoDocuments {
+			// Not locked
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+		}
+		if lockStatus.ID != lockData.ID {
+			return ErrLockIDMismatch
+		}
+
+		return tx.Bucket(boltLocksBucket).Delete([]byte(name))
+	})
+	return
+}
+
+// ForceUnlockState unlocks a Terraform state, whatever its lock ID,
+// and returns the removed lock.
+func (st *BoltStorage) ForceUnlockState(ctx context.Context, name string) (lockStatus LockInfo, err error) {
+	err = st.db.Update(func(tx *bolt.Tx) (err error) {
+		lockStatus, err = boltGetLock(tx, name)
+		if err != nil {
+			return
+		}
+
+		return tx.Bucket(boltLocksBucket).Delete([]byte(name))
+	})
+	return
+}
+
+// RemoveState moves the Terraform states to the trash.
+func (st *BoltStorage) RemoveState(ctx context.Context, name string) (err error) {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		latest := tx.Bucket(boltLatestBucket)
+		key := latest.Get([]byte(name))
+		if key == nil {
+			return ErrNoDocuments
+		}
+
+		data, err := json.Marshal(&DeletedState{
+			Name:      name,
+			Serial:    int64(binary.BigEndian.Uint64(key)),
+			DeletedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal deleted state: %v", err)
+		}
+
+		err = tx.Bucket(boltTrashBucket).Put([]byte(name), data)
+		if err != nil {
+			return fmt.Errorf("failed to remove state: %v", err)
+		}
+		return latest.Delete([]byte(name))
+	})
+}
+
+// ListTrash returns the states in the trash
+func (st *BoltStorage) ListTrash(ctx context.Context, pageNum, pageSize int) (coll DeletedStateCollection, err error) {
+	err = st.db.View(func(tx *bolt.Tx) error {
+		trash := tx.Bucket(boltTrashBucket)
+		coll.Metadata = paginationMetadata(trash.Stats().KeyN, pageNum)
+
+		return boltPaginate(trash.Cursor(), nil, pageNum, pageSize, func(k, v []byte) error {
+			var deleted DeletedState
+			if err := json.Unmarshal(v, &deleted); err != nil {
+				return fmt.Errorf("failed to unmarshal deleted state: %v", err)
+			}
+			coll.Data = append(coll.Data, &deleted)
+			return nil
+		})
+	})
+	return
+}
+
+// RestoreState moves Terraform states back from the trash.
+func (st *BoltStorage) RestoreState(ctx context.Context, name string) (err error) {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		trash := tx.Bucket(boltTrashBucket)
+		if trash.Get([]byte(name)) == nil {
+			return ErrNoDocuments
+		}
+
+		// Serials are sorted, so the last key is the latest serial
+		if b := tx.Bucket(boltStatesBucket).Bucket([]byte(name)); b != nil {
+			if key, _ := b.Cursor().Last(); key != nil {
+				err := tx.Bucket(boltLatestBucket).Put([]byte(name), key)
+				if err != nil {
+					return fmt.Errorf("failed to restore state: %v", err)
+				}
+			}
+		}
+		return trash.Delete([]byte(name))
+	})
+}
+
+// PurgeState permanently removes the Terraform states from the trash,
+// along with their lock.
+func (st *BoltStorage) PurgeState(ctx context.Context, name string) (err error) {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		trash := tx.Bucket(boltTrashBucket)
+		if trash.Get([]byte(name)) == nil {
+			return ErrNoDocuments
+		}
+
+		err := tx.Bucket(boltStatesBucket).DeleteBucket([]byte(name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return fmt.Errorf("failed to purge state: %v", err)
+		}
+		err = tx.Bucket(boltLocksBucket).Delete([]byte(name))
+		if err != nil {
+			return fmt.Errorf("failed to remove lock: %v", err)
+		}
+		return trash.Delete([]byte(name))
+	})
+}
+
+// ListStates returns all state names from TerraDB
+func (st *BoltStorage) ListStates(ctx context.Context, prefix string, pageNum, pageSize int) (coll StateCollection, err error) {
+	err = st.db.View(func(tx *bolt.Tx) error {
+		latest := tx.Bucket(boltLatestBucket)
+		states := tx.Bucket(boltStatesBucket)
+
+		total := latest.Stats().KeyN
+		if prefix != "" {
+			total = 0
+			c := latest.Cursor()
+			for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+				total++
+			}
+		}
+		coll.Metadata = paginationMetadata(total, pageNum)
+
+		return boltPaginate(latest.Cursor(), []byte(prefix), pageNum, pageSize, func(k, v []byte) error {
+			name := string(k)
+			state, err := boltGetDoc(states.Bucket(k), v, name)
+			if err != nil {
+				return fmt.Errorf("failed to get state: %v", err)
+			}
+
+			// Init value required because of omitempty
+			state.Locked = false
+			state.LockInfo, err = boltGetLock(tx, name)
+			if err == nil {
+				state.Locked = true
+			} else if err != ErrNoDocuments {
+				return fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+			}
+			coll.Data = append(coll.Data, state)
+			return nil
+		})
+	})
+	return
+}
+
+// GetState retrieves a Terraform state, at a given serial.
+// If serial is 0, it gets the latest serial
+func (st *BoltStorage) GetState(ctx context.Context, name string, serial int) (state State, err error) {
+	err = st.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltTrashBucket).Get([]byte(name)) != nil {
+			return ErrNoDocuments
+		}
+
+		key := boltSerialKey(int64(serial))
+		if serial == 0 {
+			key = tx.Bucket(boltLatestBucket).Get([]byte(name))
+			if key == nil {
+				return ErrNoDocuments
+			}
+		}
+
+		s, err := boltGetDoc(tx.Bucket(boltStatesBucket).Bucket([]byte(name)), key, name)
+		if err != nil {
+			return err
+		}
+		state = *s
+
+		// Init value required because of omitempty
+		state.Locked = false
+		state.LockInfo, err = boltGetLock(tx, name)
+		if err == nil {
+			state.Locked = true
+		} else if err != ErrNoDocuments {
+			return fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+		}
+		return nil
+	})
+	return
+}
+
+// InsertState adds a Terraform state to the database,
+// if the conditions hold. They are checked in the same transaction.
+func (st *BoltStorage) InsertState(ctx context.Context, doc State, timestamp, source, name string, cond InsertConditions) (err error) {
+	data, err := json.Marshal(&boltDoc{
+		Timestamp: timestamp,
+		Source:    source,
+		State:     &doc,
+		Raw:       doc.Raw,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+
+	return st.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltTrashBucket).Get([]byte(name)) != nil {
+			return ErrStateDeleted
+		}
+
+		var lock *LockInfo
+		l, err := boltGetLock(tx, name)
+		if err == nil {
+			lock = &l
+		} else if err != ErrNoDocuments {
+			return fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+		}
+		var latest *State
+		if key := tx.Bucket(boltLatestBucket).Get([]byte(name)); key != nil {
+			latest, err = boltGetDoc(tx.Bucket(boltStatesBucket).Bucket([]byte(name)), key, name)
+			if err != nil {
+				return fmt.Errorf("failed to get latest state: %v", err)
+			}
+		}
+		err = cond.check(lock, latest, doc)
+		if err != nil {
+			return err
+		}
+
+		b, err := tx.Bucket(boltStatesBucket).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return fmt.Errorf("failed to create state bucket: %v", err)
+		}
+
+		key := boltSerialKey(doc.Serial)
+		err = b.Put(key, data)
+		if err != nil {
+			return fmt.Errorf("failed to insert state: %v", err)
+		}
+
+		// Keep the latest serial index up to date
+		index := tx.Bucket(boltLatestBucket)
+		if current := index.Get([]byte(name)); current == nil || bytes.Compare(key, current) > 0 {
+			return index.Put([]byte(name), key)
+		}
+		return nil
+	})
+}
+
+// ListStateSerials returns all state serials with a given name.
+func (st *BoltStorage) ListStateSerials(ctx context.Context, name string, pageNum, pageSize int) (coll StateCollection, err error) {
+	return st.listSerials(name, false, pageNum, pageSize)
+}
+
+// listTrashedSerials returns the serials of a state in the trash.
+func (st *BoltStorage) listTrashedSerials(ctx context.Context, name string, pageNum, pageSize int) (coll StateCollection, err error) {
+	return st.listSerials(name, true, pageNum, pageSize)
+}
+
+// replaceTrashedSerial replaces a serial of a state in the trash,
+// which stays in the trash.
+func (st *BoltStorage) replaceTrashedSerial(ctx context.Context, doc State, timestamp, source, name string) (err error) {
+	data, err := json.Marshal(&boltDoc{
+		Timestamp: timestamp,
+		Source:    source,
+		State:     &doc,
+		Raw:       doc.Raw,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+
+	return st.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltTrashBucket).Get([]byte(name)) == nil {
+			return ErrNoDocuments
+		}
+		b := tx.Bucket(boltStatesBucket).Bucket([]byte(name))
+		key := boltSerialKey(doc.Serial)
+		if b == nil || b.Get(key) == nil {
+			return ErrNoDocuments
+		}
+		return b.Put(key, data)
+	})
+}
+
+// listSerials returns the serials of a state, if it is in the trash or not
+func (st *BoltStorage) listSerials(name string, trashed bool, pageNum, pageSize int) (coll StateCollection, err error) {
+	err = st.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltStatesBucket).Bucket([]byte(name))
+		if b == nil || (tx.Bucket(boltTrashBucket).Get([]byte(name)) != nil) != trashed {
+			coll.Metadata = paginationMetadata(0, pageNum)
+			return nil
+		}
+
+		coll.Metadata = paginationMetadata(b.Stats().KeyN, pageNum)
+
+		return boltPaginate(b.Cursor(), nil, pageNum, pageSize, func(k, v []byte) error {
+			state, err := boltDecodeDoc(v, name)
+			if err != nil {
+				return fmt.Errorf("failed to get state: %v", err)
+			}
+			coll.Data = append(coll.Data, state)
+			return nil
+		})
+	})
+	return
+}
+
+// GetResource retrieves a Terraform resource given a state, module and name
+func (st *BoltStorage) GetResource(ctx context.Context, state, module, name string) (res Resource, err error) {
+	s, err := st.GetState(ctx, state, 0)
+	if err == ErrNoDocuments {
+		return
+	} else if err != nil {
+		return res, fmt.Errorf("failed to get resource: %v", err)
+	}
+
+	res, err = getResource(s, module, name)
+	return
+}
+
+// InsertToken adds an API token, or replaces the token with the same ID.
+func (st *BoltStorage) InsertToken(ctx context.Context, token Token) (err error) {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token: %v", err)
+	}
+
+	return st.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTokensBucket).Put([]byte(token.ID), data)
+	})
+}
+
+// GetToken returns an API token by ID
+func (st *BoltStorage) GetToken(ctx context.Context, id string) (token Token, err error) {
+	err = st.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltTokensBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNoDocuments
+		}
+		return json.Unmarshal(data, &token)
+	})
+	return
+}
+
+// ListTokens returns the API tokens
+func (st *BoltStorage) ListTokens(ctx context.Context, pageNum, pageSize int) (coll TokenCollection, err error) {
+	err = st.db.View(func(tx *bolt.Tx) error {
+		tokens := tx.Bucket(boltTokensBucket)
+		coll.Metadata = paginationMetadata(tokens.Stats().KeyN, pageNum)
+
+		return boltPaginate(tokens.Cursor(), nil, pageNum, pageSize, func(k, v []byte) error {
+			var token Token
+			if err := json.Unmarshal(v, &token); err != nil {
+				return fmt.Errorf("failed to unmarshal token: %v", err)
+			}
+			coll.Data = append(coll.Data, &token)
+			return nil
+		})
+	})
+	return
+}
+
+// RemoveToken revokes an API token
+func (st *BoltStorage) RemoveToken(ctx context.Context, id string) (err error) {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		tokens := tx.Bucket(boltTokensBucket)
+		if tokens.Get([]byte(id)) == nil {
+			return ErrNoDocuments
+		}
+		return tokens.Delete([]byte(id))
+	})
+}
+
+// InsertACL adds an ACL, or replaces the ACL with the same ID.
+func (st *BoltStorage) InsertACL(ctx context.Context, acl ACL) (err error) {
+	data, err := json.Marshal(acl)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ACL: %v", err)
+	}
+
+	return st.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltACLsBucket).Put([]byte(acl.ID), data)
+	})
+}
+
+// ListACLs returns the ACLs
+func (st *BoltStorage) ListACLs(ctx context.Context, pageNum, pageSize int) (coll ACLCollection, err error) {
+	err = st.db.View(func(tx *bolt.Tx) error {
+		acls := tx.Bucket(boltACLsBucket)
+		coll.Metadata = paginationMetadata(acls.Stats().KeyN, pageNum)
+
+		return boltPaginate(acls.Cursor(), nil, pageNum, pageSize, func(k, v []byte) error {
+			var acl ACL
+			if err := json.Unmarshal(v, &acl); err != nil {
+				return fmt.Errorf("failed to unmarshal ACL: %v", err)
+			}
+			coll.Data = append(coll.Data, &acl)
+			return nil
+		})
+	})
+	return
+}
+
+// RemoveACL removes an ACL
+func (st *BoltStorage) RemoveACL(ctx context.Context, id string) (err error) {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		acls := tx.Bucket(boltACLsBucket)
+		if acls.Get([]byte(id)) == nil {
+			return ErrNoDocuments
+		}
+		return acls.Delete([]byte(id))
+	})
+}
+
+// InsertAuditRecord adds an audit record
+func (st *BoltStorage) InsertAuditRecord(ctx context.Context, record AuditRecord) (err error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %v", err)
+	}
+
+	return st.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAuditBucket).Put([]byte(record.ID), data)
+	})
+}
+
+// ListAuditRecords returns the audit records selected by filter.
+// All the records are scanned, most recent first, to count the matches.
+func (st *BoltStorage) ListAuditRecords(ctx context.Context, filter AuditFilter, pageNum, pageSize int) (coll AuditCollection, err error) {
+	skips := pageSize * (pageNum - 1)
+
+	total := 0
+	err = st.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltAuditBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var record AuditRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("failed to unmarshal audit record: %v", err)
+			}
+			if !filter.Match(&record) {
+				continue
+			}
+			if total >= skips && total < skips+pageSize {
+				coll.Data = append(coll.Data, &record)
+			}
+			total++
+		}
+		return nil
+	})
+	coll.Metadata = paginationMetadata(total, pageNum)
+	return
+}
+
+// InsertWebhook adds a webhook, or replaces the webhook with the same ID.
+func (st *BoltStorage) InsertWebhook(ctx context.Context, webhook Webhook) (err error) {
+	data, err := json.Marshal(webhook)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook: %v", err)
+	}
+
+	return st.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltWebhooksBucket).Put([]byte(webhook.ID), data)
+	})
+}
+
+// ListWebhooks returns the webhooks
+func (st *BoltStorage) ListWebhooks(ctx context.Context, pageNum, pageSize int) (coll WebhookCollection, err error) {
+	err = st.db.View(func(tx *bolt.Tx) error {
+		webhooks := tx.Bucket(boltWebhooksBucket)
+		coll.Metadata = paginationMetadata(webhooks.Stats().KeyN, pageNum)
+
+		return boltPaginate(webhooks.Cursor(), nil, pageNum, pageSize, func(k, v []byte) error {
+			var webhook Webhook
+			if err := json.Unmarshal(v, &webhook); err != nil {
+				return fmt.Errorf("failed to unmarshal webhook: %v", err)
+			}
+			coll.Data = append(coll.Data, &webhook)
+			return nil
+		})
+	})
+	return
+}
+
+// RemoveWebhook removes a webhook
+func (st *BoltStorage) RemoveWebhook(ctx context.Context, id string) (err error) {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		webhooks := tx.Bucket(boltWebhooksBucket)
+		if webhooks.Get([]byte(id)) == nil {
+			return ErrNoDocuments
+		}
+		return webhooks.Delete([]byte(id))
+	})
+}
+
+// InsertDelivery adds a webhook delivery, or replaces the delivery with the same ID.
+func (st *BoltStorage) InsertDelivery(ctx context.Context, delivery Delivery) (err error) {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %v", err)
+	}
+
+	return st.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDeliveriesBucket).Put([]byte(delivery.ID), data)
+	})
+}
+
+// ListDeliveries returns the webhook deliveries selected by filter.
+// All the deliveries are scanned, most recent first, to count the matches.
+func (st *BoltStorage) ListDeliveries(ctx context.Context, filter DeliveryFilter, pageNum, pageSize int) (coll DeliveryCollection, err error) {
+	skips := pageSize * (pageNum - 1)
+
+	total := 0
+	err = st.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltDeliveriesBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var delivery Delivery
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return fmt.Errorf("failed to unmarshal delivery: %v", err)
+			}
+			if !filter.Match(&delivery) {
+				continue
+			}
+			if total >= skips && total < skips+pageSize {
+				coll.Data = append(coll.Data, &delivery)
+			}
+			total++
+		}
+		return nil
+	})
+	coll.Metadata = paginationMetadata(total, pageNum)
+	return
+}
+
+// boltSerialKey encodes a serial so that keys sort in serial order.
+func boltSerialKey(serial int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(serial))
+	return key
+}
+
+// boltPaginate walks a page of the keys of a bucket starting with prefix
+// using its cursor, skipping the entries of the previous pages.
+func boltPaginate(c *bolt.Cursor, prefix []byte, pageNum, pageSize int, fn func(k, v []byte) error) error {
+	skips := pageSize * (pageNum - 1)
+
+	k, v := c.First()
+	if len(prefix) > 0 {
+		k, v = c.Seek(prefix)
+	}
+
+	i := 0
+	for ; k != nil && bytes.HasPrefix(k, prefix) && i < skips+pageSize; k, v = c.Next() {
+		if i >= skips {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		i++
+	}
+	return nil
+}
+
+func boltGetLock(tx *bolt.Tx, name string) (lockStatus LockInfo, err error) {
+	data := tx.Bucket(boltLocksBucket).Get([]byte(name))
+	if data == nil {
+		return lockStatus, ErrNoDocuments
+	}
+	err = json.Unmarshal(data, &lockStatus)
+	return
+}
+
+func boltGetDoc(b *bolt.Bucket, key []byte, name string) (state *State, err error) {
+	if b == nil {
+		return nil, ErrNoDocuments
+	}
+	data := b.Get(key)
+	if data == nil {
+		return nil, ErrNoDocuments
+	}
+	return boltDecodeDoc(data, name)
+}
+
+func boltDecodeDoc(data []byte, name string) (state *State, err error) {
+	var doc boltDoc
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return state, fmt.Errorf("failed to unmarshal state: %v", err)
+	}
+	state = doc.State
+	if state == nil {
+		state = &State{}
+	}
+	state.Raw = doc.Raw
+	state.Name = name
+	state.LastModified, err = time.Parse("20060102150405", doc.Timestamp)
+	if err != nil {
+		return state, fmt.Errorf("failed to convert timestamp: %v", err)
+	}
+	return
+}
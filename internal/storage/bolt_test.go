@@ -0,0 +1,32 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/camptocamp/terradb/internal/storage"
+	"github.com/camptocamp/terradb/internal/storage/storagetest"
+)
+
+func TestBoltStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terradb-bolt")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		f, err := ioutil.TempFile(dir, "terradb.db")
+		if err != nil {
+			t.Fatalf("failed to create database file: %v", err)
+		}
+		f.Close()
+
+		st, err := storage.NewBolt(&storage.BoltConfig{Path: f.Name()})
+		if err != nil {
+			t.Fatalf("failed to open Bolt storage: %v", err)
+		}
+		return st
+	})
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// deltaOp is an operation of a line-based delta between two documents:
+// either a copy of lines from the base document, or lines to insert.
+// Lines keep their line feed, so that documents are rebuilt byte for byte.
+type deltaOp struct {
+	// Copy is the [start, count] range of base lines to copy
+	Copy   []int    `json:"copy,omitempty"`
+	Insert []string `json:"insert,omitempty"`
+}
+
+// deltaSearchWindow is the number of occurrences of a line in the base
+// document which are considered when looking for a matching block
+const deltaSearchWindow = 64
+
+// DeltaStats describes the space saved by delta-encoded serials
+type DeltaStats struct {
+	Serials   int `json:"serials"`
+	Snapshots int `json:"snapshots"`
+	Deltas    int `json:"deltas"`
+
+	// FullBytes is the size of the delta-encoded serials
+	// if they were stored in full, and DeltaBytes their actual size
+	FullBytes  int64 `json:"full_bytes"`
+	DeltaBytes int64 `json:"delta_bytes"`
+	SavedBytes int64 `json:"saved_bytes"`
+}
+
+// diffLines returns the operations which rebuild target from base.
+// It greedily copies the longest blocks of base lines it finds,
+// preferring blocks close to the previous copy.
+func diffLines(base, target []byte) (ops []deltaOp) {
+	baseLines := splitLines(base)
+	targetLines := splitLines(target)
+
+	positions := make(map[string][]int)
+	for i, l := range baseLines {
+		positions[l] = append(positions[l], i)
+	}
+
+	next := 0
+	for i := 0; i < len(targetLines); {
+		start, count := -1, 0
+
+		// Extending the previous copy is the most common case
+		candidates := positions[targetLines[i]]
+		j := sort.SearchInts(candidates, next)
+		lo, hi := j-deltaSearchWindow/2, j+deltaSearchWindow/2
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(candidates) {
+			hi = len(candidates)
+		}
+		for _, p := range candidates[lo:hi] {
+			n := 0
+			for p+n < len(baseLines) && i+n < len(targetLines) && baseLines[p+n] == targetLines[i+n] {
+				n++
+			}
+			if n > count || (n == count && p == next) {
+				start, count = p, n
+			}
+		}
+
+		if count == 0 {
+			if len(ops) == 0 || ops[len(ops)-1].Insert == nil {
+				ops = append(ops, deltaOp{Insert: []string{}})
+			}
+			last := &ops[len(ops)-1]
+			last.Insert = append(last.Insert, targetLines[i])
+			i++
+			continue
+		}
+
+		ops = append(ops, deltaOp{Copy: []int{start, count}})
+		i += count
+		next = start + count
+	}
+	return
+}
+
+// applyDelta rebuilds a document from its base and delta operations
+func applyDelta(base []byte, ops []deltaOp) ([]byte, error) {
+	baseLines := splitLines(base)
+
+	var buf bytes.Buffer
+	for _, op := range ops {
+		if op.Copy == nil {
+			for _, l := range op.Insert {
+				buf.WriteString(l)
+			}
+			continue
+		}
+
+		if len(op.Copy) != 2 {
+			return nil, fmt.Errorf("invalid copy operation %v", op.Copy)
+		}
+		start, count := op.Copy[0], op.Copy[1]
+		if start < 0 || count < 0 || start+count > len(baseLines) {
+			return nil, fmt.Errorf("copy of lines %d-%d out of the %d base lines", start, start+count, len(baseLines))
+		}
+		for _, l := range baseLines[start : start+count] {
+			buf.WriteString(l)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// splitLines splits a document after each line feed
+func splitLines(data []byte) (lines []string) {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			lines = append(lines, string(data))
+			break
+		}
+		lines = append(lines, string(data[:i+1]))
+		data = data[i+1:]
+	}
+	return
+}
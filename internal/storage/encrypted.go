@@ -0,0 +1,510 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EncryptedBody is the encrypted body of a state. The body is encrypted
+// with the data key of the state, which is stored wrapped by a master key.
+type EncryptedBody struct {
+	// KeyID identifies the master key which wraps DataKey
+	KeyID   string `json:"key_id"`
+	DataKey []byte `json:"data_key"`
+
+	// Raw tells whether the body is the pushed document,
+	// or the Terraform state when the document was not kept
+	Raw  bool   `json:"raw,omitempty"`
+	Body []byte `json:"body"`
+}
+
+// masterKeySize is the size of master and data keys (AES-256)
+const masterKeySize = 32
+
+// encryptionRotationSource is the source of the serials
+// written when re-encrypting them
+const encryptionRotationSource = "key-rotation"
+
+// encryptionPageSize is the page size used when re-encrypting all serials
+const encryptionPageSize = 100
+
+// Keyring holds the master keys which wrap the data keys of the states.
+// New serials are encrypted with the current key, older keys are only
+// used to decrypt the serials which have not been re-encrypted yet.
+type Keyring struct {
+	current *masterKey
+	keys    map[string]*masterKey
+}
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewKeyring returns a keyring with a current master key and older keys
+func NewKeyring(current []byte, old ...[]byte) (k *Keyring, err error) {
+	k = &Keyring{
+		keys: make(map[string]*masterKey),
+	}
+
+	for i, key := range append([][]byte{current}, old...) {
+		mk, err := newMasterKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			k.current = mk
+		}
+		k.keys[mk.id] = mk
+	}
+	return
+}
+
+// ParseKey decodes a base64-encoded master key
+func ParseKey(s string) (key []byte, err error) {
+	key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key: %v", err)
+	}
+	if len(key) != masterKeySize {
+		return nil, fmt.Errorf("key is %d bytes long, expected %d", len(key), masterKeySize)
+	}
+	return
+}
+
+// LoadKeyFile reads a base64-encoded master key from a file
+func LoadKeyFile(path string) (key []byte, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
+	}
+	key, err = ParseKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %v", path, err)
+	}
+	return
+}
+
+// newMasterKey returns a master key, identified by its SHA-256 prefix
+// so that the keys of a keyring can be listed in any order
+func newMasterKey(key []byte) (mk *masterKey, err error) {
+	if len(key) != masterKeySize {
+		return nil, fmt.Errorf("key is %d bytes long, expected %d", len(key), masterKeySize)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(key)
+	return &masterKey{
+		id:   hex.EncodeToString(sum[:8]),
+		aead: aead,
+	}, nil
+}
+
+func newAEAD(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data, prefixing it with a random nonce
+func seal(aead cipher.AEAD, data, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return aead.Seal(nonce, nonce, data, additional), nil
+}
+
+// open decrypts data sealed by seal
+func open(aead cipher.AEAD, data, additional []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, data[:n], data[n:], additional)
+}
+
+// EncryptedStorage encrypts the state bodies of another storage.
+// Only the metadata of the states (version, serial, lineage and checksum)
+// is stored in clear, so that storages can still index serials.
+//
+// Each state has its own data key, which is stored with each serial
+// wrapped by the current master key. Serials stored in clear,
+// before encryption was enabled, are returned as is.
+type EncryptedStorage struct {
+	Storage
+	keyring *Keyring
+}
+
+// NewEncrypted returns a storage encrypting the state bodies of st
+func NewEncrypted(st Storage, keyring *Keyring) *EncryptedStorage {
+	return &EncryptedStorage{
+		Storage: st,
+		keyring: keyring,
+	}
+}
+
+// GetName returns the storage's name.
+func (st *EncryptedStorage) GetName() string {
+	return st.Storage.GetName() + "+encrypted"
+}
+
+// ListStates returns all state names from TerraDB
+func (st *EncryptedStorage) ListStates(ctx context.Context, prefix string, pageNum, pageSize int) (coll StateCollection, err error) {
+	coll, err = st.Storage.ListStates(ctx, prefix, pageNum, pageSize)
+	if err != nil {
+		return
+	}
+	err = st.decryptAll(coll.Data)
+	return
+}
+
+// GetState retrieves a Terraform state, at a given serial.
+// If serial is 0, it gets the latest serial
+func (st *EncryptedStorage) GetState(ctx context.Context, name string, serial int) (state State, err error) {
+	state, err = st.Storage.GetState(ctx, name, serial)
+	if err != nil {
+		return
+	}
+	err = st.decrypt(&state)
+	return
+}
+
+// InsertState adds a Terraform state to the database,
+// if the conditions hold. The data key of the latest serial is reused,
+// and generated for the first serial of a state.
+func (st *EncryptedStorage) InsertState(ctx context.Context, doc State, timestamp, source, name string, cond InsertConditions) (err error) {
+	var dataKey []byte
+	latest, err := st.Storage.GetState(ctx, name, 0)
+	if err == nil && latest.Encryption != nil {
+		dataKey, err = st.unwrapKey(name, latest.Encryption)
+		if err != nil {
+			return
+		}
+	} else if err != nil && err != ErrNoDocuments {
+		return
+	}
+	if dataKey == nil {
+		dataKey, err = newDataKey()
+		if err != nil {
+			return
+		}
+	}
+
+	enc, err := st.encrypt(name, doc, dataKey)
+	if err != nil {
+		return
+	}
+	return st.Storage.InsertState(ctx, enc, timestamp, source, name, cond)
+}
+
+// ListStateSerials returns all state serials with a given name.
+func (st *EncryptedStorage) ListStateSerials(ctx context.Context, name string, pageNum, pageSize int) (coll StateCollection, err error) {
+	coll, err = st.Storage.ListStateSerials(ctx, name, pageNum, pageSize)
+	if err != nil {
+		return
+	}
+	err = st.decryptAll(coll.Data)
+	return
+}
+
+// GetResource retrieves a Terraform resource given a state, module and name
+func (st *EncryptedStorage) GetResource(ctx context.Context, state, module, name string) (res Resource, err error) {
+	s, err := st.GetState(ctx, state, 0)
+	if err == ErrNoDocuments {
+		return
+	} else if err != nil {
+		return res, fmt.Errorf("failed to get resource: %v", err)
+	}
+
+	return getResource(s, module, name)
+}
+
+// Rotate re-encrypts all serials of the states with the current master key,
+// generating a new data key for each state. States in the trash are
+// re-encrypted in place, and stay in the trash.
+//
+// Git storages are refused, since their history would keep the serials
+// encrypted with the former keys, or stored in clear.
+func (st *EncryptedStorage) Rotate(ctx context.Context) (serials int, err error) {
+	if _, ok := st.Storage.(*GitStorage); ok {
+		return 0, fmt.Errorf("the Git history keeps the former serials, they cannot be re-encrypted")
+	}
+
+	var names []string
+	for page := 1; ; page++ {
+		coll, err := st.Storage.ListStates(ctx, "", page, encryptionPageSize)
+		if err != nil {
+			return serials, fmt.Errorf("failed to list states: %v", err)
+		}
+		for _, s := range coll.Data {
+			names = append(names, s.Name)
+		}
+		if len(coll.Data) < encryptionPageSize {
+			break
+		}
+	}
+
+	var trashed []string
+	for page := 1; ; page++ {
+		coll, err := st.Storage.ListTrash(ctx, page, encryptionPageSize)
+		if err != nil {
+			return serials, fmt.Errorf("failed to list trash: %v", err)
+		}
+		for _, s := range coll.Data {
+			trashed = append(trashed, s.Name)
+		}
+		if len(coll.Data) < encryptionPageSize {
+			break
+		}
+	}
+
+	for _, name := range names {
+		n, err := st.rotateState(ctx, name)
+		serials += n
+		if err != nil {
+			return serials, fmt.Errorf("failed to re-encrypt %s: %v", name, err)
+		}
+
+		log.WithFields(log.Fields{
+			"name":    name,
+			"serials": n,
+		}).Info("Re-encrypted state")
+	}
+
+	for _, name := range trashed {
+		n, err := st.rotateTrashedState(ctx, name)
+		serials += n
+		if err != nil {
+			return serials, fmt.Errorf("failed to re-encrypt %s from the trash: %v", name, err)
+		}
+
+		log.WithFields(log.Fields{
+			"name":    name,
+			"serials": n,
+		}).Info("Re-encrypted trashed state")
+	}
+	return
+}
+
+// trashRewriter is implemented by the storages whose states can be
+// re-encrypted in the trash, without being restored
+type trashRewriter interface {
+	listTrashedSerials(ctx context.Context, name string, pageNum, pageSize int) (coll StateCollection, err error)
+	replaceTrashedSerial(ctx context.Context, doc State, timestamp, source, name string) (err error)
+}
+
+// rotateTrashedState re-encrypts a state in the trash in place,
+// so that it stays hidden and keeps its deletion date
+func (st *EncryptedStorage) rotateTrashedState(ctx context.Context, name string) (serials int, err error) {
+	trash, ok := st.Storage.(trashRewriter)
+	if !ok {
+		return 0, fmt.Errorf("the %s storage cannot re-encrypt states in the trash", st.Storage.GetName())
+	}
+
+	list := func(page int) (coll StateCollection, err error) {
+		coll, err = trash.listTrashedSerials(ctx, name, page, encryptionPageSize)
+		if err != nil {
+			return
+		}
+		err = st.decryptAll(coll.Data)
+		return
+	}
+	write := func(enc State, timestamp string) error {
+		return trash.replaceTrashedSerial(ctx, enc, timestamp, encryptionRotationSource, name)
+	}
+	return st.rotateSerials(name, list, write)
+}
+
+func (st *EncryptedStorage) rotateState(ctx context.Context, name string) (serials int, err error) {
+	list := func(page int) (StateCollection, error) {
+		return st.ListStateSerials(ctx, name, page, encryptionPageSize)
+	}
+	// Serials are rewritten as they are, whoever holds the lock
+	write := func(enc State, timestamp string) error {
+		return st.Storage.InsertState(ctx, enc, timestamp, encryptionRotationSource, name, InsertConditions{})
+	}
+	return st.rotateSerials(name, list, write)
+}
+
+// rotateSerials re-encrypts the serials of a state with a new data key,
+// reading them with list and writing them with write
+func (st *EncryptedStorage) rotateSerials(name string, list func(page int) (StateCollection, error), write func(enc State, timestamp string) error) (serials int, err error) {
+	dataKey, err := newDataKey()
+	if err != nil {
+		return
+	}
+
+	var docs []*State
+	for page := 1; ; page++ {
+		coll, err := list(page)
+		if err != nil {
+			return serials, err
+		}
+		docs = append(docs, coll.Data...)
+		if len(coll.Data) < encryptionPageSize {
+			break
+		}
+	}
+
+	// The latest serial is written last, since its data key
+	// is the one reused by the next serials
+	for _, doc := range docs {
+		enc, err := st.encrypt(name, *doc, dataKey)
+		if err != nil {
+			return serials, err
+		}
+		err = write(enc, doc.LastModified.Format("20060102150405"))
+		if err != nil {
+			return serials, err
+		}
+		serials++
+	}
+	return
+}
+
+// encrypt returns the metadata of a state, along with its encrypted body
+func (st *EncryptedStorage) encrypt(name string, doc State, dataKey []byte) (enc State, err error) {
+	body, raw := doc.Raw, true
+	if body == nil {
+		raw = false
+		doc.Encryption = nil
+		body, err = TerraformStateJSON(doc)
+		if err != nil {
+			return enc, fmt.Errorf("failed to marshal state: %v", err)
+		}
+	}
+
+	// Encrypted states can only be compared by their checksums
+	if doc.MD5 == "" {
+		sum := md5.Sum(body)
+		doc.MD5 = base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return
+	}
+	sealed, err := seal(aead, body, bodyAdditionalData(name, doc.Serial))
+	if err != nil {
+		return enc, fmt.Errorf("failed to encrypt state: %v", err)
+	}
+	wrapped, err := seal(st.keyring.current.aead, dataKey, []byte(name))
+	if err != nil {
+		return enc, fmt.Errorf("failed to wrap data key: %v", err)
+	}
+
+	enc = State{
+		Version:   doc.Version,
+		TFVersion: doc.TFVersion,
+		Serial:    doc.Serial,
+		Lineage:   doc.Lineage,
+		MD5:       doc.MD5,
+		Encryption: &EncryptedBody{
+			KeyID:   st.keyring.current.id,
+			DataKey: wrapped,
+			Raw:     raw,
+			Body:    sealed,
+		},
+	}
+	return
+}
+
+// decrypt replaces the metadata of an encrypted state with the full state,
+// keeping the fields set by the storage
+func (st *EncryptedStorage) decrypt(state *State) (err error) {
+	if state.Encryption == nil {
+		return nil
+	}
+	enc := state.Encryption
+
+	dataKey, err := st.unwrapKey(state.Name, enc)
+	if err != nil {
+		return
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return
+	}
+	body, err := open(aead, enc.Body, bodyAdditionalData(state.Name, state.Serial))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt serial %d of %s: %v", state.Serial, state.Name, err)
+	}
+
+	var dec State
+	err = json.Unmarshal(body, &dec)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal state: %v", err)
+	}
+	dec.MD5 = state.MD5
+	if enc.Raw {
+		dec.Raw = body
+		// Some storages only keep the checksum along with raw documents
+		if dec.MD5 == "" {
+			sum := md5.Sum(body)
+			dec.MD5 = base64.StdEncoding.EncodeToString(sum[:])
+		}
+	}
+	dec.Name = state.Name
+	dec.LastModified = state.LastModified
+	dec.Locked = state.Locked
+	dec.LockInfo = state.LockInfo
+	*state = dec
+	return
+}
+
+func (st *EncryptedStorage) decryptAll(states []*State) (err error) {
+	for _, s := range states {
+		err = st.decrypt(s)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// unwrapKey returns the data key of an encrypted state
+func (st *EncryptedStorage) unwrapKey(name string, enc *EncryptedBody) (dataKey []byte, err error) {
+	mk, ok := st.keyring.keys[enc.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %s for state %s", enc.KeyID, name)
+	}
+	dataKey, err = open(mk.aead, enc.DataKey, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key of %s: %v", name, err)
+	}
+	return
+}
+
+func newDataKey() (key []byte, err error) {
+	key = make([]byte, masterKeySize)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %v", err)
+	}
+	return
+}
+
+// bodyAdditionalData binds an encrypted body to its state and serial,
+// so that it cannot be swapped with the body of another serial
+func bodyAdditionalData(name string, serial int64) []byte {
+	return []byte(fmt.Sprintf("%s/%d", name, serial))
+}
@@ -0,0 +1,144 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terradb/internal/storage"
+	"github.com/camptocamp/terradb/internal/storage/storagetest"
+)
+
+func newKeyring(t *testing.T, keys ...[]byte) *storage.Keyring {
+	k, err := storage.NewKeyring(keys[0], keys[1:]...)
+	if err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+	return k
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewEncrypted(storage.NewMemory(), newKeyring(t, key))
+	})
+}
+
+func TestEncryptedRotate(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		testEncryptedRotate(t, storage.NewMemory())
+	})
+
+	t.Run("Bolt", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "terradb-bolt")
+		if err != nil {
+			t.Fatalf("failed to create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		bolt, err := storage.NewBolt(&storage.BoltConfig{Path: filepath.Join(dir, "terradb.db")})
+		if err != nil {
+			t.Fatalf("failed to open Bolt storage: %v", err)
+		}
+		testEncryptedRotate(t, bolt)
+	})
+}
+
+func testEncryptedRotate(t *testing.T, inner storage.Storage) {
+	ctx := context.Background()
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	st := storage.NewEncrypted(inner, newKeyring(t, oldKey))
+	for _, name := range []string{"live", "trashed"} {
+		for serial := int64(1); serial <= 2; serial++ {
+			err := st.InsertState(ctx, storagetest.NewState(serial, "lineage"), storagetest.Timestamp, "direct", name, storage.InsertConditions{})
+			if err != nil {
+				t.Fatalf("failed to insert %s serial %d: %v", name, serial, err)
+			}
+		}
+	}
+	if err := st.RemoveState(ctx, "trashed"); err != nil {
+		t.Fatalf("failed to remove state: %v", err)
+	}
+	before, err := inner.ListTrash(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list trash: %v", err)
+	}
+
+	rotated := storage.NewEncrypted(inner, newKeyring(t, newKey, oldKey))
+	time.Sleep(10 * time.Millisecond)
+	serials, err := rotated.Rotate(ctx)
+	if err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	if serials != 4 {
+		t.Errorf("expected 4 re-encrypted serials, got %d", serials)
+	}
+
+	trash, err := inner.ListTrash(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list trash: %v", err)
+	}
+	if len(trash.Data) != 1 || trash.Data[0].Name != "trashed" {
+		t.Fatalf("expected the trashed state to stay in the trash, got %+v", trash.Data)
+	}
+	if !trash.Data[0].DeletedAt.Equal(before.Data[0].DeletedAt) {
+		t.Errorf("expected the deletion date to be kept, got %v instead of %v", trash.Data[0].DeletedAt, before.Data[0].DeletedAt)
+	}
+
+	// The former key can be retired, including for the trashed states
+	retired := storage.NewEncrypted(inner, newKeyring(t, newKey))
+	if err = retired.RestoreState(ctx, "trashed"); err != nil {
+		t.Fatalf("failed to restore state: %v", err)
+	}
+	for _, name := range []string{"live", "trashed"} {
+		for serial := 1; serial <= 2; serial++ {
+			if _, err = retired.GetState(ctx, name, serial); err != nil {
+				t.Errorf("failed to read %s serial %d with the new key only: %v", name, serial, err)
+			}
+		}
+	}
+}
+
+func TestEncryptedRotateGit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terradb-git")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	git, err := storage.NewGit(&storage.GitConfig{Path: dir})
+	if err != nil {
+		t.Fatalf("failed to open Git storage: %v", err)
+	}
+	st := storage.NewEncrypted(git, newKeyring(t, bytes.Repeat([]byte{1}, 32)))
+	if _, err = st.Rotate(context.Background()); err == nil {
+		t.Errorf("expected rotation to be refused on a Git storage")
+	}
+}
+
+// deltaMemory is a memory storage pretending to store deltas
+type deltaMemory struct {
+	storage.Storage
+}
+
+func (deltaMemory) Compact(ctx context.Context) error { return nil }
+
+func (deltaMemory) DeltaStats(ctx context.Context) (storage.DeltaStats, error) {
+	return storage.DeltaStats{}, nil
+}
+
+func TestEncryptedDeltas(t *testing.T) {
+	key := newKeyring(t, bytes.Repeat([]byte{1}, 32))
+	if _, ok := storage.Deltas(storage.NewEncrypted(storage.NewMemory(), key)); ok {
+		t.Errorf("expected an encrypted memory storage not to support deltas")
+	}
+	if _, ok := storage.Deltas(storage.NewEncrypted(deltaMemory{storage.NewMemory()}, key)); !ok {
+		t.Errorf("expected an encrypted storage to forward the deltas of the storage it wraps")
+	}
+}
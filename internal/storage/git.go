@@ -0,0 +1,1110 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GitConfig stores the informations required to use a Git repository.
+type GitConfig struct {
+	Path string
+}
+
+// GitStorage stores Terraform states in a local Git repository,
+// with one commit per serial.
+//
+// Each state is written to <name>/terraform.tfstate, as pushed by Terraform,
+// and the commit message carries the state metadata (serial, lineage, source,
+// timestamp and checksum) as trailers, which are used to answer history requests.
+// Locks are kept out of the history, in .git/terradb/locks.
+//
+// Removing, restoring and purging a state are recorded as commits as well.
+// Since the history is meant to be kept, purged states are no longer served
+// but remain in the repository objects until the history is rewritten.
+type GitStorage struct {
+	path  string
+	mutex sync.RWMutex
+
+	// lockMutex serializes lock removals, so that the lock checked
+	// by UnlockState is the one which is removed
+	lockMutex sync.Mutex
+}
+
+// gitCommit is a commit of a state file, as read from the Git history
+type gitCommit struct {
+	Hash      string
+	Name      string
+	Serial    int64
+	Lineage   string
+	Source    string
+	Timestamp string
+	MD5       string
+	Removed   bool
+	Restored  bool
+	Purged    bool
+
+	// Time is the commit date
+	Time time.Time
+}
+
+// gitTrashEntry is a state in the trash, as read from the Git history
+type gitTrashEntry struct {
+	Removal *gitCommit
+
+	// Serials are the commits hidden by the removal, newest first
+	Serials []*gitCommit
+}
+
+const gitStateFile = "terraform.tfstate"
+
+// NewGit initializes the Git repository if required.
+func NewGit(config *GitConfig) (st *GitStorage, err error) {
+	st = &GitStorage{
+		path: config.Path,
+	}
+
+	for _, dir := range []string{st.locksDir(), st.tokensDir(), st.aclsDir(), st.auditDir(), st.webhooksDir(), st.deliveriesDir()} {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return st, fmt.Errorf("failed to create %s: %v", dir, err)
+		}
+	}
+
+	if _, err = os.Stat(filepath.Join(st.path, ".git", "HEAD")); os.IsNotExist(err) {
+		_, err = st.git(context.Background(), "init")
+		if err != nil {
+			return st, fmt.Errorf("failed to initialize repository: %v", err)
+		}
+	}
+	return
+}
+
+// GetName returns the storage's name.
+func (*GitStorage) GetName() string {
+	return "git"
+}
+
+// GetLockStatus returns a Terraform lock.
+func (st *GitStorage) GetLockStatus(ctx context.Context, name string) (lockStatus LockInfo, err error) {
+	data, err := ioutil.ReadFile(st.lockFile(name))
+	if os.IsNotExist(err) {
+		return lockStatus, ErrNoDocuments
+	} else if err != nil {
+		return lockStatus, fmt.Errorf("failed to read lock: %v", err)
+	}
+
+	err = json.Unmarshal(data, &lockStatus)
+	return
+}
+
+// LockState locks a Terraform state.
+// The lock file is created exclusively, so that only one lock can be taken.
+// If the state is already locked, it returns ErrLocked
+// along with the current lock.
+func (st *GitStorage) LockState(ctx context.Context, name string, lockData LockInfo) (lockStatus LockInfo, err error) {
+	// State file uses the same key as lock
+	lockData.Path = name
+
+	data, err := json.Marshal(lockData)
+	if err != nil {
+		return lockStatus, fmt.Errorf("failed to marshal lock: %v", err)
+	}
+
+	// Write the lock to a temporary file, then link it in place:
+	// the link fails if the lock exists, and readers never see a partial file.
+	tmp, err := ioutil.TempFile(st.locksDir(), ".lock-")
+	if err != nil {
+		return lockStatus, fmt.Errorf("failed to create lock: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		return lockStatus, fmt.Errorf("failed to write lock: %v", err)
+	}
+
+	err = os.Link(tmp.Name(), st.lockFile(name))
+	if os.IsExist(err) {
+		lockStatus, err = st.GetLockStatus(ctx, name)
+		if err == ErrNoDocuments {
+			// The lock was released in the meantime
+			return st.LockState(ctx, name, lockData)
+		} else if err != nil {
+			return lockStatus, fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+		}
+		return lockStatus, ErrLocked
+	} else if err != nil {
+		return lockStatus, fmt.Errorf("failed to create lock: %v", err)
+	}
+
+	return lockData, nil
+}
+
+// UnlockState unlocks a Terraform state.
+// If the state is locked with another lock ID, it returns ErrLockIDMismatch
+// along with the current lock.
+func (st *GitStorage) UnlockState(ctx context.Context, name string, lockData LockInfo) (lockStatus LockInfo, err error) {
+	st.lockMutex.Lock()
+	defer st.lockMutex.Unlock()
+
+	lockStatus, err = st.GetLockStatus(ctx, name)
+	if err == ErrNoDocuments {
+		// Not locked
+		return lockStatus, nil
+	} else if err != nil {
+		return lockStatus, fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+	}
+	if lockStatus.ID != lockData.ID {
+		return lockStatus, ErrLockIDMismatch
+	}
+
+	err = os.Remove(st.lockFile(name))
+	return
+}
+
+// ForceUnlockState unlocks a Terraform state, whatever its lock ID,
+// and returns the removed lock.
+func (st *GitStorage) ForceUnlockState(ctx context.Context, name string) (lockStatus LockInfo, err error) {
+	st.lockMutex.Lock()
+	defer st.lockMutex.Unlock()
+
+	lockStatus, err = st.GetLockStatus(ctx, name)
+	if err != nil {
+		return
+	}
+
+	err = os.Remove(st.lockFile(name))
+	return
+}
+
+// RemoveState moves the Terraform states to the trash.
+// The state file is removed, and its history is no longer served.
+func (st *GitStorage) RemoveState(ctx context.Context, name string) (err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	serials, err := st.serials(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve history: %v", err)
+	}
+	if len(serials) == 0 {
+		return ErrNoDocuments
+	}
+
+	msg, err := gitMessage("Remove state "+name, gitTrailer{"Name", name}, gitTrailer{"Removed", "true"})
+	if err != nil {
+		return
+	}
+
+	_, err = st.git(ctx, "rm", "-q", "--ignore-unmatch", "--", filepath.Join(name, gitStateFile))
+	if err != nil {
+		return fmt.Errorf("failed to remove state: %v", err)
+	}
+
+	return st.commit(ctx, msg)
+}
+
+// ListTrash returns the states in the trash
+func (st *GitStorage) ListTrash(ctx context.Context, pageNum, pageSize int) (coll DeletedStateCollection, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	commits, err := st.history(ctx, "")
+	if err != nil {
+		return coll, fmt.Errorf("failed to list deleted states: %v", err)
+	}
+	_, trash := gitScan(commits)
+
+	var names []string
+	for name := range trash {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	coll.Metadata = paginationMetadata(len(names), pageNum)
+	start, end := paginationBounds(len(names), pageNum, pageSize)
+	for _, name := range names[start:end] {
+		entry := trash[name]
+		deleted := &DeletedState{
+			Name:      name,
+			DeletedAt: entry.Removal.Time,
+		}
+		if latest := entry.latest(); latest != nil {
+			deleted.Serial = latest.Serial
+		}
+		coll.Data = append(coll.Data, deleted)
+	}
+	return
+}
+
+// RestoreState moves Terraform states back from the trash,
+// by checking out the latest serial again.
+func (st *GitStorage) RestoreState(ctx context.Context, name string) (err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	entry, err := st.trashEntry(ctx, name)
+	if err != nil {
+		return
+	}
+
+	msg, err := gitMessage("Restore state "+name, gitTrailer{"Name", name}, gitTrailer{"Restored", "true"})
+	if err != nil {
+		return
+	}
+
+	if latest := entry.latest(); latest != nil {
+		_, err = st.git(ctx, "checkout", latest.Hash, "--", filepath.Join(name, gitStateFile))
+		if err != nil {
+			return fmt.Errorf("failed to restore state: %v", err)
+		}
+	}
+
+	return st.commit(ctx, msg)
+}
+
+// PurgeState permanently removes the Terraform states from the trash,
+// along with their lock.
+func (st *GitStorage) PurgeState(ctx context.Context, name string) (err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	_, err = st.trashEntry(ctx, name)
+	if err != nil {
+		return
+	}
+
+	msg, err := gitMessage("Purge state "+name, gitTrailer{"Name", name}, gitTrailer{"Purged", "true"})
+	if err != nil {
+		return
+	}
+
+	st.lockMutex.Lock()
+	err = os.Remove(st.lockFile(name))
+	st.lockMutex.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove lock: %v", err)
+	}
+
+	return st.commit(ctx, msg)
+}
+
+// ListStates returns all state names from TerraDB
+func (st *GitStorage) ListStates(ctx context.Context, prefix string, pageNum, pageSize int) (coll StateCollection, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	commits, err := st.history(ctx, "")
+	if err != nil {
+		return coll, fmt.Errorf("failed to list states: %v", err)
+	}
+
+	latest := make(map[string]*gitCommit)
+	live, _ := gitScan(commits)
+	for _, c := range live {
+		if !strings.HasPrefix(c.Name, prefix) {
+			continue
+		}
+		if l, ok := latest[c.Name]; !ok || c.Serial > l.Serial {
+			latest[c.Name] = c
+		}
+	}
+
+	var names []string
+	for name := range latest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	coll.Metadata = paginationMetadata(len(names), pageNum)
+	start, end := paginationBounds(len(names), pageNum, pageSize)
+	for _, name := range names[start:end] {
+		state, err := st.readState(ctx, latest[name])
+		if err != nil {
+			return coll, fmt.Errorf("failed to get state: %v", err)
+		}
+
+		// Init value required because of omitempty
+		state.Locked = false
+		state.LockInfo, err = st.GetLockStatus(ctx, name)
+		if err == nil {
+			state.Locked = true
+		} else if err != ErrNoDocuments {
+			return coll, fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+		}
+		coll.Data = append(coll.Data, state)
+	}
+
+	return coll, nil
+}
+
+// GetState retrieves a Terraform state, at a given serial.
+// If serial is 0, it gets the latest serial
+func (st *GitStorage) GetState(ctx context.Context, name string, serial int) (state State, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	serials, err := st.serials(ctx, name)
+	if err != nil {
+		return state, fmt.Errorf("failed to retrieve history: %v", err)
+	}
+	if len(serials) == 0 {
+		return state, ErrNoDocuments
+	}
+
+	c := serials[len(serials)-1]
+	if serial != 0 {
+		c = nil
+		for _, s := range serials {
+			if s.Serial == int64(serial) {
+				c = s
+			}
+		}
+		if c == nil {
+			return state, ErrNoDocuments
+		}
+	}
+
+	s, err := st.readState(ctx, c)
+	if err != nil {
+		return state, fmt.Errorf("failed to get state: %v", err)
+	}
+	state = *s
+
+	// Init value required because of omitempty
+	state.Locked = false
+	state.LockInfo, err = st.GetLockStatus(ctx, name)
+	if err == nil {
+		state.Locked = true
+	} else if err == ErrNoDocuments {
+		// Reset err
+		err = nil
+	} else {
+		return state, fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+	}
+	return
+}
+
+// InsertState adds a Terraform state to the database,
+// if the conditions hold. They are checked under the write mutex.
+func (st *GitStorage) InsertState(ctx context.Context, doc State, timestamp, source, name string, cond InsertConditions) (err error) {
+	// Hierarchical names are nested directories, next to the state files
+	err = CheckName(name)
+	if err != nil {
+		return
+	}
+	for _, e := range strings.Split(name, "/") {
+		if e == gitStateFile {
+			return fmt.Errorf("state name %s conflicts with the state files", name)
+		}
+	}
+
+	// The pushed document is written as is when it was kept
+	data, err := doc.Document()
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+
+	trailers := []gitTrailer{
+		{"Name", name},
+		{"Serial", strconv.FormatInt(doc.Serial, 10)},
+		{"Lineage", doc.Lineage},
+		{"Source", source},
+		{"Timestamp", timestamp},
+	}
+	if doc.MD5 != "" {
+		trailers = append(trailers, gitTrailer{"MD5", doc.MD5})
+	}
+	msg, err := gitMessage(fmt.Sprintf("Push state %s serial %d", name, doc.Serial), trailers...)
+	if err != nil {
+		return
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	_, err = st.trashEntry(ctx, name)
+	if err == nil {
+		return ErrStateDeleted
+	} else if err != ErrNoDocuments {
+		return
+	}
+
+	var lock *LockInfo
+	l, err := st.GetLockStatus(ctx, name)
+	if err == nil {
+		lock = &l
+	} else if err != ErrNoDocuments {
+		return fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+	}
+	serials, err := st.serials(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve history: %v", err)
+	}
+	var latest *State
+	if len(serials) > 0 {
+		latest, err = st.readState(ctx, serials[len(serials)-1])
+		if err != nil {
+			return fmt.Errorf("failed to get latest state: %v", err)
+		}
+	}
+	err = cond.check(lock, latest, doc)
+	if err != nil {
+		return
+	}
+
+	path := filepath.Join(st.path, name, gitStateFile)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+
+	_, err = st.git(ctx, "add", "--", filepath.Join(name, gitStateFile))
+	if err != nil {
+		return fmt.Errorf("failed to add state: %v", err)
+	}
+
+	return st.commit(ctx, msg)
+}
+
+// ListStateSerials returns all state serials with a given name.
+func (st *GitStorage) ListStateSerials(ctx context.Context, name string, pageNum, pageSize int) (coll StateCollection, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	serials, err := st.serials(ctx, name)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list states: %v", err)
+	}
+
+	coll.Metadata = paginationMetadata(len(serials), pageNum)
+	start, end := paginationBounds(len(serials), pageNum, pageSize)
+	for _, c := range serials[start:end] {
+		state, err := st.readState(ctx, c)
+		if err != nil {
+			return coll, fmt.Errorf("failed to get state: %v", err)
+		}
+		coll.Data = append(coll.Data, state)
+	}
+
+	return
+}
+
+// GetResource retrieves a Terraform resource given a state, module and name
+func (st *GitStorage) GetResource(ctx context.Context, state, module, name string) (res Resource, err error) {
+	s, err := st.GetState(ctx, state, 0)
+	if err == ErrNoDocuments {
+		return
+	} else if err != nil {
+		return res, fmt.Errorf("failed to get resource: %v", err)
+	}
+
+	res, err = getResource(s, module, name)
+	return
+}
+
+func (st *GitStorage) locksDir() string {
+	return filepath.Join(st.path, ".git", "terradb", "locks")
+}
+
+func (st *GitStorage) lockFile(name string) string {
+	return filepath.Join(st.locksDir(), url.PathEscape(name)+".json")
+}
+
+// tokensDir holds the API tokens, out of the repository history
+func (st *GitStorage) tokensDir() string {
+	return filepath.Join(st.path, ".git", "terradb", "tokens")
+}
+
+func (st *GitStorage) tokenFile(id string) string {
+	return filepath.Join(st.tokensDir(), url.PathEscape(id)+".json")
+}
+
+// InsertToken adds an API token, or replaces the token with the same ID.
+func (st *GitStorage) InsertToken(ctx context.Context, token Token) (err error) {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token: %v", err)
+	}
+
+	err = ioutil.WriteFile(st.tokenFile(token.ID), data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write token: %v", err)
+	}
+	return
+}
+
+// GetToken returns an API token by ID
+func (st *GitStorage) GetToken(ctx context.Context, id string) (token Token, err error) {
+	data, err := ioutil.ReadFile(st.tokenFile(id))
+	if os.IsNotExist(err) {
+		return token, ErrNoDocuments
+	} else if err != nil {
+		return token, fmt.Errorf("failed to read token: %v", err)
+	}
+
+	err = json.Unmarshal(data, &token)
+	return
+}
+
+// ListTokens returns the API tokens
+func (st *GitStorage) ListTokens(ctx context.Context, pageNum, pageSize int) (coll TokenCollection, err error) {
+	ids, err := gitListIDs(st.tokensDir())
+	if err != nil {
+		return coll, fmt.Errorf("failed to list tokens: %v", err)
+	}
+
+	coll.Metadata = paginationMetadata(len(ids), pageNum)
+	start, end := paginationBounds(len(ids), pageNum, pageSize)
+	for _, id := range ids[start:end] {
+		token, err := st.GetToken(ctx, id)
+		if err == ErrNoDocuments {
+			// Revoked in the meantime
+			continue
+		} else if err != nil {
+			return coll, err
+		}
+		coll.Data = append(coll.Data, &token)
+	}
+	return
+}
+
+// RemoveToken revokes an API token
+func (st *GitStorage) RemoveToken(ctx context.Context, id string) (err error) {
+	err = os.Remove(st.tokenFile(id))
+	if os.IsNotExist(err) {
+		return ErrNoDocuments
+	} else if err != nil {
+		return fmt.Errorf("failed to remove token: %v", err)
+	}
+	return
+}
+
+// aclsDir holds the ACLs, out of the repository history
+func (st *GitStorage) aclsDir() string {
+	return filepath.Join(st.path, ".git", "terradb", "acls")
+}
+
+func (st *GitStorage) aclFile(id string) string {
+	return filepath.Join(st.aclsDir(), url.PathEscape(id)+".json")
+}
+
+// InsertACL adds an ACL, or replaces the ACL with the same ID.
+func (st *GitStorage) InsertACL(ctx context.Context, acl ACL) (err error) {
+	data, err := json.Marshal(acl)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ACL: %v", err)
+	}
+
+	err = ioutil.WriteFile(st.aclFile(acl.ID), data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write ACL: %v", err)
+	}
+	return
+}
+
+// ListACLs returns the ACLs
+func (st *GitStorage) ListACLs(ctx context.Context, pageNum, pageSize int) (coll ACLCollection, err error) {
+	ids, err := gitListIDs(st.aclsDir())
+	if err != nil {
+		return coll, fmt.Errorf("failed to list ACLs: %v", err)
+	}
+
+	coll.Metadata = paginationMetadata(len(ids), pageNum)
+	start, end := paginationBounds(len(ids), pageNum, pageSize)
+	for _, id := range ids[start:end] {
+		data, err := ioutil.ReadFile(st.aclFile(id))
+		if os.IsNotExist(err) {
+			// Removed in the meantime
+			continue
+		} else if err != nil {
+			return coll, fmt.Errorf("failed to read ACL: %v", err)
+		}
+
+		var acl ACL
+		err = json.Unmarshal(data, &acl)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal ACL: %v", err)
+		}
+		coll.Data = append(coll.Data, &acl)
+	}
+	return
+}
+
+// RemoveACL removes an ACL
+func (st *GitStorage) RemoveACL(ctx context.Context, id string) (err error) {
+	err = os.Remove(st.aclFile(id))
+	if os.IsNotExist(err) {
+		return ErrNoDocuments
+	} else if err != nil {
+		return fmt.Errorf("failed to remove ACL: %v", err)
+	}
+	return
+}
+
+// auditDir holds the audit records, out of the repository history
+func (st *GitStorage) auditDir() string {
+	return filepath.Join(st.path, ".git", "terradb", "audit")
+}
+
+func (st *GitStorage) auditFile(id string) string {
+	return filepath.Join(st.auditDir(), url.PathEscape(id)+".json")
+}
+
+// InsertAuditRecord adds an audit record
+func (st *GitStorage) InsertAuditRecord(ctx context.Context, record AuditRecord) (err error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %v", err)
+	}
+
+	err = ioutil.WriteFile(st.auditFile(record.ID), data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write audit record: %v", err)
+	}
+	return
+}
+
+// ListAuditRecords returns the audit records selected by filter
+func (st *GitStorage) ListAuditRecords(ctx context.Context, filter AuditFilter, pageNum, pageSize int) (coll AuditCollection, err error) {
+	ids, err := gitListIDs(st.auditDir())
+	if err != nil {
+		return coll, fmt.Errorf("failed to list audit records: %v", err)
+	}
+
+	var records []*AuditRecord
+	for i := len(ids) - 1; i >= 0; i-- {
+		data, err := ioutil.ReadFile(st.auditFile(ids[i]))
+		if err != nil {
+			return coll, fmt.Errorf("failed to read audit record: %v", err)
+		}
+
+		var record AuditRecord
+		err = json.Unmarshal(data, &record)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal audit record: %v", err)
+		}
+		if filter.Match(&record) {
+			records = append(records, &record)
+		}
+	}
+
+	coll.Metadata = paginationMetadata(len(records), pageNum)
+	start, end := paginationBounds(len(records), pageNum, pageSize)
+	coll.Data = records[start:end]
+	return
+}
+
+// webhooksDir holds the webhooks, out of the repository history
+func (st *GitStorage) webhooksDir() string {
+	return filepath.Join(st.path, ".git", "terradb", "webhooks")
+}
+
+func (st *GitStorage) webhookFile(id string) string {
+	return filepath.Join(st.webhooksDir(), url.PathEscape(id)+".json")
+}
+
+// InsertWebhook adds a webhook, or replaces the webhook with the same ID.
+func (st *GitStorage) InsertWebhook(ctx context.Context, webhook Webhook) (err error) {
+	data, err := json.Marshal(webhook)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook: %v", err)
+	}
+
+	err = ioutil.WriteFile(st.webhookFile(webhook.ID), data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write webhook: %v", err)
+	}
+	return
+}
+
+// ListWebhooks returns the webhooks
+func (st *GitStorage) ListWebhooks(ctx context.Context, pageNum, pageSize int) (coll WebhookCollection, err error) {
+	ids, err := gitListIDs(st.webhooksDir())
+	if err != nil {
+		return coll, fmt.Errorf("failed to list webhooks: %v", err)
+	}
+
+	coll.Metadata = paginationMetadata(len(ids), pageNum)
+	start, end := paginationBounds(len(ids), pageNum, pageSize)
+	for _, id := range ids[start:end] {
+		data, err := ioutil.ReadFile(st.webhookFile(id))
+		if os.IsNotExist(err) {
+			// Removed in the meantime
+			continue
+		} else if err != nil {
+			return coll, fmt.Errorf("failed to read webhook: %v", err)
+		}
+
+		var webhook Webhook
+		err = json.Unmarshal(data, &webhook)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal webhook: %v", err)
+		}
+		coll.Data = append(coll.Data, &webhook)
+	}
+	return
+}
+
+// RemoveWebhook removes a webhook
+func (st *GitStorage) RemoveWebhook(ctx context.Context, id string) (err error) {
+	err = os.Remove(st.webhookFile(id))
+	if os.IsNotExist(err) {
+		return ErrNoDocuments
+	} else if err != nil {
+		return fmt.Errorf("failed to remove webhook: %v", err)
+	}
+	return
+}
+
+// deliveriesDir holds the webhook deliveries, out of the repository history
+func (st *GitStorage) deliveriesDir() string {
+	return filepath.Join(st.path, ".git", "terradb", "deliveries")
+}
+
+func (st *GitStorage) deliveryFile(id string) string {
+	return filepath.Join(st.deliveriesDir(), url.PathEscape(id)+".json")
+}
+
+// InsertDelivery adds a webhook delivery, or replaces the delivery with the same ID.
+func (st *GitStorage) InsertDelivery(ctx context.Context, delivery Delivery) (err error) {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %v", err)
+	}
+
+	err = ioutil.WriteFile(st.deliveryFile(delivery.ID), data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write delivery: %v", err)
+	}
+	return
+}
+
+// ListDeliveries returns the webhook deliveries selected by filter
+func (st *GitStorage) ListDeliveries(ctx context.Context, filter DeliveryFilter, pageNum, pageSize int) (coll DeliveryCollection, err error) {
+	ids, err := gitListIDs(st.deliveriesDir())
+	if err != nil {
+		return coll, fmt.Errorf("failed to list deliveries: %v", err)
+	}
+
+	var deliveries []*Delivery
+	for i := len(ids) - 1; i >= 0; i-- {
+		data, err := ioutil.ReadFile(st.deliveryFile(ids[i]))
+		if err != nil {
+			return coll, fmt.Errorf("failed to read delivery: %v", err)
+		}
+
+		var delivery Delivery
+		err = json.Unmarshal(data, &delivery)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal delivery: %v", err)
+		}
+		if filter.Match(&delivery) {
+			deliveries = append(deliveries, &delivery)
+		}
+	}
+
+	coll.Metadata = paginationMetadata(len(deliveries), pageNum)
+	start, end := paginationBounds(len(deliveries), pageNum, pageSize)
+	coll.Data = deliveries[start:end]
+	return
+}
+
+// gitListIDs returns the sorted IDs of the JSON files of a directory
+func gitListIDs(dir string) (ids []string, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		if id, err := url.PathUnescape(strings.TrimSuffix(f.Name(), ".json")); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return
+}
+
+// git runs a git command in the repository
+func (st *GitStorage) git(ctx context.Context, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", st.path}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=TerraDB",
+		"GIT_AUTHOR_EMAIL=terradb@localhost",
+		"GIT_COMMITTER_NAME=TerraDB",
+		"GIT_COMMITTER_EMAIL=terradb@localhost",
+	)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// gitTrailer is a metadata line of a commit message
+type gitTrailer struct {
+	Key   string
+	Value string
+}
+
+// gitMessage formats a commit message with its trailers.
+// Values holding line breaks or other control characters are refused,
+// since they could add trailers.
+func gitMessage(subject string, trailers ...gitTrailer) (msg string, err error) {
+	if strings.IndexFunc(subject, isControl) != -1 {
+		return "", fmt.Errorf("invalid commit subject %q: control characters are not allowed", subject)
+	}
+	msg = subject + "\n\n"
+	for _, t := range trailers {
+		if strings.IndexFunc(t.Value, isControl) != -1 {
+			return "", fmt.Errorf("invalid %s %q: control characters are not allowed", strings.ToLower(t.Key), t.Value)
+		}
+		msg += t.Key + ": " + t.Value + "\n"
+	}
+	return
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+func (st *GitStorage) commit(ctx context.Context, msg string) error {
+	_, err := st.git(ctx, "-c", "commit.gpgsign=false", "commit", "-q", "--allow-empty", "-m", msg)
+	if err != nil {
+		return fmt.Errorf("failed to commit: %v", err)
+	}
+	return nil
+}
+
+// history returns the commits of a state, newest first.
+// If name is empty, the commits of all states are returned.
+// Commits are selected by their Name trailer rather than by path,
+// since purges do not touch the state file.
+func (st *GitStorage) history(ctx context.Context, name string) (commits []*gitCommit, err error) {
+	if _, err = st.git(ctx, "rev-parse", "-q", "--verify", "HEAD"); err != nil {
+		// Empty repository
+		return nil, nil
+	}
+
+	out, err := st.git(ctx, "log", "--format=%H%x1f%ct%x1f%B%x1e")
+	if err != nil {
+		return
+	}
+
+	for _, entry := range strings.Split(string(out), "\x1e") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "\x1f", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		c, err := parseGitCommit(parts[0], parts[2])
+		if err != nil {
+			return commits, fmt.Errorf("failed to parse commit %s: %v", parts[0], err)
+		}
+		ts, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return commits, fmt.Errorf("failed to parse commit %s date: %v", parts[0], err)
+		}
+		c.Time = time.Unix(ts, 0).UTC()
+		if c.Name != "" && (name == "" || c.Name == name) {
+			commits = append(commits, c)
+		}
+	}
+	return
+}
+
+// serials returns the live serials of a state, sorted by serial.
+// When a serial was pushed several times, the newest commit wins.
+func (st *GitStorage) serials(ctx context.Context, name string) (serials []*gitCommit, err error) {
+	commits, err := st.history(ctx, name)
+	if err != nil {
+		return
+	}
+
+	seen := make(map[int64]bool)
+	live, _ := gitScan(commits)
+	for _, c := range live {
+		if !seen[c.Serial] {
+			seen[c.Serial] = true
+			serials = append(serials, c)
+		}
+	}
+
+	sort.Slice(serials, func(i, j int) bool { return serials[i].Serial < serials[j].Serial })
+	return
+}
+
+func (st *GitStorage) readState(ctx context.Context, c *gitCommit) (state *State, err error) {
+	data, err := st.git(ctx, "show", c.Hash+":"+filepath.ToSlash(filepath.Join(c.Name, gitStateFile)))
+	if err != nil {
+		return
+	}
+
+	state = &State{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return state, fmt.Errorf("failed to unmarshal state: %v", err)
+	}
+	if c.MD5 != "" {
+		state.MD5 = c.MD5
+		// The file is the pushed document, unless it is encrypted
+		if state.Encryption == nil {
+			state.Raw = data
+		}
+	}
+	state.Name = c.Name
+	state.LastModified, err = time.Parse("20060102150405", c.Timestamp)
+	if err != nil {
+		return state, fmt.Errorf("failed to convert timestamp: %v", err)
+	}
+	return
+}
+
+// trashEntry returns the trash entry of a state,
+// or ErrNoDocuments if it is not in the trash.
+func (st *GitStorage) trashEntry(ctx context.Context, name string) (entry *gitTrashEntry, err error) {
+	commits, err := st.history(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve history: %v", err)
+	}
+
+	_, trash := gitScan(commits)
+	entry, ok := trash[name]
+	if !ok {
+		return nil, ErrNoDocuments
+	}
+	return
+}
+
+// gitScan walks the commits (newest first) and splits the commits
+// of each state between the live ones and the ones in the trash.
+// A removal hides the commits which precede it, unless it was undone
+// by a restore. The commits which precede a purge, or an older removal,
+// belong to a previous incarnation of the state and are dropped.
+func gitScan(commits []*gitCommit) (live []*gitCommit, trash map[string]*gitTrashEntry) {
+	type scan struct {
+		seen     bool
+		restored bool
+		dead     bool
+		trash    *gitTrashEntry
+	}
+
+	states := make(map[string]*scan)
+	trash = make(map[string]*gitTrashEntry)
+	for _, c := range commits {
+		s, ok := states[c.Name]
+		if !ok {
+			s = &scan{}
+			states[c.Name] = s
+		}
+
+		switch {
+		case s.dead:
+		case c.Purged:
+			s.dead = true
+		case c.Restored:
+			s.restored = true
+		case c.Removed && s.restored:
+			// This removal was undone
+			s.restored = false
+		case c.Removed && !s.seen:
+			// The most recent event is a removal
+			s.trash = &gitTrashEntry{Removal: c}
+			trash[c.Name] = s.trash
+		case c.Removed:
+			s.dead = true
+		case s.trash != nil:
+			s.trash.Serials = append(s.trash.Serials, c)
+		default:
+			live = append(live, c)
+		}
+		s.seen = true
+	}
+	return
+}
+
+// latest returns the commit of the latest serial hidden by the removal
+func (e *gitTrashEntry) latest() (latest *gitCommit) {
+	for _, c := range e.Serials {
+		if latest == nil || c.Serial > latest.Serial {
+			latest = c
+		}
+	}
+	return
+}
+
+func parseGitCommit(hash, msg string) (c *gitCommit, err error) {
+	c = &gitCommit{
+		Hash: hash,
+	}
+
+	// Only the last paragraph holds the trailers, never the subject
+	paragraphs := strings.Split(strings.TrimSpace(msg), "\n\n")
+	if len(paragraphs) < 2 {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(paragraphs[len(paragraphs)-1], "\n") {
+		kv := strings.SplitN(line, ": ", 2)
+		if len(kv) != 2 {
+			// Not a trailer block
+			return &gitCommit{Hash: hash}, nil
+		}
+		if seen[kv[0]] {
+			return nil, fmt.Errorf("duplicate %s trailer", kv[0])
+		}
+		seen[kv[0]] = true
+
+		switch kv[0] {
+		case "Name":
+			c.Name = kv[1]
+		case "Serial":
+			c.Serial, err = strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return
+			}
+		case "Lineage":
+			c.Lineage = kv[1]
+		case "Source":
+			c.Source = kv[1]
+		case "Timestamp":
+			c.Timestamp = kv[1]
+		case "MD5":
+			c.MD5 = kv[1]
+		case "Removed":
+			c.Removed = kv[1] == "true"
+		case "Restored":
+			c.Restored = kv[1] == "true"
+		case "Purged":
+			c.Purged = kv[1] == "true"
+		}
+	}
+	return
+}
@@ -0,0 +1,89 @@
+package storage_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/camptocamp/terradb/internal/storage"
+	"github.com/camptocamp/terradb/internal/storage/storagetest"
+)
+
+func TestGitStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terradb-git")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		path, err := ioutil.TempDir(dir, "repository")
+		if err != nil {
+			t.Fatalf("failed to create repository directory: %v", err)
+		}
+
+		st, err := storage.NewGit(&storage.GitConfig{Path: path})
+		if err != nil {
+			t.Fatalf("failed to open Git storage: %v", err)
+		}
+		return st
+	})
+}
+
+func TestGitTrailerInjection(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "terradb-git")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := storage.NewGit(&storage.GitConfig{Path: dir})
+	if err != nil {
+		t.Fatalf("failed to open Git storage: %v", err)
+	}
+	err = st.InsertState(ctx, storagetest.NewState(1, "lineage"), storagetest.Timestamp, "direct", "prod", storage.InsertConditions{})
+	if err != nil {
+		t.Fatalf("failed to insert state: %v", err)
+	}
+
+	evil := storagetest.NewState(1, "x\nName: prod\nRemoved: true")
+	err = st.InsertState(ctx, evil, storagetest.Timestamp, "direct", "team/evil", storage.InsertConditions{})
+	if err == nil {
+		t.Errorf("expected a lineage with line breaks to be refused")
+	}
+	err = st.InsertState(ctx, storagetest.NewState(1, "lineage"), storagetest.Timestamp, "direct\nRemoved: true", "team/evil", storage.InsertConditions{})
+	if err == nil {
+		t.Errorf("expected a source with line breaks to be refused")
+	}
+
+	if _, err = st.GetState(ctx, "prod", 0); err != nil {
+		t.Errorf("expected prod to stay live, got %v", err)
+	}
+	trash, err := st.ListTrash(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list trash: %v", err)
+	}
+	if len(trash.Data) != 0 {
+		t.Errorf("expected an empty trash, got %+v", trash.Data)
+	}
+
+	// Only the final trailer block counts, and keys may not repeat
+	commit := func(msg string) {
+		out, err := exec.Command("git", "-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com",
+			"-c", "commit.gpgsign=false", "commit", "-q", "--allow-empty", "-m", msg).CombinedOutput()
+		if err != nil {
+			t.Fatalf("failed to commit: %v: %s", err, out)
+		}
+	}
+	commit("Name: prod\nRemoved: true\n\nNote: not a state commit\n")
+	if _, err = st.GetState(ctx, "prod", 0); err != nil {
+		t.Errorf("expected trailers outside the final block to be ignored, got %v", err)
+	}
+	commit("Push state prod serial 2\n\nName: prod\nSerial: 2\nName: other\n")
+	if _, err = st.ListStates(ctx, "", 1, 10); err == nil {
+		t.Errorf("expected duplicate trailers to be refused")
+	}
+}
@@ -0,0 +1,683 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage stores Terraform states in memory.
+// It is meant for development and tests, as nothing is persisted.
+type MemoryStorage struct {
+	mutex sync.RWMutex
+
+	// states maps state names to their serials
+	states map[string]map[int64]*memoryDoc
+	locks  map[string]LockInfo
+
+	// trash holds the deleted states, whose serials are kept in states
+	trash map[string]*DeletedState
+
+	// tokens holds the marshaled API tokens
+	tokens map[string][]byte
+
+	// acls holds the marshaled ACLs
+	acls map[string][]byte
+
+	// audit holds the marshaled audit records
+	audit map[string][]byte
+
+	// webhooks and deliveries hold the marshaled webhooks and their deliveries
+	webhooks   map[string][]byte
+	deliveries map[string][]byte
+}
+
+// memoryDoc is a single serial of a state.
+// The state is kept marshaled so that callers can never
+// modify the stored data through pointers.
+type memoryDoc struct {
+	Timestamp string
+	Source    string
+	State     []byte
+	Raw       []byte
+}
+
+// NewMemory returns an empty in-memory storage.
+func NewMemory() *MemoryStorage {
+	return &MemoryStorage{
+		states: make(map[string]map[int64]*memoryDoc),
+		locks:  make(map[string]LockInfo),
+		trash:  make(map[string]*DeletedState),
+		tokens: make(map[string][]byte),
+		acls:   make(map[string][]byte),
+		audit:  make(map[string][]byte),
+
+		webhooks:   make(map[string][]byte),
+		deliveries: make(map[string][]byte),
+	}
+}
+
+// GetName returns the storage's name.
+func (*MemoryStorage) GetName() string {
+	return "memory"
+}
+
+// GetLockStatus returns a Terraform lock.
+func (st *MemoryStorage) GetLockStatus(ctx context.Context, name string) (lockStatus LockInfo, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	lockStatus, ok := st.locks[name]
+	if !ok {
+		return lockStatus, ErrNoDocuments
+	}
+	return
+}
+
+// LockState locks a Terraform state.
+// If the state is already locked, it returns ErrLocked
+// along with the current lock.
+func (st *MemoryStorage) LockState(ctx context.Context, name string, lockData LockInfo) (lockStatus LockInfo, err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if lockStatus, ok := st.locks[name]; ok {
+		return lockStatus, ErrLocked
+	}
+
+	// State file uses the same key as lock
+	lockData.Path = name
+	st.locks[name] = lockData
+	return lockData, nil
+}
+
+// UnlockState unlocks a Terraform state.
+// If the state is locked with another lock ID, it returns ErrLockIDMismatch
+// along with the current lock.
+func (st *MemoryStorage) UnlockState(ctx context.Context, name string, lockData LockInfo) (lockStatus LockInfo, err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	lockStatus, ok := st.locks[name]
+	if !ok {
+		// Not locked
+		return lockStatus, nil
+	}
+	if lockStatus.ID != lockData.ID {
+		return lockStatus, ErrLockIDMismatch
+	}
+
+	delete(st.locks, name)
+	return
+}
+
+// ForceUnlockState unlocks a Terraform state, whatever its lock ID,
+// and returns the removed lock.
+func (st *MemoryStorage) ForceUnlockState(ctx context.Context, name string) (lockStatus LockInfo, err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	lockStatus, ok := st.locks[name]
+	if !ok {
+		return lockStatus, ErrNoDocuments
+	}
+
+	delete(st.locks, name)
+	return
+}
+
+// RemoveState moves the Terraform states to the trash.
+func (st *MemoryStorage) RemoveState(ctx context.Context, name string) (err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	serials, ok := st.liveSerials(name)
+	if !ok {
+		return ErrNoDocuments
+	}
+
+	st.trash[name] = &DeletedState{
+		Name:      name,
+		Serial:    latestSerial(serials),
+		DeletedAt: time.Now().UTC(),
+	}
+	return
+}
+
+// ListTrash returns the states in the trash
+func (st *MemoryStorage) ListTrash(ctx context.Context, pageNum, pageSize int) (coll DeletedStateCollection, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	var names []string
+	for name := range st.trash {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	coll.Metadata = paginationMetadata(len(names), pageNum)
+	start, end := paginationBounds(len(names), pageNum, pageSize)
+	for _, name := range names[start:end] {
+		deleted := *st.trash[name]
+		coll.Data = append(coll.Data, &deleted)
+	}
+	return
+}
+
+// RestoreState moves Terraform states back from the trash.
+func (st *MemoryStorage) RestoreState(ctx context.Context, name string) (err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if _, ok := st.trash[name]; !ok {
+		return ErrNoDocuments
+	}
+
+	delete(st.trash, name)
+	return
+}
+
+// PurgeState permanently removes the Terraform states from the trash,
+// along with their lock.
+func (st *MemoryStorage) PurgeState(ctx context.Context, name string) (err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if _, ok := st.trash[name]; !ok {
+		return ErrNoDocuments
+	}
+
+	delete(st.states, name)
+	delete(st.locks, name)
+	delete(st.trash, name)
+	return
+}
+
+// ListStates returns all state names from TerraDB
+func (st *MemoryStorage) ListStates(ctx context.Context, prefix string, pageNum, pageSize int) (coll StateCollection, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	var names []string
+	for name := range st.states {
+		if _, ok := st.trash[name]; !ok && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	coll.Metadata = paginationMetadata(len(names), pageNum)
+	start, end := paginationBounds(len(names), pageNum, pageSize)
+	for _, name := range names[start:end] {
+		serials := st.states[name]
+		state, err := serials[latestSerial(serials)].toState(name)
+		if err != nil {
+			return coll, fmt.Errorf("failed to get state: %v", err)
+		}
+
+		// Init value required because of omitempty
+		state.Locked = false
+		if lock, ok := st.locks[name]; ok {
+			state.LockInfo = lock
+			state.Locked = true
+		}
+		coll.Data = append(coll.Data, state)
+	}
+
+	return
+}
+
+// GetState retrieves a Terraform state, at a given serial.
+// If serial is 0, it gets the latest serial
+func (st *MemoryStorage) GetState(ctx context.Context, name string, serial int) (state State, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	serials, ok := st.liveSerials(name)
+	if !ok {
+		return state, ErrNoDocuments
+	}
+
+	s := int64(serial)
+	if serial == 0 {
+		s = latestSerial(serials)
+	}
+
+	doc, ok := serials[s]
+	if !ok {
+		return state, ErrNoDocuments
+	}
+
+	ps, err := doc.toState(name)
+	if err != nil {
+		return state, fmt.Errorf("failed to get state: %v", err)
+	}
+	state = *ps
+
+	// Init value required because of omitempty
+	state.Locked = false
+	if lock, ok := st.locks[name]; ok {
+		state.LockInfo = lock
+		state.Locked = true
+	}
+	return
+}
+
+// InsertState adds a Terraform state to the database,
+// if the conditions hold.
+func (st *MemoryStorage) InsertState(ctx context.Context, doc State, timestamp, source, name string, cond InsertConditions) (err error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if _, ok := st.trash[name]; ok {
+		return ErrStateDeleted
+	}
+
+	var lock *LockInfo
+	if l, ok := st.locks[name]; ok {
+		lock = &l
+	}
+	var latest *State
+	if serials, ok := st.states[name]; ok && len(serials) > 0 {
+		latest, err = serials[latestSerial(serials)].toState(name)
+		if err != nil {
+			return fmt.Errorf("failed to get latest state: %v", err)
+		}
+	}
+	err = cond.check(lock, latest, doc)
+	if err != nil {
+		return
+	}
+
+	if _, ok := st.states[name]; !ok {
+		st.states[name] = make(map[int64]*memoryDoc)
+	}
+	st.states[name][doc.Serial] = &memoryDoc{
+		Timestamp: timestamp,
+		Source:    source,
+		State:     data,
+		Raw:       copyBytes(doc.Raw),
+	}
+	return
+}
+
+// ListStateSerials returns all state serials with a given name.
+func (st *MemoryStorage) ListStateSerials(ctx context.Context, name string, pageNum, pageSize int) (coll StateCollection, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	serials, _ := st.liveSerials(name)
+	return memorySerials(name, serials, pageNum, pageSize)
+}
+
+// listTrashedSerials returns the serials of a state in the trash.
+func (st *MemoryStorage) listTrashedSerials(ctx context.Context, name string, pageNum, pageSize int) (coll StateCollection, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	var serials map[int64]*memoryDoc
+	if _, ok := st.trash[name]; ok {
+		serials = st.states[name]
+	}
+	return memorySerials(name, serials, pageNum, pageSize)
+}
+
+// replaceTrashedSerial replaces a serial of a state in the trash,
+// which stays in the trash.
+func (st *MemoryStorage) replaceTrashedSerial(ctx context.Context, doc State, timestamp, source, name string) (err error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if _, ok := st.trash[name]; !ok {
+		return ErrNoDocuments
+	}
+	if _, ok := st.states[name][doc.Serial]; !ok {
+		return ErrNoDocuments
+	}
+	st.states[name][doc.Serial] = &memoryDoc{
+		Timestamp: timestamp,
+		Source:    source,
+		State:     data,
+		Raw:       copyBytes(doc.Raw),
+	}
+	return
+}
+
+// memorySerials returns a page of serials, sorted by serial
+func memorySerials(name string, serials map[int64]*memoryDoc, pageNum, pageSize int) (coll StateCollection, err error) {
+	var keys []int64
+	for s := range serials {
+		keys = append(keys, s)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	coll.Metadata = paginationMetadata(len(keys), pageNum)
+	start, end := paginationBounds(len(keys), pageNum, pageSize)
+	for _, s := range keys[start:end] {
+		state, err := serials[s].toState(name)
+		if err != nil {
+			return coll, fmt.Errorf("failed to get state: %v", err)
+		}
+		coll.Data = append(coll.Data, state)
+	}
+	return
+}
+
+// GetResource retrieves a Terraform resource given a state, module and name
+func (st *MemoryStorage) GetResource(ctx context.Context, state, module, name string) (res Resource, err error) {
+	s, err := st.GetState(ctx, state, 0)
+	if err == ErrNoDocuments {
+		return
+	} else if err != nil {
+		return res, fmt.Errorf("failed to get resource: %v", err)
+	}
+
+	res, err = getResource(s, module, name)
+	return
+}
+
+// liveSerials returns the serials of a state, unless it is in the trash.
+// The caller must hold the mutex.
+func (st *MemoryStorage) liveSerials(name string) (serials map[int64]*memoryDoc, ok bool) {
+	if _, deleted := st.trash[name]; deleted {
+		return nil, false
+	}
+	serials, ok = st.states[name]
+	return
+}
+
+func (d *memoryDoc) toState(name string) (state *State, err error) {
+	state = &State{}
+	err = json.Unmarshal(d.State, state)
+	if err != nil {
+		return state, fmt.Errorf("failed to unmarshal state: %v", err)
+	}
+	state.Raw = copyBytes(d.Raw)
+	state.Name = name
+	state.LastModified, err = time.Parse("20060102150405", d.Timestamp)
+	if err != nil {
+		return state, fmt.Errorf("failed to convert timestamp: %v", err)
+	}
+	return
+}
+
+func latestSerial(serials map[int64]*memoryDoc) (latest int64) {
+	first := true
+	for s := range serials {
+		if first || s > latest {
+			latest = s
+			first = false
+		}
+	}
+	return
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// InsertToken adds an API token, or replaces the token with the same ID.
+func (st *MemoryStorage) InsertToken(ctx context.Context, token Token) (err error) {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token: %v", err)
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.tokens[token.ID] = data
+	return
+}
+
+// GetToken returns an API token by ID
+func (st *MemoryStorage) GetToken(ctx context.Context, id string) (token Token, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	data, ok := st.tokens[id]
+	if !ok {
+		return token, ErrNoDocuments
+	}
+	err = json.Unmarshal(data, &token)
+	return
+}
+
+// ListTokens returns the API tokens
+func (st *MemoryStorage) ListTokens(ctx context.Context, pageNum, pageSize int) (coll TokenCollection, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	var ids []string
+	for id := range st.tokens {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	coll.Metadata = paginationMetadata(len(ids), pageNum)
+	start, end := paginationBounds(len(ids), pageNum, pageSize)
+	for _, id := range ids[start:end] {
+		var token Token
+		err = json.Unmarshal(st.tokens[id], &token)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal token: %v", err)
+		}
+		coll.Data = append(coll.Data, &token)
+	}
+	return
+}
+
+// RemoveToken revokes an API token
+func (st *MemoryStorage) RemoveToken(ctx context.Context, id string) (err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if _, ok := st.tokens[id]; !ok {
+		return ErrNoDocuments
+	}
+	delete(st.tokens, id)
+	return
+}
+
+// InsertACL adds an ACL, or replaces the ACL with the same ID.
+func (st *MemoryStorage) InsertACL(ctx context.Context, acl ACL) (err error) {
+	data, err := json.Marshal(acl)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ACL: %v", err)
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.acls[acl.ID] = data
+	return
+}
+
+// ListACLs returns the ACLs
+func (st *MemoryStorage) ListACLs(ctx context.Context, pageNum, pageSize int) (coll ACLCollection, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	var ids []string
+	for id := range st.acls {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	coll.Metadata = paginationMetadata(len(ids), pageNum)
+	start, end := paginationBounds(len(ids), pageNum, pageSize)
+	for _, id := range ids[start:end] {
+		var acl ACL
+		err = json.Unmarshal(st.acls[id], &acl)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal ACL: %v", err)
+		}
+		coll.Data = append(coll.Data, &acl)
+	}
+	return
+}
+
+// RemoveACL removes an ACL
+func (st *MemoryStorage) RemoveACL(ctx context.Context, id string) (err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if _, ok := st.acls[id]; !ok {
+		return ErrNoDocuments
+	}
+	delete(st.acls, id)
+	return
+}
+
+// InsertAuditRecord adds an audit record
+func (st *MemoryStorage) InsertAuditRecord(ctx context.Context, record AuditRecord) (err error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %v", err)
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.audit[record.ID] = data
+	return
+}
+
+// ListAuditRecords returns the audit records selected by filter
+func (st *MemoryStorage) ListAuditRecords(ctx context.Context, filter AuditFilter, pageNum, pageSize int) (coll AuditCollection, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	var ids []string
+	for id := range st.audit {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+	var records []*AuditRecord
+	for _, id := range ids {
+		var record AuditRecord
+		err = json.Unmarshal(st.audit[id], &record)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal audit record: %v", err)
+		}
+		if filter.Match(&record) {
+			records = append(records, &record)
+		}
+	}
+
+	coll.Metadata = paginationMetadata(len(records), pageNum)
+	start, end := paginationBounds(len(records), pageNum, pageSize)
+	coll.Data = records[start:end]
+	return
+}
+
+// InsertWebhook adds a webhook, or replaces the webhook with the same ID.
+func (st *MemoryStorage) InsertWebhook(ctx context.Context, webhook Webhook) (err error) {
+	data, err := json.Marshal(webhook)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook: %v", err)
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.webhooks[webhook.ID] = data
+	return
+}
+
+// ListWebhooks returns the webhooks
+func (st *MemoryStorage) ListWebhooks(ctx context.Context, pageNum, pageSize int) (coll WebhookCollection, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	var ids []string
+	for id := range st.webhooks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	coll.Metadata = paginationMetadata(len(ids), pageNum)
+	start, end := paginationBounds(len(ids), pageNum, pageSize)
+	for _, id := range ids[start:end] {
+		var webhook Webhook
+		err = json.Unmarshal(st.webhooks[id], &webhook)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal webhook: %v", err)
+		}
+		coll.Data = append(coll.Data, &webhook)
+	}
+	return
+}
+
+// RemoveWebhook removes a webhook
+func (st *MemoryStorage) RemoveWebhook(ctx context.Context, id string) (err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if _, ok := st.webhooks[id]; !ok {
+		return ErrNoDocuments
+	}
+	delete(st.webhooks, id)
+	return
+}
+
+// InsertDelivery adds a webhook delivery, or replaces the delivery with the same ID.
+func (st *MemoryStorage) InsertDelivery(ctx context.Context, delivery Delivery) (err error) {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %v", err)
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.deliveries[delivery.ID] = data
+	return
+}
+
+// ListDeliveries returns the webhook deliveries selected by filter
+func (st *MemoryStorage) ListDeliveries(ctx context.Context, filter DeliveryFilter, pageNum, pageSize int) (coll DeliveryCollection, err error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	var ids []string
+	for id := range st.deliveries {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+	var deliveries []*Delivery
+	for _, id := range ids {
+		var delivery Delivery
+		err = json.Unmarshal(st.deliveries[id], &delivery)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal delivery: %v", err)
+		}
+		if filter.Match(&delivery) {
+			deliveries = append(deliveries, &delivery)
+		}
+	}
+
+	coll.Metadata = paginationMetadata(len(deliveries), pageNum)
+	start, end := paginationBounds(len(deliveries), pageNum, pageSize)
+	coll.Data = deliveries[start:end]
+	return
+}
@@ -2,8 +2,14 @@ package storage
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"regexp"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -19,11 +25,30 @@ type MongoDBConfig struct {
 	URL      string
 	Username string
 	Password string
+
+	// BlobThreshold is the size above which state bodies are stored
+	// in GridFS rather than in the state documents (0 to disable)
+	BlobThreshold int
+	// Compression is the compression of the bodies stored in GridFS
+	Compression string
+	// SnapshotInterval is the number of serials between two serials
+	// stored in full, the others being stored as deltas (0 to disable)
+	SnapshotInterval int
+
+	// TLSCAFile verifies the certificate of the server, and TLSCertFile
+	// and TLSKeyFile authenticate the client. TLSKeyFile may be empty
+	// if TLSCertFile holds both the certificate and the key.
+	TLSCAFile   string
+	TLSCertFile string
+	TLSKeyFile  string
 }
 
 // MongoDBStorage stores the MongoDB client.
 type MongoDBStorage struct {
-	client *mongo.Client
+	client           *mongo.Client
+	blobThreshold    int
+	compression      string
+	snapshotInterval int
 }
 
 type mongoDoc struct {
@@ -31,6 +56,13 @@ type mongoDoc struct {
 	Source    string
 	State     *State
 	Name      string
+	Raw       []byte
+
+	// Blob references the state body when it is stored in GridFS,
+	// State then only holds the state metadata
+	Blob *mongoBlob
+	// Delta holds the state body when it is stored as a delta
+	Delta *mongoDelta
 }
 
 // a collection of paginated mongoDoc
@@ -46,9 +78,21 @@ type mongoLockInfoDoc struct {
 
 // NewMongoDB initializes a connection to the defined MongoDB instance.
 func NewMongoDB(config *MongoDBConfig) (st *MongoDBStorage, err error) {
-	st = &MongoDBStorage{}
+	st = &MongoDBStorage{
+		blobThreshold:    config.BlobThreshold,
+		compression:      config.Compression,
+		snapshotInterval: config.SnapshotInterval,
+	}
+	switch st.compression {
+	case "":
+		st.compression = MongoCompressionNone
+	case MongoCompressionNone, MongoCompressionGzip:
+	default:
+		return st, fmt.Errorf("unsupported compression %s", st.compression)
+	}
 
-	clientOptions := options.Client()
+	// The URI is applied first, since it would override the TLS configuration
+	clientOptions := options.Client().ApplyURI(config.URL)
 
 	if config.Username != "" {
 		clientOptions.SetAuth(options.Credential{
@@ -57,13 +101,113 @@ func NewMongoDB(config *MongoDBConfig) (st *MongoDBStorage, err error) {
 		})
 	}
 
+	if config.TLSCAFile != "" || config.TLSCertFile != "" {
+		tlsConfig, err := mongoTLSConfig(config)
+		if err != nil {
+			return st, err
+		}
+		clientOptions.SetTLSConfig(tlsConfig)
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	st.client, err = mongo.Connect(ctx, clientOptions.ApplyURI(config.URL))
+	st.client, err = mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		return
 	}
 	err = st.client.Ping(ctx, readpref.Primary())
+	if err != nil {
+		return
+	}
+
+	// A unique index on lock names makes lock acquisition atomic
+	_, err = st.client.Database("terradb").Collection("locks").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return st, fmt.Errorf("failed to create locks index: %v", err)
+	}
+
+	// A unique index on lease names serializes the writes of each state
+	_, err = st.client.Database("terradb").Collection("write_leases").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return st, fmt.Errorf("failed to create write leases index: %v", err)
+	}
+
+	_, err = st.client.Database("terradb").Collection("trash").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return st, fmt.Errorf("failed to create trash index: %v", err)
+	}
+
+	_, err = st.client.Database("terradb").Collection("tokens").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return st, fmt.Errorf("failed to create tokens index: %v", err)
+	}
+
+	_, err = st.client.Database("terradb").Collection("acls").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return st, fmt.Errorf("failed to create ACLs index: %v", err)
+	}
+
+	_, err = st.client.Database("terradb").Collection("audit").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return st, fmt.Errorf("failed to create audit index: %v", err)
+	}
+
+	for _, c := range []string{"webhooks", "deliveries"} {
+		_, err = st.client.Database("terradb").Collection(c).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		})
+		if err != nil {
+			return st, fmt.Errorf("failed to create %s index: %v", c, err)
+		}
+	}
+	return
+}
+
+// mongoTLSConfig returns the TLS configuration of the connection
+func mongoTLSConfig(config *MongoDBConfig) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{}
+
+	if config.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(config.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MongoDB CA file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in MongoDB CA file %s", config.TLSCAFile)
+		}
+	}
+
+	if config.TLSCertFile != "" {
+		keyFile := config.TLSKeyFile
+		if keyFile == "" {
+			keyFile = config.TLSCertFile
+		}
+		cert, err := tls.LoadX509KeyPair(config.TLSCertFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MongoDB client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
 	return
 }
 
@@ -73,11 +217,8 @@ func (*MongoDBStorage) GetName() string {
 }
 
 // GetLockStatus returns a Terraform lock.
-func (st *MongoDBStorage) GetLockStatus(name string) (lockStatus LockInfo, err error) {
+func (st *MongoDBStorage) GetLockStatus(ctx context.Context, name string) (lockStatus LockInfo, err error) {
 	collection := st.client.Database("terradb").Collection("locks")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	res := collection.FindOne(ctx, bson.M{"name": name})
 	if res.Err() != nil {
 		err = res.Err()
@@ -94,62 +235,237 @@ func (st *MongoDBStorage) GetLockStatus(name string) (lockStatus LockInfo, err e
 	return
 }
 
+// mongoLockAttempts is how many times LockState tries to take a lock
+// which is released as soon as it is found held
+const mongoLockAttempts = 5
+
 // LockState locks a Terraform state.
-func (st *MongoDBStorage) LockState(name string, lockData LockInfo) (err error) {
+// If the state is already locked, it returns ErrLocked
+// along with the current lock.
+func (st *MongoDBStorage) LockState(ctx context.Context, name string, lockData LockInfo) (lockStatus LockInfo, err error) {
 	collection := st.client.Database("terradb").Collection("locks")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	// State file uses the same key as lock
 	lockData.Path = name
 
-	_, err = collection.InsertOne(ctx, map[string]interface{}{
-		"name": name,
-		"lock": lockData,
-	})
+	for attempt := 0; attempt < mongoLockAttempts; attempt++ {
+		_, err = collection.InsertOne(ctx, map[string]interface{}{
+			"name": name,
+			"lock": lockData,
+		})
+		if err == nil {
+			return lockData, nil
+		} else if !isMongoDuplicateKey(err) {
+			return
+		}
 
-	return
+		lockStatus, err = st.GetLockStatus(ctx, name)
+		if err == nil {
+			return lockStatus, ErrLocked
+		} else if err != ErrNoDocuments {
+			return lockStatus, fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+		}
+		// The lock was released in the meantime, try again
+	}
+	return lockStatus, fmt.Errorf("failed to lock %s: the lock kept changing after %d attempts", name, mongoLockAttempts)
 }
 
 // UnlockState unlocks a Terraform state.
-func (st *MongoDBStorage) UnlockState(name string, lockData LockInfo) (err error) {
+// If the state is locked with another lock ID, it returns ErrLockIDMismatch
+// along with the current lock.
+func (st *MongoDBStorage) UnlockState(ctx context.Context, name string, lockData LockInfo) (lockStatus LockInfo, err error) {
 	collection := st.client.Database("terradb").Collection("locks")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	_, err = collection.DeleteOne(ctx, map[string]interface{}{
-		"name": name,
+	res, err := collection.DeleteOne(ctx, map[string]interface{}{
+		"name":    name,
+		"lock.id": lockData.ID,
 	}, &options.DeleteOptions{})
+	if err != nil {
+		return
+	}
+	if res.DeletedCount == 1 {
+		return lockData, nil
+	}
+
+	lockStatus, err = st.GetLockStatus(ctx, name)
+	if err == ErrNoDocuments {
+		// Not locked
+		return lockStatus, nil
+	} else if err != nil {
+		return lockStatus, fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+	}
+	return lockStatus, ErrLockIDMismatch
+}
+
+// ForceUnlockState unlocks a Terraform state, whatever its lock ID,
+// and returns the removed lock.
+func (st *MongoDBStorage) ForceUnlockState(ctx context.Context, name string) (lockStatus LockInfo, err error) {
+	collection := st.client.Database("terradb").Collection("locks")
+
+	var lockDoc mongoLockInfoDoc
+	err = collection.FindOneAndDelete(ctx, bson.M{"name": name}).Decode(&lockDoc)
+	if err == mongo.ErrNoDocuments {
+		return lockStatus, ErrNoDocuments
+	} else if err != nil {
+		return lockStatus, fmt.Errorf("failed to remove lock: %v", err)
+	}
+	return lockDoc.Lock, nil
+}
+
+// RemoveState moves the Terraform states to the trash.
+// The trash entry is recorded first, so that the state is never
+// hidden without being listed in the trash.
+func (st *MongoDBStorage) RemoveState(ctx context.Context, name string) (err error) {
+	latest, err := st.GetState(ctx, name, 0)
+	if err != nil {
+		return
+	}
+
+	trash := st.client.Database("terradb").Collection("trash")
+	upsert := true
+	_, err = trash.UpdateOne(ctx, bson.M{"name": name}, bson.M{
+		"$set": &DeletedState{
+			Name:      name,
+			Serial:    latest.Serial,
+			DeletedAt: time.Now().UTC(),
+		},
+	}, &options.UpdateOptions{
+		Upsert: &upsert,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove state: %v", err)
+	}
+
+	collection := st.client.Database("terradb").Collection("terraform_states")
+	_, err = collection.UpdateMany(ctx, bson.M{"name": name}, bson.M{
+		"$set": bson.M{"deleted": true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove state: %v", err)
+	}
+	return
+}
+
+// ListTrash returns the states in the trash
+func (st *MongoDBStorage) ListTrash(ctx context.Context, pageNum, pageSize int) (coll DeletedStateCollection, err error) {
+	trash := st.client.Database("terradb").Collection("trash")
+
+	total, err := trash.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return coll, fmt.Errorf("failed to count deleted states: %v", err)
+	}
+	coll.Metadata = paginationMetadata(int(total), pageNum)
 
+	cur, err := trash.Find(ctx, bson.M{}, options.Find().
+		SetSort(bson.M{"name": 1}).
+		SetSkip(int64(pageSize*(pageNum-1))).
+		SetLimit(int64(pageSize)),
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list deleted states: %v", err)
+	}
+
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var deleted DeletedState
+		err = cur.Decode(&deleted)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode deleted states: %v", err)
+		}
+		deleted.DeletedAt = deleted.DeletedAt.UTC()
+		coll.Data = append(coll.Data, &deleted)
+	}
+
+	err = cur.Err()
 	return
 }
 
-// RemoveState removes the Terraform states.
-func (st *MongoDBStorage) RemoveState(name string) (err error) {
+// RestoreState moves Terraform states back from the trash.
+func (st *MongoDBStorage) RestoreState(ctx context.Context, name string) (err error) {
+	err = st.findTrash(ctx, name)
+	if err != nil {
+		return
+	}
+
 	collection := st.client.Database("terradb").Collection("terraform_states")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	_, err = collection.UpdateMany(ctx, bson.M{"name": name}, bson.M{
+		"$unset": bson.M{"deleted": ""},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore state: %v", err)
+	}
 
-	_, err = collection.DeleteOne(ctx, map[string]interface{}{
-		"name": name,
-	}, &options.DeleteOptions{})
+	_, err = st.client.Database("terradb").Collection("trash").DeleteOne(ctx, bson.M{"name": name})
+	if err != nil {
+		return fmt.Errorf("failed to restore state: %v", err)
+	}
+	return
+}
+
+// PurgeState permanently removes the Terraform states from the trash,
+// along with their lock.
+func (st *MongoDBStorage) PurgeState(ctx context.Context, name string) (err error) {
+	err = st.findTrash(ctx, name)
+	if err != nil {
+		return
+	}
+
+	err = st.deleteBlobs(ctx, bson.M{"name": name})
+	if err != nil {
+		return fmt.Errorf("failed to purge state: %v", err)
+	}
+
+	collection := st.client.Database("terradb").Collection("terraform_states")
+	_, err = collection.DeleteMany(ctx, bson.M{"name": name})
+	if err != nil {
+		return fmt.Errorf("failed to purge state: %v", err)
+	}
+
+	_, err = st.client.Database("terradb").Collection("locks").DeleteOne(ctx, bson.M{"name": name})
+	if err != nil {
+		return fmt.Errorf("failed to remove lock: %v", err)
+	}
 
+	_, err = st.client.Database("terradb").Collection("trash").DeleteOne(ctx, bson.M{"name": name})
+	if err != nil {
+		return fmt.Errorf("failed to purge state: %v", err)
+	}
+	return
+}
+
+// findTrash returns ErrNoDocuments if a state is not in the trash
+func (st *MongoDBStorage) findTrash(ctx context.Context, name string) (err error) {
+	trash := st.client.Database("terradb").Collection("trash")
+	var deleted DeletedState
+	// Err does not report missing documents, only Decode does
+	err = trash.FindOne(ctx, bson.M{"name": name}).Decode(&deleted)
+	if err == mongo.ErrNoDocuments {
+		return ErrNoDocuments
+	} else if err != nil {
+		return fmt.Errorf("failed to retrieve deleted state: %v", err)
+	}
 	return
 }
 
 // ListStates returns all state names from TerraDB
-func (st *MongoDBStorage) ListStates(pageNum, pageSize int) (coll StateCollection, err error) {
+func (st *MongoDBStorage) ListStates(ctx context.Context, prefix string, pageNum, pageSize int) (coll StateCollection, err error) {
 	collection := st.client.Database("terradb").Collection("terraform_states")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
+	// Sort by serial so that $last returns the latest serial,
+	// then by name so that pages are stable
 	req := mongo.Pipeline{
-		{{"$group", bson.D{
-			{"_id", "$name"},
-			{"name", bson.D{{"$last", "$name"}}},
-			{"state", bson.D{{"$last", "$state"}}},
-			{"timestamp", bson.D{{"$last", "$timestamp"}}},
+		{{Key: "$match", Value: bson.D{
+			{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+			{Key: "name", Value: bson.D{{Key: "$regex", Value: "^" + regexp.QuoteMeta(prefix)}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "name", Value: 1}, {Key: "state.serial", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$name"},
+			{Key: "name", Value: bson.D{{Key: "$last", Value: "$name"}}},
+			{Key: "state", Value: bson.D{{Key: "$last", Value: "$state"}}},
+			{Key: "timestamp", Value: bson.D{{Key: "$last", Value: "$timestamp"}}},
+			{Key: "blob", Value: bson.D{{Key: "$last", Value: "$blob"}}},
+			{Key: "delta", Value: bson.D{{Key: "$last", Value: "$delta"}}},
 		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
 	}
 	pl := paginateReq(req, pageNum, pageSize)
 	cur, err := collection.Aggregate(ctx, pl, options.Aggregate())
@@ -157,9 +473,9 @@ func (st *MongoDBStorage) ListStates(pageNum, pageSize int) (coll StateCollectio
 		return coll, fmt.Errorf("failed to list states: %v", err)
 	}
 
-	defer cur.Close(context.Background())
+	defer cur.Close(ctx)
 
-	for cur.Next(nil) {
+	for cur.Next(ctx) {
 		var mongoColl mongoDocCollection
 		err = cur.Decode(&mongoColl)
 		if err != nil {
@@ -167,12 +483,16 @@ func (st *MongoDBStorage) ListStates(pageNum, pageSize int) (coll StateCollectio
 		}
 		coll.Metadata = mongoColl.Metadata
 		for _, d := range mongoColl.Docs {
+			err = st.loadDoc(ctx, d, nil)
+			if err != nil {
+				return coll, fmt.Errorf("failed to get state: %v", err)
+			}
 			state, err := d.toState()
 			if err != nil {
 				return coll, fmt.Errorf("failed to get state: %v", err)
 			}
 
-			state.LockInfo, err = st.GetLockStatus(state.Name)
+			state.LockInfo, err = st.GetLockStatus(ctx, state.Name)
 			// Init value required because of omitempty
 			state.Locked = false
 			if err == nil {
@@ -194,13 +514,11 @@ func (st *MongoDBStorage) ListStates(pageNum, pageSize int) (coll StateCollectio
 
 // GetState retrieves a Terraform state, at a given serial.
 // If serial is 0, it gets the latest serial
-func (st *MongoDBStorage) GetState(name string, serial int) (state State, err error) {
+func (st *MongoDBStorage) GetState(ctx context.Context, name string, serial int) (state State, err error) {
 	collection := st.client.Database("terradb").Collection("terraform_states")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	filter := map[string]interface{}{
-		"name": name,
+		"name":    name,
+		"deleted": bson.M{"$ne": true},
 	}
 
 	if serial != 0 {
@@ -221,6 +539,10 @@ func (st *MongoDBStorage) GetState(name string, serial int) (state State, err er
 		return
 	}
 
+	err = st.loadDoc(ctx, &doc, nil)
+	if err != nil {
+		return state, fmt.Errorf("failed to get state: %v", err)
+	}
 	s, err := doc.toState()
 	if err != nil {
 		return state, fmt.Errorf("failed to get state: %v", err)
@@ -228,7 +550,7 @@ func (st *MongoDBStorage) GetState(name string, serial int) (state State, err er
 	state = *s
 	// Init value required because of omitempty
 	state.Locked = false
-	state.LockInfo, err = st.GetLockStatus(state.Name)
+	state.LockInfo, err = st.GetLockStatus(ctx, state.Name)
 	if err == nil {
 		state.Locked = true
 	} else if err == ErrNoDocuments {
@@ -243,23 +565,96 @@ func (st *MongoDBStorage) GetState(name string, serial int) (state State, err er
 	return
 }
 
-// InsertState adds a Terraform state to the database.
-func (st *MongoDBStorage) InsertState(doc State, timestamp, source, name string) (err error) {
-	collection := st.client.Database("terradb").Collection("terraform_states")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// InsertState adds a Terraform state to the database,
+// if the conditions hold. They are checked under the write lease
+// of the state, which the other instances must take to write it.
+func (st *MongoDBStorage) InsertState(ctx context.Context, doc State, timestamp, source, name string, cond InsertConditions) (err error) {
+	lease, err := st.takeWriteLease(ctx, name)
+	if err != nil {
+		return
+	}
+	defer lease.release()
 
-	var query interface{}
-	json.Unmarshal([]byte(fmt.Sprintf(`{
-		"state.serial": "%v",
-		"name": "%s"
-	}`, doc.Serial, name)), &query)
+	err = st.findTrash(ctx, name)
+	if err == nil {
+		return ErrStateDeleted
+	} else if err != ErrNoDocuments {
+		return
+	}
+
+	var lock *LockInfo
+	l, err := st.GetLockStatus(ctx, name)
+	if err == nil {
+		lock = &l
+	} else if err != ErrNoDocuments {
+		return fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+	}
+	var latest *State
+	s, err := st.GetState(ctx, name, 0)
+	if err == nil {
+		latest = &s
+	} else if err != ErrNoDocuments {
+		return fmt.Errorf("failed to get latest state: %v", err)
+	}
+	err = cond.check(lock, latest, doc)
+	if err != nil {
+		return
+	}
+
+	// Deltas based on an overwritten serial would no longer apply
+	err = st.materializeDeltas(ctx, name, doc.Serial)
+	if err != nil {
+		return
+	}
+
+	base, err := st.deltaBase(ctx, name, doc.Serial)
+	if err != nil {
+		return
+	}
+	return st.writeSerial(ctx, name, &doc, timestamp, source, base)
+}
+
+// writeSerial stores a serial of a state, as a delta against base
+// if it is not nil and the delta is smaller than the state,
+// in GridFS if it is large, or inline.
+func (st *MongoDBStorage) writeSerial(ctx context.Context, name string, doc *State, timestamp, source string, base *mongoSnapshot) (err error) {
+	collection := st.client.Database("terradb").Collection("terraform_states")
+	query := bson.M{
+		"state.serial": doc.Serial,
+		"name":         name,
+	}
 
 	data := &mongoDoc{
 		Timestamp: timestamp,
 		Source:    source,
 		Name:      name,
-		State:     &doc,
+		State:     doc,
+		Raw:       doc.Raw,
+	}
+
+	if base != nil {
+		data.Delta, err = encodeDelta(base, doc)
+		if err != nil {
+			return
+		}
+	}
+
+	// Large bodies are stored in GridFS, to keep documents under 16MB
+	if data.Delta == nil {
+		data.Blob, err = st.offloadState(ctx, name, doc)
+		if err != nil {
+			return
+		}
+	}
+	if data.Delta != nil || data.Blob != nil {
+		data.State = stateMetadata(*doc)
+		data.Raw = nil
+	}
+
+	// The body of an overwritten serial is no longer referenced
+	oldBlob, err := st.serialBlob(ctx, name, doc.Serial)
+	if err != nil {
+		return
 	}
 
 	upsert := true
@@ -269,19 +664,67 @@ func (st *MongoDBStorage) InsertState(doc State, timestamp, source, name string)
 	}, &options.UpdateOptions{
 		Upsert: &upsert,
 	})
+	if err != nil {
+		if data.Blob != nil {
+			st.deleteBlob(ctx, data.Blob)
+		}
+		return
+	}
 
+	if oldBlob != nil {
+		err = st.deleteBlob(ctx, oldBlob)
+	}
 	return
 }
 
 // ListStateSerials returns all state serials with a given name.
-func (st *MongoDBStorage) ListStateSerials(name string, pageNum, pageSize int) (coll StateCollection, err error) {
+func (st *MongoDBStorage) ListStateSerials(ctx context.Context, name string, pageNum, pageSize int) (coll StateCollection, err error) {
+	return st.listSerials(ctx, name, bson.D{{Key: "$ne", Value: true}}, pageNum, pageSize)
+}
+
+// listTrashedSerials returns the serials of a state in the trash.
+func (st *MongoDBStorage) listTrashedSerials(ctx context.Context, name string, pageNum, pageSize int) (coll StateCollection, err error) {
+	return st.listSerials(ctx, name, true, pageNum, pageSize)
+}
+
+// replaceTrashedSerial replaces a serial of a state in the trash,
+// which stays in the trash, under the write lease of the state.
+func (st *MongoDBStorage) replaceTrashedSerial(ctx context.Context, doc State, timestamp, source, name string) (err error) {
+	lease, err := st.takeWriteLease(ctx, name)
+	if err != nil {
+		return
+	}
+	defer lease.release()
+
+	err = st.findTrash(ctx, name)
+	if err != nil {
+		return
+	}
+
 	collection := st.client.Database("terradb").Collection("terraform_states")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	n, err := collection.CountDocuments(ctx, bson.M{"name": name, "state.serial": doc.Serial, "deleted": true})
+	if err != nil {
+		return fmt.Errorf("failed to retrieve state: %v", err)
+	}
+	if n == 0 {
+		return ErrNoDocuments
+	}
 
+	// Deltas based on the replaced serial would no longer apply
+	err = st.materializeDeltas(ctx, name, doc.Serial)
+	if err != nil {
+		return
+	}
+	// The deleted flag is left as is
+	return st.writeSerial(ctx, name, &doc, timestamp, source, nil)
+}
+
+// listSerials returns the serials of a state whose deleted flag matches deleted
+func (st *MongoDBStorage) listSerials(ctx context.Context, name string, deleted interface{}, pageNum, pageSize int) (coll StateCollection, err error) {
+	collection := st.client.Database("terradb").Collection("terraform_states")
 	req := mongo.Pipeline{
-		{{"$match", bson.D{{"name", name}}}},
-		{{"$sort", bson.D{{"state.serial", 1}}}},
+		{{Key: "$match", Value: bson.D{{Key: "name", Value: name}, {Key: "deleted", Value: deleted}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "state.serial", Value: 1}}}},
 	}
 
 	pl := paginateReq(req, pageNum, pageSize)
@@ -290,16 +733,21 @@ func (st *MongoDBStorage) ListStateSerials(name string, pageNum, pageSize int) (
 		return coll, fmt.Errorf("failed to list states: %v", err)
 	}
 
-	defer cur.Close(context.Background())
+	defer cur.Close(ctx)
 
 	var mongoColl mongoDocCollection
-	for cur.Next(nil) {
+	for cur.Next(ctx) {
 		err = cur.Decode(&mongoColl)
 		if err != nil {
 			return coll, fmt.Errorf("failed to decode states: %v", err)
 		}
 		coll.Metadata = mongoColl.Metadata
+		snapshots := make(map[int64][]byte)
 		for _, d := range mongoColl.Docs {
+			err = st.loadDoc(ctx, d, snapshots)
+			if err != nil {
+				return coll, fmt.Errorf("failed to get state: %v", err)
+			}
 			state, err := d.toState()
 			if err != nil {
 				return coll, fmt.Errorf("failed to get state: %v", err)
@@ -316,9 +764,11 @@ func (st *MongoDBStorage) ListStateSerials(name string, pageNum, pageSize int) (
 }
 
 // GetResource retrieves a Terraform resource given a state, module and name
-func (st *MongoDBStorage) GetResource(state, module, name string) (res Resource, err error) {
-	s, err := st.GetState(state, 0)
-	if err != nil {
+func (st *MongoDBStorage) GetResource(ctx context.Context, state, module, name string) (res Resource, err error) {
+	s, err := st.GetState(ctx, state, 0)
+	if err == ErrNoDocuments {
+		return
+	} else if err != nil {
 		return res, fmt.Errorf("failed to get resource: %v", err)
 	}
 
@@ -327,12 +777,20 @@ func (st *MongoDBStorage) GetResource(state, module, name string) (res Resource,
 }
 
 func getResource(state State, module, name string) (res Resource, err error) {
+	if state.Version == StateVersion4 {
+		r := getResourceV4(state.Resources, module, name)
+		if r == nil {
+			return res, ErrNoDocuments
+		}
+		return Resource{V4: r}, nil
+	}
+
 	for _, m := range state.Modules {
 		for _, p := range m.Path {
 			if p == module {
 				r, ok := m.Resources[name]
 				if ok {
-					return *r, nil
+					return Resource{V3: r}, nil
 				}
 				return res, ErrNoDocuments
 			}
@@ -341,18 +799,454 @@ func getResource(state State, module, name string) (res Resource, err error) {
 	return res, ErrNoDocuments
 }
 
+// InsertToken adds an API token, or replaces the token with the same ID.
+func (st *MongoDBStorage) InsertToken(ctx context.Context, token Token) (err error) {
+	collection := st.client.Database("terradb").Collection("tokens")
+	_, err = collection.ReplaceOne(ctx, bson.M{"id": token.ID}, token, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to insert token: %v", err)
+	}
+	return
+}
+
+// GetToken returns an API token by ID
+func (st *MongoDBStorage) GetToken(ctx context.Context, id string) (token Token, err error) {
+	collection := st.client.Database("terradb").Collection("tokens")
+	err = collection.FindOne(ctx, bson.M{"id": id}).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return token, ErrNoDocuments
+	} else if err != nil {
+		return token, fmt.Errorf("failed to retrieve token: %v", err)
+	}
+	mongoTokenUTC(&token)
+	return
+}
+
+// ListTokens returns the API tokens
+func (st *MongoDBStorage) ListTokens(ctx context.Context, pageNum, pageSize int) (coll TokenCollection, err error) {
+	tokens := st.client.Database("terradb").Collection("tokens")
+
+	total, err := tokens.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return coll, fmt.Errorf("failed to count tokens: %v", err)
+	}
+	coll.Metadata = paginationMetadata(int(total), pageNum)
+
+	cur, err := tokens.Find(ctx, bson.M{}, options.Find().
+		SetSort(bson.M{"id": 1}).
+		SetSkip(int64(pageSize*(pageNum-1))).
+		SetLimit(int64(pageSize)),
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list tokens: %v", err)
+	}
+
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var token Token
+		err = cur.Decode(&token)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode tokens: %v", err)
+		}
+		mongoTokenUTC(&token)
+		coll.Data = append(coll.Data, &token)
+	}
+
+	err = cur.Err()
+	return
+}
+
+// RemoveToken revokes an API token
+func (st *MongoDBStorage) RemoveToken(ctx context.Context, id string) (err error) {
+	res, err := st.client.Database("terradb").Collection("tokens").DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return fmt.Errorf("failed to remove token: %v", err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrNoDocuments
+	}
+	return
+}
+
+// InsertACL adds an ACL, or replaces the ACL with the same ID.
+func (st *MongoDBStorage) InsertACL(ctx context.Context, acl ACL) (err error) {
+	collection := st.client.Database("terradb").Collection("acls")
+	_, err = collection.ReplaceOne(ctx, bson.M{"id": acl.ID}, acl, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to insert ACL: %v", err)
+	}
+	return
+}
+
+// ListACLs returns the ACLs
+func (st *MongoDBStorage) ListACLs(ctx context.Context, pageNum, pageSize int) (coll ACLCollection, err error) {
+	acls := st.client.Database("terradb").Collection("acls")
+
+	total, err := acls.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return coll, fmt.Errorf("failed to count ACLs: %v", err)
+	}
+	coll.Metadata = paginationMetadata(int(total), pageNum)
+
+	cur, err := acls.Find(ctx, bson.M{}, options.Find().
+		SetSort(bson.M{"id": 1}).
+		SetSkip(int64(pageSize*(pageNum-1))).
+		SetLimit(int64(pageSize)),
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list ACLs: %v", err)
+	}
+
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var acl ACL
+		err = cur.Decode(&acl)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode ACLs: %v", err)
+		}
+		coll.Data = append(coll.Data, &acl)
+	}
+
+	err = cur.Err()
+	return
+}
+
+// RemoveACL removes an ACL
+func (st *MongoDBStorage) RemoveACL(ctx context.Context, id string) (err error) {
+	res, err := st.client.Database("terradb").Collection("acls").DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return fmt.Errorf("failed to remove ACL: %v", err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrNoDocuments
+	}
+	return
+}
+
+// InsertAuditRecord adds an audit record
+func (st *MongoDBStorage) InsertAuditRecord(ctx context.Context, record AuditRecord) (err error) {
+	_, err = st.client.Database("terradb").Collection("audit").InsertOne(ctx, record)
+	if err != nil {
+		return fmt.Errorf("failed to insert audit record: %v", err)
+	}
+	return
+}
+
+// ListAuditRecords returns the audit records selected by filter
+func (st *MongoDBStorage) ListAuditRecords(ctx context.Context, filter AuditFilter, pageNum, pageSize int) (coll AuditCollection, err error) {
+	audit := st.client.Database("terradb").Collection("audit")
+
+	query := bson.M{}
+	for field, value := range map[string]string{
+		"name":      filter.Name,
+		"principal": filter.Principal,
+		"action":    filter.Action,
+		"outcome":   filter.Outcome,
+	} {
+		if value != "" {
+			query[field] = value
+		}
+	}
+	times := bson.M{}
+	if !filter.Since.IsZero() {
+		times["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		times["$lte"] = filter.Until
+	}
+	if len(times) > 0 {
+		query["time"] = times
+	}
+
+	total, err := audit.CountDocuments(ctx, query)
+	if err != nil {
+		return coll, fmt.Errorf("failed to count audit records: %v", err)
+	}
+	coll.Metadata = paginationMetadata(int(total), pageNum)
+
+	cur, err := audit.Find(ctx, query, options.Find().
+		SetSort(bson.M{"id": -1}).
+		SetSkip(int64(pageSize*(pageNum-1))).
+		SetLimit(int64(pageSize)),
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list audit records: %v", err)
+	}
+
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var record AuditRecord
+		err = cur.Decode(&record)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode audit records: %v", err)
+		}
+		record.Time = record.Time.UTC()
+		coll.Data = append(coll.Data, &record)
+	}
+
+	err = cur.Err()
+	return
+}
+
+// InsertWebhook adds a webhook, or replaces the webhook with the same ID.
+func (st *MongoDBStorage) InsertWebhook(ctx context.Context, webhook Webhook) (err error) {
+	collection := st.client.Database("terradb").Collection("webhooks")
+	_, err = collection.ReplaceOne(ctx, bson.M{"id": webhook.ID}, webhook, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to insert webhook: %v", err)
+	}
+	return
+}
+
+// ListWebhooks returns the webhooks
+func (st *MongoDBStorage) ListWebhooks(ctx context.Context, pageNum, pageSize int) (coll WebhookCollection, err error) {
+	webhooks := st.client.Database("terradb").Collection("webhooks")
+
+	total, err := webhooks.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return coll, fmt.Errorf("failed to count webhooks: %v", err)
+	}
+	coll.Metadata = paginationMetadata(int(total), pageNum)
+
+	cur, err := webhooks.Find(ctx, bson.M{}, options.Find().
+		SetSort(bson.M{"id": 1}).
+		SetSkip(int64(pageSize*(pageNum-1))).
+		SetLimit(int64(pageSize)),
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list webhooks: %v", err)
+	}
+
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var webhook Webhook
+		err = cur.Decode(&webhook)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode webhooks: %v", err)
+		}
+		webhook.CreatedAt = webhook.CreatedAt.UTC()
+		coll.Data = append(coll.Data, &webhook)
+	}
+
+	err = cur.Err()
+	return
+}
+
+// RemoveWebhook removes a webhook
+func (st *MongoDBStorage) RemoveWebhook(ctx context.Context, id string) (err error) {
+	res, err := st.client.Database("terradb").Collection("webhooks").DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return fmt.Errorf("failed to remove webhook: %v", err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrNoDocuments
+	}
+	return
+}
+
+// mongoDelivery is a webhook delivery, stored as JSON along with the
+// fields it is filtered on, since BSON has no raw JSON type for its payload
+type mongoDelivery struct {
+	ID        string `bson:"id"`
+	WebhookID string `bson:"webhook_id"`
+	Status    string `bson:"status"`
+	Delivery  string `bson:"delivery"`
+}
+
+// InsertDelivery adds a webhook delivery, or replaces the delivery with the same ID.
+func (st *MongoDBStorage) InsertDelivery(ctx context.Context, delivery Delivery) (err error) {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %v", err)
+	}
+
+	doc := mongoDelivery{
+		ID:        delivery.ID,
+		WebhookID: delivery.WebhookID,
+		Status:    delivery.Status,
+		Delivery:  string(data),
+	}
+	collection := st.client.Database("terradb").Collection("deliveries")
+	_, err = collection.ReplaceOne(ctx, bson.M{"id": delivery.ID}, doc, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to insert delivery: %v", err)
+	}
+	return
+}
+
+// ListDeliveries returns the webhook deliveries selected by filter
+func (st *MongoDBStorage) ListDeliveries(ctx context.Context, filter DeliveryFilter, pageNum, pageSize int) (coll DeliveryCollection, err error) {
+	deliveries := st.client.Database("terradb").Collection("deliveries")
+
+	query := bson.M{}
+	if filter.WebhookID != "" {
+		query["webhook_id"] = filter.WebhookID
+	}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+
+	total, err := deliveries.CountDocuments(ctx, query)
+	if err != nil {
+		return coll, fmt.Errorf("failed to count deliveries: %v", err)
+	}
+	coll.Metadata = paginationMetadata(int(total), pageNum)
+
+	cur, err := deliveries.Find(ctx, query, options.Find().
+		SetSort(bson.M{"id": -1}).
+		SetSkip(int64(pageSize*(pageNum-1))).
+		SetLimit(int64(pageSize)),
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list deliveries: %v", err)
+	}
+
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var doc mongoDelivery
+		err = cur.Decode(&doc)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode deliveries: %v", err)
+		}
+
+		var delivery Delivery
+		err = json.Unmarshal([]byte(doc.Delivery), &delivery)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal delivery: %v", err)
+		}
+		coll.Data = append(coll.Data, &delivery)
+	}
+
+	err = cur.Err()
+	return
+}
+
+// mongoTokenUTC restores the UTC location of the token dates,
+// which MongoDB decodes as local times
+func mongoTokenUTC(token *Token) {
+	token.CreatedAt = token.CreatedAt.UTC()
+	if token.ExpiresAt != nil {
+		expiresAt := token.ExpiresAt.UTC()
+		token.ExpiresAt = &expiresAt
+	}
+}
+
+// mongoWriteLease is held by the instance writing the serials of a state,
+// pushing or compacting them, since the deltas of a state are based on
+// its other serials
+type mongoWriteLease struct {
+	collection *mongo.Collection
+	name       string
+	owner      string
+}
+
+const (
+	// mongoWriteLeaseTTL is how long a write lease is valid,
+	// so that the leases of the instances which crashed expire
+	mongoWriteLeaseTTL = time.Minute
+
+	// mongoWriteLeaseRetry is the delay between two attempts
+	// to take a write lease held by another writer
+	mongoWriteLeaseRetry = 50 * time.Millisecond
+)
+
+// takeWriteLease takes the write lease of a state, waiting for
+// the current holder to release it, or for it to expire
+func (st *MongoDBStorage) takeWriteLease(ctx context.Context, name string) (lease *mongoWriteLease, err error) {
+	owner := make([]byte, 8)
+	_, err = rand.Read(owner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate write lease: %v", err)
+	}
+	lease = &mongoWriteLease{
+		collection: st.client.Database("terradb").Collection("write_leases"),
+		name:       name,
+		owner:      hex.EncodeToString(owner),
+	}
+
+	for {
+		now := time.Now()
+		_, err = lease.collection.DeleteOne(ctx, bson.M{"name": name, "expires": bson.M{"$lt": now}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove expired write lease: %v", err)
+		}
+
+		_, err = lease.collection.InsertOne(ctx, bson.M{
+			"name":    name,
+			"owner":   lease.owner,
+			"expires": now.Add(mongoWriteLeaseTTL),
+		})
+		if err == nil {
+			return lease, nil
+		} else if !isMongoDuplicateKey(err) {
+			return nil, fmt.Errorf("failed to take write lease: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(mongoWriteLeaseRetry):
+		}
+	}
+}
+
+// renew extends a write lease during long writes, and fails
+// if it expired and was taken over meanwhile
+func (l *mongoWriteLease) renew(ctx context.Context) (err error) {
+	res, err := l.collection.UpdateOne(ctx, bson.M{"name": l.name, "owner": l.owner}, bson.M{
+		"$set": bson.M{"expires": time.Now().Add(mongoWriteLeaseTTL)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to renew write lease: %v", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("write lease of %s expired", l.name)
+	}
+	return
+}
+
+// release releases a write lease, even when the write was canceled
+func (l *mongoWriteLease) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := l.collection.DeleteOne(ctx, bson.M{"name": l.name, "owner": l.owner})
+	if err != nil {
+		log.Errorf("failed to release write lease of %s: %s", l.name, err)
+	}
+}
+
+// isMongoDuplicateKey returns whether err is a duplicate key error
+func isMongoDuplicateKey(err error) bool {
+	we, ok := err.(mongo.WriteException)
+	if !ok {
+		return false
+	}
+	for _, e := range we.WriteErrors {
+		if e.Code == 11000 {
+			return true
+		}
+	}
+	return false
+}
+
 func paginateReq(req mongo.Pipeline, pageNum, pageSize int) (pl mongo.Pipeline) {
 	skips := pageSize * (pageNum - 1)
 
 	pl = append(req,
-		bson.D{{"$facet", bson.D{
-			{"metadata", bson.A{
-				bson.D{{"$count", "total"}},
-				bson.D{{"$addFields", bson.D{{"page", pageNum}}}},
+		bson.D{{Key: "$facet", Value: bson.D{
+			{Key: "metadata", Value: bson.A{
+				bson.D{{Key: "$count", Value: "total"}},
+				bson.D{{Key: "$addFields", Value: bson.D{{Key: "page", Value: pageNum}}}},
 			}},
-			{"docs", bson.A{
-				bson.D{{"$skip", skips}},
-				bson.D{{"$limit", pageSize}},
+			{Key: "docs", Value: bson.A{
+				bson.D{{Key: "$skip", Value: skips}},
+				bson.D{{Key: "$limit", Value: pageSize}},
 			}},
 		},
 		}},
@@ -363,6 +1257,7 @@ func paginateReq(req mongo.Pipeline, pageNum, pageSize int) (pl mongo.Pipeline)
 
 func (d *mongoDoc) toState() (state *State, err error) {
 	state = d.State
+	state.Raw = d.Raw
 	state.Name = d.Name
 	state.LastModified, err = time.Parse("20060102150405", d.Timestamp)
 	if err != nil {
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Compression algorithms of the state bodies stored in GridFS
+const (
+	MongoCompressionNone = "none"
+	MongoCompressionGzip = "gzip"
+)
+
+// mongoBlobBucket is the GridFS bucket holding large state bodies
+const mongoBlobBucket = "state_blobs"
+
+// mongoBlob references a state body stored in GridFS.
+// The document then only keeps the state metadata.
+type mongoBlob struct {
+	ID          primitive.ObjectID
+	Compression string
+
+	// Raw tells whether the body is the pushed document,
+	// or the marshaled state when the document was not kept
+	Raw bool
+
+	// Size is the size of the stored, possibly compressed, body
+	Size int
+}
+
+// offloadState stores the body of a state in GridFS
+// if the document would be larger than the blob threshold.
+// It returns nil if the state should be stored inline.
+func (st *MongoDBStorage) offloadState(ctx context.Context, name string, doc *State) (blob *mongoBlob, err error) {
+	if st.blobThreshold <= 0 {
+		return nil, nil
+	}
+
+	body, raw := doc.Raw, true
+	if body == nil {
+		raw = false
+		body, err = json.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal state: %v", err)
+		}
+	}
+
+	// Inline, the decoded state is stored along with the raw document
+	state, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal state: %v", err)
+	}
+	if len(state)+len(doc.Raw) < st.blobThreshold {
+		return nil, nil
+	}
+
+	blob = &mongoBlob{
+		ID:          primitive.NewObjectID(),
+		Compression: st.compression,
+		Raw:         raw,
+	}
+
+	if blob.Compression == MongoCompressionGzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err = zw.Write(body)
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress state: %v", err)
+		}
+		body = buf.Bytes()
+	}
+	blob.Size = len(body)
+
+	bucket, err := st.blobBucket(ctx)
+	if err != nil {
+		return
+	}
+	err = bucket.UploadFromStreamWithID(blob.ID, fmt.Sprintf("%s/%d", name, doc.Serial), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload state body: %v", err)
+	}
+	return
+}
+
+// loadBlob replaces the state metadata of a document
+// with the full state stored in GridFS, if any.
+func (st *MongoDBStorage) loadBlob(ctx context.Context, d *mongoDoc) (err error) {
+	if d.Blob == nil {
+		return nil
+	}
+
+	bucket, err := st.blobBucket(ctx)
+	if err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	_, err = bucket.DownloadToStream(d.Blob.ID, &buf)
+	if err != nil {
+		return fmt.Errorf("failed to download state body: %v", err)
+	}
+	body := buf.Bytes()
+
+	if d.Blob.Compression == MongoCompressionGzip {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to decompress state body: %v", err)
+		}
+		body, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return fmt.Errorf("failed to decompress state body: %v", err)
+		}
+	}
+
+	state := &State{}
+	err = json.Unmarshal(body, state)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal state: %v", err)
+	}
+	if d.State != nil {
+		state.MD5 = d.State.MD5
+	}
+	if d.Blob.Raw {
+		d.Raw = body
+	}
+	d.State = state
+	return
+}
+
+// deleteBlobs removes the GridFS bodies of the documents matching filter
+func (st *MongoDBStorage) deleteBlobs(ctx context.Context, filter bson.M) (err error) {
+	collection := st.client.Database("terradb").Collection("terraform_states")
+	filter["blob"] = bson.M{"$ne": nil}
+	cur, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"blob": 1}))
+	if err != nil {
+		return fmt.Errorf("failed to list state bodies: %v", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var d mongoDoc
+		err = cur.Decode(&d)
+		if err != nil {
+			return fmt.Errorf("failed to decode state: %v", err)
+		}
+		err = st.deleteBlob(ctx, d.Blob)
+		if err != nil {
+			return
+		}
+	}
+	return cur.Err()
+}
+
+// deleteBlob removes a state body from GridFS
+func (st *MongoDBStorage) deleteBlob(ctx context.Context, blob *mongoBlob) (err error) {
+	bucket, err := st.blobBucket(ctx)
+	if err != nil {
+		return
+	}
+	err = bucket.Delete(blob.ID)
+	if err != nil && err != gridfs.ErrFileNotFound {
+		return fmt.Errorf("failed to delete state body: %v", err)
+	}
+	return nil
+}
+
+// blobBucket returns the GridFS bucket, bound by the context deadline.
+// Buckets are not safe for concurrent use, so one is opened per operation.
+func (st *MongoDBStorage) blobBucket(ctx context.Context) (bucket *gridfs.Bucket, err error) {
+	bucket, err = gridfs.NewBucket(st.client.Database("terradb"), options.GridFSBucket().SetName(mongoBlobBucket))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GridFS bucket: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		bucket.SetReadDeadline(deadline)
+		bucket.SetWriteDeadline(deadline)
+	}
+	return
+}
+
+// stateMetadata returns the fields of a state which are kept
+// in the document when its body is stored in GridFS
+func stateMetadata(doc State) *State {
+	return &State{
+		Version:   doc.Version,
+		TFVersion: doc.TFVersion,
+		Serial:    doc.Serial,
+		Lineage:   doc.Lineage,
+		MD5:       doc.MD5,
+	}
+}
+
+// serialBlob returns the blob of the document of a serial, if any
+func (st *MongoDBStorage) serialBlob(ctx context.Context, name string, serial int64) (blob *mongoBlob, err error) {
+	collection := st.client.Database("terradb").Collection("terraform_states")
+
+	var d mongoDoc
+	err = collection.FindOne(ctx, bson.M{"name": name, "state.serial": serial},
+		options.FindOne().SetProjection(bson.M{"blob": 1}),
+	).Decode(&d)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to retrieve state: %v", err)
+	}
+	return d.Blob, nil
+}
@@ -0,0 +1,391 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoDelta stores a serial as a delta against a snapshot,
+// which is a serial stored in full. State then only holds the state metadata.
+//
+// Deltas are line-based rather than JSON patches, since the documents
+// pushed by Terraform must be rebuilt byte for byte, to match their checksums.
+type mongoDelta struct {
+	// Base is the serial of the snapshot
+	Base int64
+
+	// Raw tells whether the rebuilt body is the pushed document,
+	// or the Terraform state when the document was not kept
+	Raw bool
+
+	// Ops are the JSON-encoded delta operations
+	Ops []byte
+
+	// Size is the size of the rebuilt body, StoredSize the size of Ops
+	Size       int
+	StoredSize int
+}
+
+// mongoSnapshot is the body of a snapshot, which deltas are computed against
+type mongoSnapshot struct {
+	Serial int64
+	Body   []byte
+}
+
+// deltaBase returns the snapshot a new serial should be based on,
+// or nil if it should be stored in full: when delta encoding is disabled,
+// when there is no older snapshot, or when the snapshot already has
+// the maximum number of deltas.
+func (st *MongoDBStorage) deltaBase(ctx context.Context, name string, serial int64) (base *mongoSnapshot, err error) {
+	if st.snapshotInterval <= 1 {
+		return nil, nil
+	}
+
+	collection := st.client.Database("terradb").Collection("terraform_states")
+
+	var snap mongoDoc
+	err = collection.FindOne(ctx, bson.M{
+		"name":         name,
+		"state.serial": bson.M{"$lt": serial},
+		"delta":        nil,
+	}, options.FindOne().SetSort(bson.M{"state.serial": -1})).Decode(&snap)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to retrieve snapshot: %v", err)
+	}
+
+	n, err := collection.CountDocuments(ctx, bson.M{
+		"name":         name,
+		"delta.base":   snap.State.Serial,
+		"state.serial": bson.M{"$ne": serial},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to count deltas: %v", err)
+	}
+	if n >= int64(st.snapshotInterval-1) {
+		return nil, nil
+	}
+
+	err = st.loadBlob(ctx, &snap)
+	if err != nil {
+		return
+	}
+	body, _, err := mongoDocBody(&snap)
+	if err != nil {
+		return
+	}
+	return &mongoSnapshot{Serial: snap.State.Serial, Body: body}, nil
+}
+
+// encodeDelta returns the delta of a state against a snapshot,
+// or nil if it would not be smaller than the state itself
+func encodeDelta(base *mongoSnapshot, doc *State) (delta *mongoDelta, err error) {
+	body, raw := doc.Raw, true
+	if body == nil {
+		raw = false
+		body, err = TerraformStateJSON(*doc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal state: %v", err)
+		}
+	}
+
+	ops, err := json.Marshal(diffLines(base.Body, body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal delta: %v", err)
+	}
+	if len(ops) >= len(body) {
+		return nil, nil
+	}
+
+	return &mongoDelta{
+		Base:       base.Serial,
+		Raw:        raw,
+		Ops:        ops,
+		Size:       len(body),
+		StoredSize: len(ops),
+	}, nil
+}
+
+// loadDoc reassembles the full state of a document, from GridFS
+// or from the snapshot its delta is based on.
+// Snapshot bodies are cached in snapshots, which may be nil.
+func (st *MongoDBStorage) loadDoc(ctx context.Context, d *mongoDoc, snapshots map[int64][]byte) (err error) {
+	if d.Delta == nil {
+		return st.loadBlob(ctx, d)
+	}
+
+	base, ok := snapshots[d.Delta.Base]
+	if !ok {
+		base, err = st.snapshotBody(ctx, d.Name, d.Delta.Base)
+		if err != nil {
+			return
+		}
+		if snapshots != nil {
+			snapshots[d.Delta.Base] = base
+		}
+	}
+
+	var ops []deltaOp
+	err = json.Unmarshal(d.Delta.Ops, &ops)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal delta: %v", err)
+	}
+	body, err := applyDelta(base, ops)
+	if err != nil {
+		return fmt.Errorf("failed to apply delta: %v", err)
+	}
+
+	state := &State{}
+	err = json.Unmarshal(body, state)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal state: %v", err)
+	}
+	if d.State != nil {
+		state.MD5 = d.State.MD5
+	}
+	if d.Delta.Raw {
+		d.Raw = body
+	}
+	d.State = state
+	return
+}
+
+// snapshotBody returns the body of the snapshot of a serial
+func (st *MongoDBStorage) snapshotBody(ctx context.Context, name string, serial int64) (body []byte, err error) {
+	collection := st.client.Database("terradb").Collection("terraform_states")
+
+	var snap mongoDoc
+	err = collection.FindOne(ctx, bson.M{"name": name, "state.serial": serial}).Decode(&snap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve snapshot %d: %v", serial, err)
+	}
+	if snap.Delta != nil {
+		return nil, fmt.Errorf("serial %d is not a snapshot", serial)
+	}
+
+	err = st.loadBlob(ctx, &snap)
+	if err != nil {
+		return
+	}
+	body, _, err = mongoDocBody(&snap)
+	return
+}
+
+// materializeDeltas stores in full the serials based on a snapshot,
+// before the snapshot is overwritten
+func (st *MongoDBStorage) materializeDeltas(ctx context.Context, name string, serial int64) (err error) {
+	docs, err := st.findDocs(ctx, bson.M{"name": name, "delta.base": serial})
+	if err != nil {
+		return
+	}
+
+	snapshots := make(map[int64][]byte)
+	for _, d := range docs {
+		err = st.rewriteSerial(ctx, d, nil, snapshots)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// rewriteSerial stores an existing serial again,
+// as a delta against base if it is not nil, or in full
+func (st *MongoDBStorage) rewriteSerial(ctx context.Context, d *mongoDoc, base *mongoSnapshot, snapshots map[int64][]byte) (err error) {
+	err = st.loadDoc(ctx, d, snapshots)
+	if err != nil {
+		return fmt.Errorf("failed to load serial %d of %s: %v", d.State.Serial, d.Name, err)
+	}
+
+	state := *d.State
+	state.Raw = d.Raw
+	return st.writeSerial(ctx, d.Name, &state, d.Timestamp, d.Source, base)
+}
+
+// findDocs returns the documents matching filter
+func (st *MongoDBStorage) findDocs(ctx context.Context, filter bson.M, opts ...*options.FindOptions) (docs []*mongoDoc, err error) {
+	collection := st.client.Database("terradb").Collection("terraform_states")
+	cur, err := collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list states: %v", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var d mongoDoc
+		err = cur.Decode(&d)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode state: %v", err)
+		}
+		docs = append(docs, &d)
+	}
+	return docs, cur.Err()
+}
+
+// Compact re-bases the serials of all states, so that every state has
+// a snapshot every snapshot interval serials, and deltas in between.
+// When delta encoding is disabled, all serials are stored in full again.
+func (st *MongoDBStorage) Compact(ctx context.Context) (err error) {
+	collection := st.client.Database("terradb").Collection("terraform_states")
+	// Without delta encoding, only the states with deltas need to be compacted
+	filter := bson.M{}
+	if st.snapshotInterval <= 1 {
+		filter["delta"] = bson.M{"$ne": nil}
+	}
+	names, err := collection.Distinct(ctx, "name", filter)
+	if err != nil {
+		return fmt.Errorf("failed to list states: %v", err)
+	}
+
+	for _, n := range names {
+		name, ok := n.(string)
+		if !ok {
+			continue
+		}
+		err = st.compactState(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to compact %s: %v", name, err)
+		}
+	}
+	return
+}
+
+func (st *MongoDBStorage) compactState(ctx context.Context, name string) (err error) {
+	lease, err := st.takeWriteLease(ctx, name)
+	if err != nil {
+		return
+	}
+	defer lease.release()
+
+	docs, err := st.findDocs(ctx, bson.M{"name": name}, options.Find().SetSort(bson.M{"state.serial": 1}))
+	if err != nil {
+		return
+	}
+
+	// Plan the base of each serial, -1 meaning a snapshot
+	bases := make([]int64, len(docs))
+	var base int64
+	count := st.snapshotInterval
+	for i, d := range docs {
+		if st.snapshotInterval <= 1 || count >= st.snapshotInterval-1 {
+			bases[i] = -1
+			base = d.State.Serial
+			count = 0
+			continue
+		}
+		bases[i] = base
+		count++
+	}
+
+	// Deltas must be based on snapshots, so snapshots are written first.
+	// Deltas are then written from the newest, so that a former snapshot
+	// is only rewritten once the serials based on it have been.
+	snapshots := make(map[int64][]byte)
+	for i, d := range docs {
+		if bases[i] == -1 && d.Delta != nil {
+			err = st.rewriteSerial(ctx, d, nil, snapshots)
+			if err == nil {
+				err = lease.renew(ctx)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	rewritten := 0
+	for i := len(docs) - 1; i >= 0; i-- {
+		d := docs[i]
+		if bases[i] == -1 || (d.Delta != nil && d.Delta.Base == bases[i]) {
+			continue
+		}
+
+		body, ok := snapshots[bases[i]]
+		if !ok {
+			body, err = st.snapshotBody(ctx, name, bases[i])
+			if err != nil {
+				return
+			}
+			snapshots[bases[i]] = body
+		}
+
+		err = st.rewriteSerial(ctx, d, &mongoSnapshot{Serial: bases[i], Body: body}, snapshots)
+		if err == nil {
+			err = lease.renew(ctx)
+		}
+		if err != nil {
+			return
+		}
+		rewritten++
+	}
+
+	if rewritten > 0 {
+		log.WithFields(log.Fields{
+			"name":    name,
+			"serials": rewritten,
+		}).Info("Compacted state serials")
+	}
+	return
+}
+
+// DeltaStats returns the space saved by delta-encoded serials
+func (st *MongoDBStorage) DeltaStats(ctx context.Context) (stats DeltaStats, err error) {
+	collection := st.client.Database("terradb").Collection("terraform_states")
+	cur, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "serials", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "deltas", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$gt", Value: bson.A{"$delta", nil}}}, 1, 0,
+			}}}}}},
+			{Key: "fullbytes", Value: bson.D{{Key: "$sum", Value: "$delta.size"}}},
+			{Key: "deltabytes", Value: bson.D{{Key: "$sum", Value: "$delta.storedsize"}}},
+		}}},
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to compute delta stats: %v", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var res struct {
+			Serials    int64
+			Deltas     int64
+			FullBytes  int64
+			DeltaBytes int64
+		}
+		err = cur.Decode(&res)
+		if err != nil {
+			return stats, fmt.Errorf("failed to decode delta stats: %v", err)
+		}
+
+		stats.Serials = int(res.Serials)
+		stats.Deltas = int(res.Deltas)
+		stats.Snapshots = stats.Serials - stats.Deltas
+		stats.FullBytes = res.FullBytes
+		stats.DeltaBytes = res.DeltaBytes
+		stats.SavedBytes = res.FullBytes - res.DeltaBytes
+	}
+	return stats, cur.Err()
+}
+
+// mongoDocBody returns the body of a document stored in full:
+// the pushed document, or the Terraform state when it was not kept
+func mongoDocBody(d *mongoDoc) (body []byte, raw bool, err error) {
+	if d.Raw != nil {
+		return d.Raw, true, nil
+	}
+	body, err = TerraformStateJSON(*d.State)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal state: %v", err)
+	}
+	return body, false, nil
+}
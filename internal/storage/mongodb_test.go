@@ -0,0 +1,42 @@
+package storage_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/camptocamp/terradb/internal/storage"
+	"github.com/camptocamp/terradb/internal/storage/storagetest"
+)
+
+// TestMongoDBStorage runs against the server in TERRADB_TEST_MONGODB_URL,
+// whose terradb database is dropped before each test
+func TestMongoDBStorage(t *testing.T) {
+	url := os.Getenv("TERRADB_TEST_MONGODB_URL")
+	if url == "" {
+		t.Skip("TERRADB_TEST_MONGODB_URL is not set")
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		t.Fatalf("failed to connect to MongoDB: %v", err)
+	}
+	defer client.Disconnect(ctx)
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		err := client.Database("terradb").Drop(ctx)
+		if err != nil {
+			t.Fatalf("failed to drop database: %v", err)
+		}
+
+		st, err := storage.NewMongoDB(&storage.MongoDBConfig{URL: url})
+		if err != nil {
+			t.Fatalf("failed to open MongoDB storage: %v", err)
+		}
+		return st
+	})
+}
@@ -0,0 +1,1022 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	// Register the PostgreSQL driver for database/sql
+	_ "github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// PostgreSQLConfig stores the informations required to connect a PostgreSQL database.
+type PostgreSQLConfig struct {
+	URL      string
+	Username string
+	Password string
+}
+
+// PostgreSQLStorage stores the PostgreSQL client.
+type PostgreSQLStorage struct {
+	db *sql.DB
+}
+
+// postgresSchema creates the tables used by TerraDB:
+// - states holds the latest serial of each state and its deletion date
+// - serials holds every serial of every state, as JSONB along with the raw document
+// - locks holds the Terraform locks
+// - tokens holds the API tokens
+// - acls holds the ACLs
+// - audit holds the audit records, with the columns they are filtered on
+// - webhooks and deliveries hold the webhooks and their deliveries
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS states (
+	name       TEXT PRIMARY KEY,
+	serial     BIGINT NOT NULL,
+	deleted_at TIMESTAMP WITH TIME ZONE
+);
+
+ALTER TABLE states ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE IF NOT EXISTS serials (
+	name          TEXT NOT NULL,
+	serial        BIGINT NOT NULL,
+	last_modified TIMESTAMP WITH TIME ZONE NOT NULL,
+	source        TEXT NOT NULL,
+	state         JSONB NOT NULL,
+	raw           BYTEA,
+	PRIMARY KEY (name, serial)
+);
+
+ALTER TABLE serials ADD COLUMN IF NOT EXISTS raw BYTEA;
+
+CREATE TABLE IF NOT EXISTS locks (
+	name TEXT PRIMARY KEY,
+	lock JSONB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS tokens (
+	id    TEXT PRIMARY KEY,
+	token JSONB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS acls (
+	id  TEXT PRIMARY KEY,
+	acl JSONB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS audit (
+	id        TEXT PRIMARY KEY,
+	time      TIMESTAMP WITH TIME ZONE NOT NULL,
+	name      TEXT NOT NULL,
+	principal TEXT NOT NULL,
+	action    TEXT NOT NULL,
+	outcome   TEXT NOT NULL,
+	record    JSONB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	id      TEXT PRIMARY KEY,
+	webhook JSONB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS deliveries (
+	id         TEXT PRIMARY KEY,
+	webhook_id TEXT NOT NULL,
+	status     TEXT NOT NULL,
+	delivery   JSONB NOT NULL
+);
+`
+
+// NewPostgreSQL initializes a connection to the defined PostgreSQL instance
+// and creates the tables if required.
+func NewPostgreSQL(config *PostgreSQLConfig) (st *PostgreSQLStorage, err error) {
+	st = &PostgreSQLStorage{}
+
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return st, fmt.Errorf("failed to parse PostgreSQL URL: %v", err)
+	}
+
+	if config.Username != "" {
+		u.User = url.UserPassword(config.Username, config.Password)
+	}
+
+	st.db, err = sql.Open("postgres", u.String())
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = st.db.PingContext(ctx)
+	if err != nil {
+		return
+	}
+
+	_, err = st.db.ExecContext(ctx, postgresSchema)
+	if err != nil {
+		return st, fmt.Errorf("failed to create tables: %v", err)
+	}
+	return
+}
+
+// GetName returns the storage's name.
+func (*PostgreSQLStorage) GetName() string {
+	return "postgres"
+}
+
+// GetLockStatus returns a Terraform lock.
+func (st *PostgreSQLStorage) GetLockStatus(ctx context.Context, name string) (lockStatus LockInfo, err error) {
+	var data []byte
+	err = st.db.QueryRowContext(ctx,
+		`SELECT lock FROM locks WHERE name = $1`, name,
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return lockStatus, ErrNoDocuments
+	} else if err != nil {
+		return lockStatus, fmt.Errorf("failed to retrieve lock: %v", err)
+	}
+
+	err = json.Unmarshal(data, &lockStatus)
+	return
+}
+
+// postgresLockAttempts is how many times LockState tries to take a lock
+// which is released as soon as it is found held
+const postgresLockAttempts = 5
+
+// LockState locks a Terraform state.
+// If the state is already locked, it returns ErrLocked
+// along with the current lock.
+func (st *PostgreSQLStorage) LockState(ctx context.Context, name string, lockData LockInfo) (lockStatus LockInfo, err error) {
+	// State file uses the same key as lock
+	lockData.Path = name
+
+	data, err := json.Marshal(lockData)
+	if err != nil {
+		return lockStatus, fmt.Errorf("failed to marshal lock: %v", err)
+	}
+
+	for attempt := 0; attempt < postgresLockAttempts; attempt++ {
+		res, err := st.db.ExecContext(ctx,
+			`INSERT INTO locks (name, lock) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING`,
+			name, string(data),
+		)
+		if err != nil {
+			return lockStatus, fmt.Errorf("failed to insert lock: %v", err)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return lockStatus, fmt.Errorf("failed to insert lock: %v", err)
+		}
+		if n == 1 {
+			return lockData, nil
+		}
+
+		lockStatus, err = st.GetLockStatus(ctx, name)
+		if err == nil {
+			return lockStatus, ErrLocked
+		} else if err != ErrNoDocuments {
+			return lockStatus, fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+		}
+		// The lock was released in the meantime, try again
+	}
+	return lockStatus, fmt.Errorf("failed to lock %s: the lock kept changing after %d attempts", name, postgresLockAttempts)
+}
+
+// UnlockState unlocks a Terraform state.
+// If the state is locked with another lock ID, it returns ErrLockIDMismatch
+// along with the current lock.
+func (st *PostgreSQLStorage) UnlockState(ctx context.Context, name string, lockData LockInfo) (lockStatus LockInfo, err error) {
+	res, err := st.db.ExecContext(ctx,
+		`DELETE FROM locks WHERE name = $1 AND lock->>'id' = $2`,
+		name, lockData.ID,
+	)
+	if err != nil {
+		return lockStatus, fmt.Errorf("failed to remove lock: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return lockStatus, fmt.Errorf("failed to remove lock: %v", err)
+	}
+	if n == 1 {
+		return lockData, nil
+	}
+
+	lockStatus, err = st.GetLockStatus(ctx, name)
+	if err == ErrNoDocuments {
+		// Not locked
+		return lockStatus, nil
+	} else if err != nil {
+		return lockStatus, fmt.Errorf("failed to retrieve lock for %s: %v", name, err)
+	}
+	return lockStatus, ErrLockIDMismatch
+}
+
+// ForceUnlockState unlocks a Terraform state, whatever its lock ID,
+// and returns the removed lock.
+func (st *PostgreSQLStorage) ForceUnlockState(ctx context.Context, name string) (lockStatus LockInfo, err error) {
+	var data []byte
+	err = st.db.QueryRowContext(ctx,
+		`DELETE FROM locks WHERE name = $1 RETURNING lock`, name,
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return lockStatus, ErrNoDocuments
+	} else if err != nil {
+		return lockStatus, fmt.Errorf("failed to remove lock: %v", err)
+	}
+
+	err = json.Unmarshal(data, &lockStatus)
+	return
+}
+
+// RemoveState moves the Terraform states to the trash.
+func (st *PostgreSQLStorage) RemoveState(ctx context.Context, name string) (err error) {
+	res, err := st.db.ExecContext(ctx,
+		`UPDATE states SET deleted_at = now() WHERE name = $1 AND deleted_at IS NULL`, name,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to remove state: %v", err)
+	}
+	return postgresExpectRow(res)
+}
+
+// ListTrash returns the states in the trash
+func (st *PostgreSQLStorage) ListTrash(ctx context.Context, pageNum, pageSize int) (coll DeletedStateCollection, err error) {
+	var total int
+	err = st.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM states WHERE deleted_at IS NOT NULL`,
+	).Scan(&total)
+	if err != nil {
+		return coll, fmt.Errorf("failed to count deleted states: %v", err)
+	}
+	coll.Metadata = paginationMetadata(total, pageNum)
+
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT name, serial, deleted_at FROM states
+		WHERE deleted_at IS NOT NULL
+		ORDER BY name
+		LIMIT $1 OFFSET $2`,
+		pageSize, pageSize*(pageNum-1),
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list deleted states: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var deleted DeletedState
+		err = rows.Scan(&deleted.Name, &deleted.Serial, &deleted.DeletedAt)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode deleted states: %v", err)
+		}
+		deleted.DeletedAt = deleted.DeletedAt.UTC()
+		coll.Data = append(coll.Data, &deleted)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// RestoreState moves Terraform states back from the trash.
+func (st *PostgreSQLStorage) RestoreState(ctx context.Context, name string) (err error) {
+	res, err := st.db.ExecContext(ctx,
+		`UPDATE states SET deleted_at = NULL WHERE name = $1 AND deleted_at IS NOT NULL`, name,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to restore state: %v", err)
+	}
+	return postgresExpectRow(res)
+}
+
+// PurgeState permanently removes the Terraform states from the trash,
+// along with their lock.
+func (st *PostgreSQLStorage) PurgeState(ctx context.Context, name string) (err error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`DELETE FROM states WHERE name = $1 AND deleted_at IS NOT NULL`, name,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to purge state: %v", err)
+	}
+	err = postgresExpectRow(res)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM serials WHERE name = $1`, name)
+	if err != nil {
+		return fmt.Errorf("failed to purge state serials: %v", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM locks WHERE name = $1`, name)
+	if err != nil {
+		return fmt.Errorf("failed to remove lock: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// ListStates returns all state names from TerraDB
+func (st *PostgreSQLStorage) ListStates(ctx context.Context, prefix string, pageNum, pageSize int) (coll StateCollection, err error) {
+	// Comparing the start of the names avoids escaping LIKE wildcards
+	var total int
+	err = st.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM states WHERE deleted_at IS NULL AND left(name, length($1)) = $1`,
+		prefix,
+	).Scan(&total)
+	if err != nil {
+		return coll, fmt.Errorf("failed to count states: %v", err)
+	}
+	coll.Metadata = paginationMetadata(total, pageNum)
+
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT s.name, s.last_modified, s.state, s.raw, l.lock
+		FROM states
+		JOIN serials s ON s.name = states.name AND s.serial = states.serial
+		LEFT JOIN locks l ON l.name = states.name
+		WHERE states.deleted_at IS NULL AND left(states.name, length($3)) = $3
+		ORDER BY states.name
+		LIMIT $1 OFFSET $2`,
+		pageSize, pageSize*(pageNum-1), prefix,
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list states: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var lock []byte
+		state, err := scanPostgresState(rows, &lock)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode states: %v", err)
+		}
+
+		// Init value required because of omitempty
+		state.Locked = false
+		if lock != nil {
+			err = json.Unmarshal(lock, &state.LockInfo)
+			if err != nil {
+				return coll, fmt.Errorf("failed to retrieve lock for %s: %v", state.Name, err)
+			}
+			state.Locked = true
+		} else {
+			log.WithFields(log.Fields{
+				"name": state.Name,
+			}).Info("Did not find lock info")
+		}
+		coll.Data = append(coll.Data, state)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// GetState retrieves a Terraform state, at a given serial.
+// If serial is 0, it gets the latest serial
+func (st *PostgreSQLStorage) GetState(ctx context.Context, name string, serial int) (state State, err error) {
+	var row *sql.Row
+	if serial == 0 {
+		row = st.db.QueryRowContext(ctx, `
+			SELECT s.name, s.last_modified, s.state, s.raw
+			FROM states
+			JOIN serials s ON s.name = states.name AND s.serial = states.serial
+			WHERE states.name = $1 AND states.deleted_at IS NULL`,
+			name,
+		)
+	} else {
+		row = st.db.QueryRowContext(ctx, `
+			SELECT s.name, s.last_modified, s.state, s.raw
+			FROM states
+			JOIN serials s ON s.name = states.name
+			WHERE states.name = $1 AND states.deleted_at IS NULL AND s.serial = $2`,
+			name, serial,
+		)
+	}
+
+	s, err := scanPostgresState(row, nil)
+	if err == sql.ErrNoRows {
+		err = ErrNoDocuments
+		return
+	} else if err != nil {
+		err = fmt.Errorf("failed to decode state: %v", err)
+		return
+	}
+	state = *s
+
+	// Init value required because of omitempty
+	state.Locked = false
+	state.LockInfo, err = st.GetLockStatus(ctx, state.Name)
+	if err == nil {
+		state.Locked = true
+	} else if err == ErrNoDocuments {
+		log.WithFields(log.Fields{
+			"name": state.Name,
+		}).Info("Did not find lock info")
+		// Reset err
+		err = nil
+	} else {
+		return state, fmt.Errorf("failed to retrieve lock for %s: %v", state.Name, err)
+	}
+	return
+}
+
+// InsertState adds a Terraform state to the database,
+// if the conditions hold. They are checked in the same transaction,
+// under a lock on the state name, since its row may not exist yet.
+func (st *PostgreSQLStorage) InsertState(ctx context.Context, doc State, timestamp, source, name string, cond InsertConditions) (err error) {
+	lastModified, err := time.Parse("20060102150405", timestamp)
+	if err != nil {
+		return fmt.Errorf("failed to convert timestamp: %v", err)
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, name)
+	if err != nil {
+		return fmt.Errorf("failed to lock state: %v", err)
+	}
+
+	// Lock the state row, so that it cannot be moved to the trash meanwhile
+	var deletedAt *time.Time
+	err = tx.QueryRowContext(ctx,
+		`SELECT deleted_at FROM states WHERE name = $1 FOR UPDATE`, name,
+	).Scan(&deletedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to retrieve state: %v", err)
+	}
+	if deletedAt != nil {
+		return ErrStateDeleted
+	}
+
+	var lock *LockInfo
+	var lockData []byte
+	err = tx.QueryRowContext(ctx, `SELECT lock FROM locks WHERE name = $1`, name).Scan(&lockData)
+	if err == nil {
+		lock = &LockInfo{}
+		err = json.Unmarshal(lockData, lock)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal lock: %v", err)
+		}
+	} else if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to retrieve lock: %v", err)
+	}
+
+	latest, err := scanPostgresState(tx.QueryRowContext(ctx, `
+		SELECT s.name, s.last_modified, s.state, s.raw
+		FROM states
+		JOIN serials s ON s.name = states.name AND s.serial = states.serial
+		WHERE states.name = $1`,
+		name,
+	), nil)
+	if err == sql.ErrNoRows {
+		latest = nil
+	} else if err != nil {
+		return fmt.Errorf("failed to retrieve latest state: %v", err)
+	}
+	err = cond.check(lock, latest, doc)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO serials (name, serial, last_modified, source, state, raw)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (name, serial) DO UPDATE
+		SET last_modified = EXCLUDED.last_modified,
+		    source = EXCLUDED.source,
+		    state = EXCLUDED.state,
+		    raw = EXCLUDED.raw`,
+		name, doc.Serial, lastModified, source, string(data), doc.Raw,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert state: %v", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO states (name, serial) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE
+		SET serial = GREATEST(states.serial, EXCLUDED.serial)`,
+		name, doc.Serial,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update latest serial: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// ListStateSerials returns all state serials with a given name.
+func (st *PostgreSQLStorage) ListStateSerials(ctx context.Context, name string, pageNum, pageSize int) (coll StateCollection, err error) {
+	return st.listSerials(ctx, name, false, pageNum, pageSize)
+}
+
+// listTrashedSerials returns the serials of a state in the trash.
+func (st *PostgreSQLStorage) listTrashedSerials(ctx context.Context, name string, pageNum, pageSize int) (coll StateCollection, err error) {
+	return st.listSerials(ctx, name, true, pageNum, pageSize)
+}
+
+// replaceTrashedSerial replaces a serial of a state in the trash,
+// which stays in the trash.
+func (st *PostgreSQLStorage) replaceTrashedSerial(ctx context.Context, doc State, timestamp, source, name string) (err error) {
+	lastModified, err := time.Parse("20060102150405", timestamp)
+	if err != nil {
+		return fmt.Errorf("failed to convert timestamp: %v", err)
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+
+	res, err := st.db.ExecContext(ctx, `
+		UPDATE serials s
+		SET last_modified = $3, source = $4, state = $5, raw = $6
+		FROM states
+		WHERE states.name = s.name AND s.name = $1 AND s.serial = $2
+		  AND states.deleted_at IS NOT NULL`,
+		name, doc.Serial, lastModified, source, string(data), doc.Raw,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to replace state: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to replace state: %v", err)
+	}
+	if n == 0 {
+		return ErrNoDocuments
+	}
+	return
+}
+
+// listSerials returns the serials of a state, if it is in the trash or not
+func (st *PostgreSQLStorage) listSerials(ctx context.Context, name string, trashed bool, pageNum, pageSize int) (coll StateCollection, err error) {
+	var total int
+	err = st.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM serials s
+		JOIN states ON states.name = s.name
+		WHERE s.name = $1 AND (states.deleted_at IS NOT NULL) = $2`,
+		name, trashed,
+	).Scan(&total)
+	if err != nil {
+		return coll, fmt.Errorf("failed to count states: %v", err)
+	}
+	coll.Metadata = paginationMetadata(total, pageNum)
+
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT s.name, s.last_modified, s.state, s.raw
+		FROM serials s
+		JOIN states ON states.name = s.name
+		WHERE s.name = $1 AND (states.deleted_at IS NOT NULL) = $2
+		ORDER BY s.serial
+		LIMIT $3 OFFSET $4`,
+		name, trashed, pageSize, pageSize*(pageNum-1),
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list states: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		state, err := scanPostgresState(rows, nil)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode states: %v", err)
+		}
+		coll.Data = append(coll.Data, state)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// GetResource retrieves a Terraform resource given a state, module and name
+func (st *PostgreSQLStorage) GetResource(ctx context.Context, state, module, name string) (res Resource, err error) {
+	s, err := st.GetState(ctx, state, 0)
+	if err == ErrNoDocuments {
+		return
+	} else if err != nil {
+		return res, fmt.Errorf("failed to get resource: %v", err)
+	}
+
+	res, err = getResource(s, module, name)
+	return
+}
+
+// InsertToken adds an API token, or replaces the token with the same ID.
+func (st *PostgreSQLStorage) InsertToken(ctx context.Context, token Token) (err error) {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token: %v", err)
+	}
+
+	_, err = st.db.ExecContext(ctx,
+		`INSERT INTO tokens (id, token) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET token = EXCLUDED.token`,
+		token.ID, string(data),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert token: %v", err)
+	}
+	return
+}
+
+// GetToken returns an API token by ID
+func (st *PostgreSQLStorage) GetToken(ctx context.Context, id string) (token Token, err error) {
+	var data []byte
+	err = st.db.QueryRowContext(ctx,
+		`SELECT token FROM tokens WHERE id = $1`, id,
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return token, ErrNoDocuments
+	} else if err != nil {
+		return token, fmt.Errorf("failed to retrieve token: %v", err)
+	}
+
+	err = json.Unmarshal(data, &token)
+	return
+}
+
+// ListTokens returns the API tokens
+func (st *PostgreSQLStorage) ListTokens(ctx context.Context, pageNum, pageSize int) (coll TokenCollection, err error) {
+	var total int
+	err = st.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM tokens`).Scan(&total)
+	if err != nil {
+		return coll, fmt.Errorf("failed to count tokens: %v", err)
+	}
+	coll.Metadata = paginationMetadata(total, pageNum)
+
+	rows, err := st.db.QueryContext(ctx,
+		`SELECT token FROM tokens ORDER BY id LIMIT $1 OFFSET $2`,
+		pageSize, pageSize*(pageNum-1),
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list tokens: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode tokens: %v", err)
+		}
+
+		var token Token
+		err = json.Unmarshal(data, &token)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal token: %v", err)
+		}
+		coll.Data = append(coll.Data, &token)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// RemoveToken revokes an API token
+func (st *PostgreSQLStorage) RemoveToken(ctx context.Context, id string) (err error) {
+	res, err := st.db.ExecContext(ctx, `DELETE FROM tokens WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to remove token: %v", err)
+	}
+	return postgresExpectRow(res)
+}
+
+// InsertACL adds an ACL, or replaces the ACL with the same ID.
+func (st *PostgreSQLStorage) InsertACL(ctx context.Context, acl ACL) (err error) {
+	data, err := json.Marshal(acl)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ACL: %v", err)
+	}
+
+	_, err = st.db.ExecContext(ctx,
+		`INSERT INTO acls (id, acl) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET acl = EXCLUDED.acl`,
+		acl.ID, string(data),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert ACL: %v", err)
+	}
+	return
+}
+
+// ListACLs returns the ACLs
+func (st *PostgreSQLStorage) ListACLs(ctx context.Context, pageNum, pageSize int) (coll ACLCollection, err error) {
+	var total int
+	err = st.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM acls`).Scan(&total)
+	if err != nil {
+		return coll, fmt.Errorf("failed to count ACLs: %v", err)
+	}
+	coll.Metadata = paginationMetadata(total, pageNum)
+
+	rows, err := st.db.QueryContext(ctx,
+		`SELECT acl FROM acls ORDER BY id LIMIT $1 OFFSET $2`,
+		pageSize, pageSize*(pageNum-1),
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list ACLs: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode ACLs: %v", err)
+		}
+
+		var acl ACL
+		err = json.Unmarshal(data, &acl)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal ACL: %v", err)
+		}
+		coll.Data = append(coll.Data, &acl)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// RemoveACL removes an ACL
+func (st *PostgreSQLStorage) RemoveACL(ctx context.Context, id string) (err error) {
+	res, err := st.db.ExecContext(ctx, `DELETE FROM acls WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to remove ACL: %v", err)
+	}
+	return postgresExpectRow(res)
+}
+
+// InsertAuditRecord adds an audit record
+func (st *PostgreSQLStorage) InsertAuditRecord(ctx context.Context, record AuditRecord) (err error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %v", err)
+	}
+
+	_, err = st.db.ExecContext(ctx,
+		`INSERT INTO audit (id, time, name, principal, action, outcome, record)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		record.ID, record.Time, record.Name, record.Principal,
+		record.Action, record.Outcome, string(data),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert audit record: %v", err)
+	}
+	return
+}
+
+// postgresAuditFilter selects the audit records matching
+// the filter passed as the first 6 parameters of a query.
+// Empty strings and NULL times select all the records.
+const postgresAuditFilter = `
+	($1 = '' OR name = $1) AND
+	($2 = '' OR principal = $2) AND
+	($3 = '' OR action = $3) AND
+	($4 = '' OR outcome = $4) AND
+	($5::TIMESTAMP WITH TIME ZONE IS NULL OR time >= $5) AND
+	($6::TIMESTAMP WITH TIME ZONE IS NULL OR time <= $6)`
+
+// ListAuditRecords returns the audit records selected by filter
+func (st *PostgreSQLStorage) ListAuditRecords(ctx context.Context, filter AuditFilter, pageNum, pageSize int) (coll AuditCollection, err error) {
+	args := []interface{}{
+		filter.Name, filter.Principal, filter.Action, filter.Outcome,
+		postgresNullTime(filter.Since), postgresNullTime(filter.Until),
+	}
+
+	var total int
+	err = st.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM audit WHERE`+postgresAuditFilter, args...,
+	).Scan(&total)
+	if err != nil {
+		return coll, fmt.Errorf("failed to count audit records: %v", err)
+	}
+	coll.Metadata = paginationMetadata(total, pageNum)
+
+	rows, err := st.db.QueryContext(ctx,
+		`SELECT record FROM audit WHERE`+postgresAuditFilter+`
+		ORDER BY id DESC LIMIT $7 OFFSET $8`,
+		append(args, pageSize, pageSize*(pageNum-1))...,
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list audit records: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode audit records: %v", err)
+		}
+
+		var record AuditRecord
+		err = json.Unmarshal(data, &record)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal audit record: %v", err)
+		}
+		coll.Data = append(coll.Data, &record)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// InsertWebhook adds a webhook, or replaces the webhook with the same ID.
+func (st *PostgreSQLStorage) InsertWebhook(ctx context.Context, webhook Webhook) (err error) {
+	data, err := json.Marshal(webhook)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook: %v", err)
+	}
+
+	_, err = st.db.ExecContext(ctx,
+		`INSERT INTO webhooks (id, webhook) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET webhook = EXCLUDED.webhook`,
+		webhook.ID, string(data),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert webhook: %v", err)
+	}
+	return
+}
+
+// ListWebhooks returns the webhooks
+func (st *PostgreSQLStorage) ListWebhooks(ctx context.Context, pageNum, pageSize int) (coll WebhookCollection, err error) {
+	var total int
+	err = st.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM webhooks`).Scan(&total)
+	if err != nil {
+		return coll, fmt.Errorf("failed to count webhooks: %v", err)
+	}
+	coll.Metadata = paginationMetadata(total, pageNum)
+
+	rows, err := st.db.QueryContext(ctx,
+		`SELECT webhook FROM webhooks ORDER BY id LIMIT $1 OFFSET $2`,
+		pageSize, pageSize*(pageNum-1),
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list webhooks: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode webhooks: %v", err)
+		}
+
+		var webhook Webhook
+		err = json.Unmarshal(data, &webhook)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal webhook: %v", err)
+		}
+		coll.Data = append(coll.Data, &webhook)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// RemoveWebhook removes a webhook
+func (st *PostgreSQLStorage) RemoveWebhook(ctx context.Context, id string) (err error) {
+	res, err := st.db.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to remove webhook: %v", err)
+	}
+	return postgresExpectRow(res)
+}
+
+// InsertDelivery adds a webhook delivery, or replaces the delivery with the same ID.
+func (st *PostgreSQLStorage) InsertDelivery(ctx context.Context, delivery Delivery) (err error) {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %v", err)
+	}
+
+	_, err = st.db.ExecContext(ctx,
+		`INSERT INTO deliveries (id, webhook_id, status, delivery) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET status = EXCLUDED.status, delivery = EXCLUDED.delivery`,
+		delivery.ID, delivery.WebhookID, delivery.Status, string(data),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert delivery: %v", err)
+	}
+	return
+}
+
+// ListDeliveries returns the webhook deliveries selected by filter
+func (st *PostgreSQLStorage) ListDeliveries(ctx context.Context, filter DeliveryFilter, pageNum, pageSize int) (coll DeliveryCollection, err error) {
+	const where = ` WHERE ($1 = '' OR webhook_id = $1) AND ($2 = '' OR status = $2)`
+
+	var total int
+	err = st.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM deliveries`+where, filter.WebhookID, filter.Status,
+	).Scan(&total)
+	if err != nil {
+		return coll, fmt.Errorf("failed to count deliveries: %v", err)
+	}
+	coll.Metadata = paginationMetadata(total, pageNum)
+
+	rows, err := st.db.QueryContext(ctx,
+		`SELECT delivery FROM deliveries`+where+` ORDER BY id DESC LIMIT $3 OFFSET $4`,
+		filter.WebhookID, filter.Status, pageSize, pageSize*(pageNum-1),
+	)
+	if err != nil {
+		return coll, fmt.Errorf("failed to list deliveries: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return coll, fmt.Errorf("failed to decode deliveries: %v", err)
+		}
+
+		var delivery Delivery
+		err = json.Unmarshal(data, &delivery)
+		if err != nil {
+			return coll, fmt.Errorf("failed to unmarshal delivery: %v", err)
+		}
+		coll.Data = append(coll.Data, &delivery)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// postgresNullTime returns NULL for the zero time
+func postgresNullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// postgresExpectRow returns ErrNoDocuments
+// if a statement did not affect any row.
+func postgresExpectRow(res sql.Result) (err error) {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count affected rows: %v", err)
+	}
+	if n == 0 {
+		return ErrNoDocuments
+	}
+	return
+}
+
+// postgresScanner is implemented by both *sql.Row and *sql.Rows
+type postgresScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanPostgresState decodes a (name, last_modified, state, raw[, lock]) row.
+// The lock column is only scanned when lock is not nil.
+func scanPostgresState(row postgresScanner, lock *[]byte) (state *State, err error) {
+	var name string
+	var lastModified time.Time
+	var data, raw []byte
+
+	dest := []interface{}{&name, &lastModified, &data, &raw}
+	if lock != nil {
+		dest = append(dest, lock)
+	}
+
+	err = row.Scan(dest...)
+	if err != nil {
+		return
+	}
+
+	state = &State{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return state, fmt.Errorf("failed to unmarshal state: %v", err)
+	}
+	state.Raw = raw
+	state.Name = name
+	state.LastModified = lastModified.UTC()
+	return
+}
@@ -0,0 +1,38 @@
+package storage_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/camptocamp/terradb/internal/storage"
+	"github.com/camptocamp/terradb/internal/storage/storagetest"
+)
+
+// TestPostgreSQLStorage runs against the database in TERRADB_TEST_POSTGRES_URL,
+// whose TerraDB tables are dropped before each test
+func TestPostgreSQLStorage(t *testing.T) {
+	url := os.Getenv("TERRADB_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("TERRADB_TEST_POSTGRES_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatalf("failed to connect to PostgreSQL: %v", err)
+	}
+	defer db.Close()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		_, err := db.Exec(`DROP TABLE IF EXISTS states, serials, locks, tokens, acls, audit, webhooks, deliveries`)
+		if err != nil {
+			t.Fatalf("failed to drop tables: %v", err)
+		}
+
+		st, err := storage.NewPostgreSQL(&storage.PostgreSQLConfig{URL: url})
+		if err != nil {
+			t.Fatalf("failed to open PostgreSQL storage: %v", err)
+		}
+		return st
+	})
+}
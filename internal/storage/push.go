@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotLocked returns an error when trying to write a state
+// which must be locked first
+var ErrNotLocked = errors.New("State is not locked")
+
+// InsertConditions are the conditions under which InsertState writes
+// a serial. Storages check them atomically with the write, so that
+// concurrent pushes cannot both pass them.
+// The zero value writes the serial unconditionally.
+type InsertConditions struct {
+	// CheckLock requires the state to be unlocked, or locked with LockID,
+	// or else InsertState returns ErrLocked
+	CheckLock bool
+	LockID    string
+	// RequireLock also requires the state to be locked,
+	// or else InsertState returns ErrNotLocked
+	RequireLock bool
+
+	// CheckHistory requires the serial to follow the latest serial,
+	// or else InsertState returns a *ConflictError
+	CheckHistory bool
+}
+
+// Reasons of the conflicts
+const (
+	ConflictLineageMismatch  = "lineage_mismatch"
+	ConflictSerialRegression = "serial_regression"
+	ConflictSerialContent    = "serial_content_mismatch"
+)
+
+// ConflictError is returned by InsertState
+// when a serial would rewrite the history of a state
+type ConflictError struct {
+	Reason         string `json:"reason"`
+	Message        string `json:"message"`
+	CurrentSerial  int64  `json:"current_serial"`
+	CurrentLineage string `json:"current_lineage"`
+	PushedSerial   int64  `json:"pushed_serial"`
+	PushedLineage  string `json:"pushed_lineage"`
+}
+
+func (e *ConflictError) Error() string {
+	return e.Message
+}
+
+// check checks the conditions against the current lock and latest serial
+// of a state, which are nil when the state is not locked or does not exist
+func (c InsertConditions) check(lock *LockInfo, latest *State, doc State) error {
+	if c.CheckLock || c.RequireLock {
+		if lock == nil && c.RequireLock {
+			return ErrNotLocked
+		}
+		if lock != nil && lock.ID != c.LockID {
+			return ErrLocked
+		}
+	}
+
+	if c.CheckHistory && latest != nil {
+		if conflict := checkHistory(*latest, doc); conflict != nil {
+			return conflict
+		}
+	}
+	return nil
+}
+
+// checkHistory checks that a pushed state can follow the current latest state:
+// it must have the same lineage, and a greater serial. Pushing the current
+// serial again is only accepted with the same content.
+func checkHistory(current, pushed State) *ConflictError {
+	conflict := &ConflictError{
+		CurrentSerial:  current.Serial,
+		CurrentLineage: current.Lineage,
+		PushedSerial:   pushed.Serial,
+		PushedLineage:  pushed.Lineage,
+	}
+
+	switch {
+	case current.Lineage != "" && pushed.Lineage != current.Lineage:
+		conflict.Reason = ConflictLineageMismatch
+		conflict.Message = fmt.Sprintf("lineage %s does not match the current lineage %s",
+			pushed.Lineage, current.Lineage)
+	case pushed.Serial < current.Serial:
+		conflict.Reason = ConflictSerialRegression
+		conflict.Message = fmt.Sprintf("serial %d is older than the current serial %d",
+			pushed.Serial, current.Serial)
+	case pushed.Serial == current.Serial && !sameStateContent(current, pushed):
+		conflict.Reason = ConflictSerialContent
+		conflict.Message = fmt.Sprintf("serial %d already exists with a different content",
+			pushed.Serial)
+	default:
+		return nil
+	}
+	return conflict
+}
+
+// sameStateContent compares two states, ignoring TerraDB's own fields.
+// Encrypted states can only be compared by their checksums.
+func sameStateContent(a, b State) bool {
+	if a.MD5 != "" && a.MD5 == b.MD5 {
+		return true
+	}
+	if a.Encryption != nil || b.Encryption != nil {
+		return false
+	}
+
+	for _, s := range []*State{&a, &b} {
+		s.Name = ""
+		s.LastModified = time.Time{}
+		s.Locked = false
+		s.LockInfo = LockInfo{}
+		s.MD5 = ""
+	}
+
+	da, errA := json.Marshal(a)
+	db, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(da, db)
+}
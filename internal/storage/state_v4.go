@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+/*
+ * The types below mirror the version 4 state format,
+ * written by Terraform 0.12+ and OpenTofu.
+ * Attribute values are kept as raw JSON, since their types
+ * depend on the provider schemas.
+ */
+
+// ResourceV4 is a resource of a version 4 state,
+// with all its instances
+type ResourceV4 struct {
+	// Module is the module address, empty for the root module
+	Module string `json:"module,omitempty"`
+
+	// Mode is either "managed" or "data"
+	Mode     string `json:"mode"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	EachMode string `json:"each,omitempty"`
+	Provider string `json:"provider"`
+
+	Instances []*InstanceV4 `json:"instances"`
+}
+
+// InstanceV4 is an instance of a version 4 resource
+type InstanceV4 struct {
+	// IndexKey is the count index or for_each key of the instance
+	IndexKey json.RawMessage `json:"index_key,omitempty"`
+	Status   string          `json:"status,omitempty"`
+	Deposed  string          `json:"deposed,omitempty"`
+
+	SchemaVersion       uint64            `json:"schema_version"`
+	Attributes          json.RawMessage   `json:"attributes,omitempty"`
+	AttributesFlat      map[string]string `json:"attributes_flat,omitempty"`
+	SensitiveAttributes json.RawMessage   `json:"sensitive_attributes,omitempty"`
+
+	IdentitySchemaVersion *uint64         `json:"identity_schema_version,omitempty"`
+	Identity              json.RawMessage `json:"identity,omitempty"`
+
+	// Private is base64-encoded provider data
+	Private string `json:"private,omitempty"`
+
+	Dependencies        []string `json:"dependencies,omitempty"`
+	CreateBeforeDestroy bool     `json:"create_before_destroy,omitempty"`
+}
+
+// OutputV4 is a root module output of a version 4 state
+type OutputV4 struct {
+	Value     json.RawMessage `json:"value"`
+	Type      json.RawMessage `json:"type"`
+	Sensitive bool            `json:"sensitive,omitempty"`
+}
+
+// Resource modes of version 4 states
+const (
+	ResourceModeManaged = "managed"
+	ResourceModeData    = "data"
+)
+
+// Address returns the address of the resource within its module,
+// as used by Terraform, e.g. aws_instance.foo or data.aws_ami.bar
+func (r *ResourceV4) Address() string {
+	addr := r.Type + "." + r.Name
+	if r.Mode == ResourceModeData {
+		addr = "data." + addr
+	}
+	return addr
+}
+
+// getResourceV4 looks up a resource by module and address.
+// The root module is named "root", as in version 3 states, and other
+// modules can be named with or without their "module." prefix.
+func getResourceV4(resources []*ResourceV4, module, name string) *ResourceV4 {
+	if module == "root" {
+		module = ""
+	} else if !strings.HasPrefix(module, "module.") {
+		module = "module." + module
+	}
+
+	for _, r := range resources {
+		if r.Module == module && r.Address() == name {
+			return r
+		}
+	}
+	return nil
+}
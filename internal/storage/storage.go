@@ -1,7 +1,11 @@
 package storage
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/terraform/terraform"
@@ -16,6 +20,17 @@ type State struct {
 	Locked   bool     `json:"locked"`
 	LockInfo LockInfo `json:"lock"`
 
+	// Raw is the document exactly as pushed by Terraform,
+	// and MD5 its base64-encoded MD5 checksum.
+	// States stored before raw documents were kept have neither.
+	// Storages which encode State keep Raw apart, not to store it twice.
+	Raw []byte `json:"-" bson:"-"`
+	MD5 string `json:"md5,omitempty"`
+
+	// Encryption holds the body of the state when it is stored encrypted,
+	// the other fields then only hold the state metadata
+	Encryption *EncryptedBody `json:"encryption,omitempty"`
+
 	/*
 	 * All fields below are copied from Terraform's code
 	 * for compatibility
@@ -49,8 +64,70 @@ type State struct {
 	// configuration.
 	Backend *terraform.BackendState `json:"backend,omitempty"`
 
-	// Modules contains all the modules in a breadth-first order
-	Modules []*terraform.ModuleState `json:"modules"`
+	// Modules contains all the modules in a breadth-first order.
+	// It is only used by version 3 states.
+	Modules []*terraform.ModuleState `json:"modules,omitempty"`
+
+	// Outputs, Resources and CheckResults are only used by version 4 states
+	Outputs      map[string]*OutputV4 `json:"outputs,omitempty"`
+	Resources    []*ResourceV4        `json:"resources,omitempty"`
+	CheckResults json.RawMessage      `json:"check_results,omitempty"`
+}
+
+// terradbFields are the State fields which are not part of Terraform states
+var terradbFields = []string{"name", "last_modified", "locked", "lock", "md5"}
+
+// Document returns the state as Terraform pushed it. If the raw document
+// was not kept, the state is marshaled without TerraDB's own fields.
+func (s *State) Document() ([]byte, error) {
+	if s.Raw != nil {
+		return s.Raw, nil
+	}
+	return TerraformStateJSON(*s)
+}
+
+// TerraformStateJSON marshals a state without TerraDB's own fields,
+// so that the result is a plain Terraform state.
+func TerraformStateJSON(doc State) ([]byte, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range terradbFields {
+		delete(fields, f)
+	}
+
+	return json.MarshalIndent(fields, "", "    ")
+}
+
+// Supported state format versions
+const (
+	StateVersion3 = 3
+	StateVersion4 = 4
+)
+
+// CheckVersion returns an error if the state format version
+// is not supported, or does not match the state content.
+func (s *State) CheckVersion() error {
+	switch s.Version {
+	case StateVersion3:
+		if len(s.Resources) > 0 || len(s.Outputs) > 0 {
+			return fmt.Errorf("version %d state has version %d resources or outputs", s.Version, StateVersion4)
+		}
+	case StateVersion4:
+		if len(s.Modules) > 0 {
+			return fmt.Errorf("version %d state has version %d modules", s.Version, StateVersion3)
+		}
+	default:
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	return nil
 }
 
 // Metadata is a metadata struct
@@ -59,12 +136,67 @@ type Metadata struct {
 	Page  int `json:"page"`
 }
 
+// paginationMetadata returns the metadata of a page of results,
+// mimicking the output of MongoDB's $facet stage: no metadata at all
+// when there are no results.
+func paginationMetadata(total, pageNum int) []*Metadata {
+	if total == 0 {
+		return []*Metadata{}
+	}
+	return []*Metadata{
+		{
+			Total: total,
+			Page:  pageNum,
+		},
+	}
+}
+
+// paginationBounds returns the slice bounds of a page
+// within a list of total results.
+func paginationBounds(total, pageNum, pageSize int) (start, end int) {
+	start = pageSize * (pageNum - 1)
+	if start < 0 {
+		start = 0
+	}
+	if start > total {
+		start = total
+	}
+	end = start + pageSize
+	if end > total {
+		end = total
+	}
+	return
+}
+
+// Paginate returns the metadata and the slice bounds of a page
+// within a list of total results, for the lists filtered
+// and paginated by the callers of a storage.
+func Paginate(total, pageNum, pageSize int) (metadata []*Metadata, start, end int) {
+	start, end = paginationBounds(total, pageNum, pageSize)
+	return paginationMetadata(total, pageNum), start, end
+}
+
 // StateCollection is a collection of State, with metadata
 type StateCollection struct {
 	Metadata []*Metadata `json:"metadata"`
 	Data     []*State    `json:"data"`
 }
 
+// DeletedState is a state in the trash
+type DeletedState struct {
+	Name string `json:"name"`
+
+	// Serial is the latest serial of the state when it was deleted
+	Serial    int64     `json:"serial"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// DeletedStateCollection is a collection of DeletedState, with metadata
+type DeletedStateCollection struct {
+	Metadata []*Metadata     `json:"metadata"`
+	Data     []*DeletedState `json:"data"`
+}
+
 // LockInfo stores lock metadata.
 //
 // Copied from Terraform's source code
@@ -95,22 +227,136 @@ type LockInfo struct {
 	Path string `json:"path,omitempty"`
 }
 
-// Resource models a Terraform Resource
-type Resource = terraform.ResourceState
+// Resource models a Terraform Resource,
+// from either a version 3 or a version 4 state
+type Resource struct {
+	V3 *terraform.ResourceState
+	V4 *ResourceV4
+}
+
+// MarshalJSON encodes the resource in the format of its state
+func (r Resource) MarshalJSON() ([]byte, error) {
+	if r.V4 != nil {
+		return json.Marshal(r.V4)
+	}
+	return json.Marshal(r.V3)
+}
+
+// UnmarshalJSON decodes a resource, guessing its format
+// from the presence of instances
+func (r *Resource) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	if _, ok := fields["instances"]; ok {
+		r.V3, r.V4 = nil, &ResourceV4{}
+		return json.Unmarshal(data, r.V4)
+	}
+	r.V3, r.V4 = &terraform.ResourceState{}, nil
+	return json.Unmarshal(data, r.V3)
+}
 
 // ErrNoDocuments returns an error when no documents were found in the storage
 var ErrNoDocuments = errors.New("No document found")
 
+// ErrLocked returns an error when trying to lock a state which is already locked
+var ErrLocked = errors.New("State is already locked")
+
+// ErrStateDeleted returns an error when trying to write a state which is in the trash
+var ErrStateDeleted = errors.New("State is in the trash")
+
+// ErrLockIDMismatch returns an error when trying to unlock a state
+// with the ID of a lock which is not the current one
+var ErrLockIDMismatch = errors.New("Lock ID does not match the current lock")
+
+// CheckName returns an error if a state name is not valid.
+// Names may be hierarchical, with elements separated by slashes,
+// e.g. org/project/env, but elements may not be empty, "." or "..".
+// Control characters, such as line breaks, are not allowed.
+func CheckName(name string) error {
+	if name == "" {
+		return fmt.Errorf("state name is empty")
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 0x20 || name[i] == 0x7f {
+			return fmt.Errorf("state name %q contains a control character", name)
+		}
+	}
+	for _, e := range strings.Split(name, "/") {
+		if e == "" || e == "." || e == ".." {
+			return fmt.Errorf("state name %s has an invalid element %q", name, e)
+		}
+	}
+	return nil
+}
+
 // Storage is an abstraction over database engines
+//
+// All methods take a context, which carries the deadline of the operation
+// and is canceled when the client goes away.
+//
+// ListStates only returns the states whose names start with prefix.
+// State names may contain slashes, to organize them hierarchically.
+//
+// InsertState checks the conditions of the push atomically with the write,
+// and replaces the serial if it exists.
+//
+// RemoveState moves a state to the trash, which hides it and all its serials
+// until it is restored with RestoreState. Trashed states are permanently
+// removed, along with their lock, by PurgeState.
+//
+// API tokens, ACLs and webhooks are stored by ID, and listed in ID order.
+// Audit records and webhook deliveries are listed most recent first,
+// in reverse ID order. InsertDelivery replaces the delivery with the same ID.
 type Storage interface {
 	GetName() string
-	ListStates(pageNum, pageSize int) (coll StateCollection, err error)
-	GetState(name string, serial int) (state State, err error)
-	InsertState(document State, timestamp, source, name string) (err error)
-	RemoveState(name string) (err error)
-	GetLockStatus(name string) (lockStatus LockInfo, err error)
-	LockState(name string, lockData LockInfo) (err error)
-	UnlockState(name string, lockData LockInfo) (err error)
-	ListStateSerials(name string, pageNum, pageSize int) (coll StateCollection, err error)
-	GetResource(state, module, name string) (res Resource, err error)
+	ListStates(ctx context.Context, prefix string, pageNum, pageSize int) (coll StateCollection, err error)
+	GetState(ctx context.Context, name string, serial int) (state State, err error)
+	InsertState(ctx context.Context, document State, timestamp, source, name string, cond InsertConditions) (err error)
+	RemoveState(ctx context.Context, name string) (err error)
+	ListTrash(ctx context.Context, pageNum, pageSize int) (coll DeletedStateCollection, err error)
+	RestoreState(ctx context.Context, name string) (err error)
+	PurgeState(ctx context.Context, name string) (err error)
+	GetLockStatus(ctx context.Context, name string) (lockStatus LockInfo, err error)
+	LockState(ctx context.Context, name string, lockData LockInfo) (lockStatus LockInfo, err error)
+	UnlockState(ctx context.Context, name string, lockData LockInfo) (lockStatus LockInfo, err error)
+	ForceUnlockState(ctx context.Context, name string) (lockStatus LockInfo, err error)
+	ListStateSerials(ctx context.Context, name string, pageNum, pageSize int) (coll StateCollection, err error)
+	GetResource(ctx context.Context, state, module, name string) (res Resource, err error)
+	InsertToken(ctx context.Context, token Token) (err error)
+	GetToken(ctx context.Context, id string) (token Token, err error)
+	ListTokens(ctx context.Context, pageNum, pageSize int) (coll TokenCollection, err error)
+	RemoveToken(ctx context.Context, id string) (err error)
+	InsertACL(ctx context.Context, acl ACL) (err error)
+	ListACLs(ctx context.Context, pageNum, pageSize int) (coll ACLCollection, err error)
+	RemoveACL(ctx context.Context, id string) (err error)
+	InsertAuditRecord(ctx context.Context, record AuditRecord) (err error)
+	ListAuditRecords(ctx context.Context, filter AuditFilter, pageNum, pageSize int) (coll AuditCollection, err error)
+	InsertWebhook(ctx context.Context, webhook Webhook) (err error)
+	ListWebhooks(ctx context.Context, pageNum, pageSize int) (coll WebhookCollection, err error)
+	RemoveWebhook(ctx context.Context, id string) (err error)
+	InsertDelivery(ctx context.Context, delivery Delivery) (err error)
+	ListDeliveries(ctx context.Context, filter DeliveryFilter, pageNum, pageSize int) (coll DeliveryCollection, err error)
+}
+
+// DeltaStorage is implemented by storages which can store serials
+// as deltas against the serials stored in full, called snapshots.
+//
+// Compact re-bases the serials of all states on the configured
+// snapshot interval, and DeltaStats reports the space it saves.
+type DeltaStorage interface {
+	Compact(ctx context.Context) (err error)
+	DeltaStats(ctx context.Context) (stats DeltaStats, err error)
+}
+
+// Deltas returns the DeltaStorage of st, if any. Encrypted storages
+// forward to the storage they wrap, whose serials are compacted as stored.
+func Deltas(st Storage) (ds DeltaStorage, ok bool) {
+	if enc, isEnc := st.(*EncryptedStorage); isEnc {
+		st = enc.Storage
+	}
+	ds, ok = st.(DeltaStorage)
+	return
 }
@@ -0,0 +1,38 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/camptocamp/terradb/internal/storage"
+)
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"app", true},
+		{"org/project/env", true},
+		{"app.v2", true},
+		{"", false},
+		{"/app", false},
+		{"app/", false},
+		{"org//app", false},
+		{"org/./app", false},
+		{"org/../app", false},
+		{"app\nName: prod", false},
+		{"app\r", false},
+		{"app\ttab", false},
+		{"app\x00", false},
+		{"app\x1f", false},
+		{"app\x7f", false},
+	}
+	for _, tt := range tests {
+		err := storage.CheckName(tt.name)
+		if tt.valid && err != nil {
+			t.Errorf("expected %q to be valid, got %v", tt.name, err)
+		} else if !tt.valid && err == nil {
+			t.Errorf("expected %q to be refused", tt.name)
+		}
+	}
+}
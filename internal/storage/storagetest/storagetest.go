@@ -0,0 +1,1564 @@
+// Package storagetest provides a conformance test suite
+// for implementations of storage.Storage.
+//
+// A backend runs the suite from its own tests:
+//
+//	func TestMemoryStorage(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Storage {
+//			return storage.NewMemory()
+//		})
+//	}
+//
+// The factory is called once per sub-test and must return an empty storage.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform/terraform"
+
+	"github.com/camptocamp/terradb/internal/storage"
+)
+
+// Factory returns a new, empty storage.
+type Factory func(t *testing.T) storage.Storage
+
+// ctx is the context passed to all storage calls
+var ctx = context.Background()
+
+// Timestamp is the timestamp used for all inserted states
+const Timestamp = "20190102030405"
+
+// Run runs the conformance suite against the storage returned by factory.
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, storage.Storage)
+	}{
+		{"Empty", testEmpty},
+		{"InsertState", testInsertState},
+		{"LatestSerial", testLatestSerial},
+		{"OverwriteSerial", testOverwriteSerial},
+		{"ListStates", testListStates},
+		{"ListStatesPagination", testListStatesPagination},
+		{"ListStatesPrefix", testListStatesPrefix},
+		{"ListStateSerials", testListStateSerials},
+		{"RemoveState", testRemoveState},
+		{"RestoreState", testRestoreState},
+		{"PurgeState", testPurgeState},
+		{"NotInTrash", testNotInTrash},
+		{"Lock", testLock},
+		{"ConcurrentLock", testConcurrentLock},
+		{"ForceUnlock", testForceUnlock},
+		{"InsertLockConditions", testInsertLockConditions},
+		{"InsertHistoryConditions", testInsertHistoryConditions},
+		{"ConcurrentInsert", testConcurrentInsert},
+		{"GetResource", testGetResource},
+		{"StateV4", testStateV4},
+		{"RawDocument", testRawDocument},
+		{"GetResourceV4", testGetResourceV4},
+		{"Tokens", testTokens},
+		{"ACLs", testACLs},
+		{"AuditRecords", testAuditRecords},
+		{"Webhooks", testWebhooks},
+		{"Deliveries", testDeliveries},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, factory(t))
+		})
+	}
+}
+
+// NewState returns a minimal Terraform state
+func NewState(serial int64, lineage string) storage.State {
+	return storage.State{
+		Version: 3,
+		Serial:  serial,
+		Lineage: lineage,
+		Modules: []*terraform.ModuleState{
+			{
+				Path:      []string{"root"},
+				Resources: map[string]*terraform.ResourceState{},
+			},
+		},
+	}
+}
+
+// NewStateV4 returns a minimal version 4 Terraform state,
+// with a single resource
+func NewStateV4(serial int64, lineage string) storage.State {
+	return storage.State{
+		Version:   4,
+		TFVersion: "1.5.7",
+		Serial:    serial,
+		Lineage:   lineage,
+		Outputs: map[string]*storage.OutputV4{
+			"id": {
+				Value: json.RawMessage(`"1234"`),
+				Type:  json.RawMessage(`"string"`),
+			},
+		},
+		Resources: []*storage.ResourceV4{
+			{
+				Mode:     storage.ResourceModeManaged,
+				Type:     "null_resource",
+				Name:     "foo",
+				Provider: `provider["registry.terraform.io/hashicorp/null"]`,
+				Instances: []*storage.InstanceV4{
+					{
+						Attributes:          json.RawMessage(`{"id":"1234","triggers":{"count":"1"}}`),
+						SensitiveAttributes: json.RawMessage(`[]`),
+					},
+				},
+			},
+		},
+	}
+}
+
+func insert(t *testing.T, st storage.Storage, name string, serial int64, lineage string) {
+	err := st.InsertState(ctx, NewState(serial, lineage), Timestamp, "direct", name, storage.InsertConditions{})
+	if err != nil {
+		t.Fatalf("failed to insert %s serial %d: %v", name, serial, err)
+	}
+}
+
+func checkMetadata(t *testing.T, coll storage.StateCollection, total, page int) {
+	if total == 0 {
+		if len(coll.Metadata) != 0 {
+			t.Errorf("expected no metadata, got %+v", coll.Metadata[0])
+		}
+		return
+	}
+
+	if len(coll.Metadata) != 1 {
+		t.Fatalf("expected 1 metadata entry, got %d", len(coll.Metadata))
+	}
+	if m := coll.Metadata[0]; m.Total != total || m.Page != page {
+		t.Errorf("expected metadata {total: %d, page: %d}, got {total: %d, page: %d}",
+			total, page, m.Total, m.Page)
+	}
+}
+
+func testEmpty(t *testing.T, st storage.Storage) {
+	coll, err := st.ListStates(ctx, "", 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list states: %v", err)
+	}
+	checkMetadata(t, coll, 0, 1)
+	if len(coll.Data) != 0 {
+		t.Errorf("expected no states, got %d", len(coll.Data))
+	}
+
+	coll, err = st.ListStateSerials(ctx, "missing", 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list state serials: %v", err)
+	}
+	checkMetadata(t, coll, 0, 1)
+	if len(coll.Data) != 0 {
+		t.Errorf("expected no serials, got %d", len(coll.Data))
+	}
+
+	if _, err = st.GetState(ctx, "missing", 0); err != storage.ErrNoDocuments {
+		t.Errorf("GetState: expected ErrNoDocuments, got %v", err)
+	}
+	if _, err = st.GetState(ctx, "missing", 1); err != storage.ErrNoDocuments {
+		t.Errorf("GetState with serial: expected ErrNoDocuments, got %v", err)
+	}
+	if _, err = st.GetLockStatus(ctx, "missing"); err != storage.ErrNoDocuments {
+		t.Errorf("GetLockStatus: expected ErrNoDocuments, got %v", err)
+	}
+	if _, err = st.GetResource(ctx, "missing", "root", "null_resource.foo"); err != storage.ErrNoDocuments {
+		t.Errorf("GetResource: expected ErrNoDocuments, got %v", err)
+	}
+	if err = st.RemoveState(ctx, "missing"); err != storage.ErrNoDocuments {
+		t.Errorf("RemoveState: expected ErrNoDocuments, got %v", err)
+	}
+	if err = st.RestoreState(ctx, "missing"); err != storage.ErrNoDocuments {
+		t.Errorf("RestoreState: expected ErrNoDocuments, got %v", err)
+	}
+	if err = st.PurgeState(ctx, "missing"); err != storage.ErrNoDocuments {
+		t.Errorf("PurgeState: expected ErrNoDocuments, got %v", err)
+	}
+
+	trash, err := st.ListTrash(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list trash: %v", err)
+	}
+	if len(trash.Metadata) != 0 || len(trash.Data) != 0 {
+		t.Errorf("expected an empty trash, got %+v", trash)
+	}
+}
+
+func testInsertState(t *testing.T, st storage.Storage) {
+	insert(t, st, "foo", 1, "lineage")
+
+	state, err := st.GetState(ctx, "foo", 0)
+	if err != nil {
+		t.Fatalf("failed to get state: %v", err)
+	}
+
+	if state.Name != "foo" {
+		t.Errorf("expected name foo, got %s", state.Name)
+	}
+	if state.Serial != 1 {
+		t.Errorf("expected serial 1, got %d", state.Serial)
+	}
+	if state.Lineage != "lineage" {
+		t.Errorf("expected lineage lineage, got %s", state.Lineage)
+	}
+	if state.Version != 3 {
+		t.Errorf("expected version 3, got %d", state.Version)
+	}
+	expected, _ := time.Parse("20060102150405", Timestamp)
+	if !state.LastModified.Equal(expected) {
+		t.Errorf("expected last_modified %v, got %v", expected, state.LastModified)
+	}
+	if state.Locked {
+		t.Errorf("expected state to be unlocked")
+	}
+	if len(state.Modules) != 1 || len(state.Modules[0].Path) != 1 || state.Modules[0].Path[0] != "root" {
+		t.Errorf("expected a single root module, got %+v", state.Modules)
+	}
+}
+
+func testLatestSerial(t *testing.T, st storage.Storage) {
+	// Insert serials out of order
+	for _, s := range []int64{2, 10, 1, 3} {
+		insert(t, st, "foo", s, "lineage")
+	}
+
+	state, err := st.GetState(ctx, "foo", 0)
+	if err != nil {
+		t.Fatalf("failed to get latest state: %v", err)
+	}
+	if state.Serial != 10 {
+		t.Errorf("expected latest serial 10, got %d", state.Serial)
+	}
+
+	state, err = st.GetState(ctx, "foo", 3)
+	if err != nil {
+		t.Fatalf("failed to get serial 3: %v", err)
+	}
+	if state.Serial != 3 {
+		t.Errorf("expected serial 3, got %d", state.Serial)
+	}
+
+	if _, err = st.GetState(ctx, "foo", 4); err != storage.ErrNoDocuments {
+		t.Errorf("expected ErrNoDocuments for a missing serial, got %v", err)
+	}
+
+	coll, err := st.ListStates(ctx, "", 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list states: %v", err)
+	}
+	if len(coll.Data) != 1 || coll.Data[0].Serial != 10 {
+		t.Errorf("expected ListStates to return serial 10, got %+v", coll.Data)
+	}
+}
+
+func testOverwriteSerial(t *testing.T, st storage.Storage) {
+	insert(t, st, "foo", 1, "first")
+	insert(t, st, "foo", 1, "second")
+
+	coll, err := st.ListStateSerials(ctx, "foo", 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list state serials: %v", err)
+	}
+	checkMetadata(t, coll, 1, 1)
+
+	state, err := st.GetState(ctx, "foo", 1)
+	if err != nil {
+		t.Fatalf("failed to get state: %v", err)
+	}
+	if state.Lineage != "second" {
+		t.Errorf("expected the last push to win, got lineage %s", state.Lineage)
+	}
+}
+
+func testListStates(t *testing.T, st storage.Storage) {
+	insert(t, st, "foo", 1, "foo")
+	insert(t, st, "foo", 2, "foo")
+	insert(t, st, "bar", 5, "bar")
+
+	_, err := st.LockState(ctx, "bar", storage.LockInfo{ID: "lock-bar"})
+	if err != nil {
+		t.Fatalf("failed to lock state: %v", err)
+	}
+
+	coll, err := st.ListStates(ctx, "", 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list states: %v", err)
+	}
+	checkMetadata(t, coll, 2, 1)
+
+	states := make(map[string]*storage.State)
+	for _, s := range coll.Data {
+		states[s.Name] = s
+	}
+
+	foo, ok := states["foo"]
+	if !ok {
+		t.Fatalf("state foo not listed")
+	}
+	if foo.Serial != 2 || foo.Locked {
+		t.Errorf("expected foo at serial 2 and unlocked, got serial %d, locked %v", foo.Serial, foo.Locked)
+	}
+
+	bar, ok := states["bar"]
+	if !ok {
+		t.Fatalf("state bar not listed")
+	}
+	if bar.Serial != 5 || !bar.Locked || bar.LockInfo.ID != "lock-bar" {
+		t.Errorf("expected bar at serial 5 and locked by lock-bar, got serial %d, locked %v by %s",
+			bar.Serial, bar.Locked, bar.LockInfo.ID)
+	}
+}
+
+func testListStatesPagination(t *testing.T, st storage.Storage) {
+	for i := 0; i < 5; i++ {
+		insert(t, st, fmt.Sprintf("state-%d", i), 1, "lineage")
+	}
+
+	seen := make(map[string]bool)
+	for page, expected := range []int{2, 2, 1, 0} {
+		coll, err := st.ListStates(ctx, "", page+1, 2)
+		if err != nil {
+			t.Fatalf("failed to list page %d: %v", page+1, err)
+		}
+		checkMetadata(t, coll, 5, page+1)
+		if len(coll.Data) != expected {
+			t.Errorf("expected %d states on page %d, got %d", expected, page+1, len(coll.Data))
+		}
+		for _, s := range coll.Data {
+			if seen[s.Name] {
+				t.Errorf("state %s listed on several pages", s.Name)
+			}
+			seen[s.Name] = true
+		}
+	}
+
+	if len(seen) != 5 {
+		t.Errorf("expected 5 distinct states over all pages, got %d", len(seen))
+	}
+}
+
+func testListStatesPrefix(t *testing.T, st storage.Storage) {
+	names := []string{"org/app/dev", "org/app/prod", "org/app", "org/db/prod", "other"}
+	for i, name := range names {
+		insert(t, st, name, int64(i+1), name)
+	}
+
+	for _, name := range names {
+		s, err := st.GetState(ctx, name, 0)
+		if err != nil {
+			t.Fatalf("failed to get state %s: %v", name, err)
+		}
+		if s.Name != name || s.Lineage != name {
+			t.Errorf("expected state %s, got %s with lineage %s", name, s.Name, s.Lineage)
+		}
+	}
+
+	for prefix, expected := range map[string][]string{
+		"":         {"org/app", "org/app/dev", "org/app/prod", "org/db/prod", "other"},
+		"org/":     {"org/app", "org/app/dev", "org/app/prod", "org/db/prod"},
+		"org/app/": {"org/app/dev", "org/app/prod"},
+		"org/db":   {"org/db/prod"},
+		"missing":  {},
+	} {
+		coll, err := st.ListStates(ctx, prefix, 1, 10)
+		if err != nil {
+			t.Fatalf("failed to list states with prefix %q: %v", prefix, err)
+		}
+		checkMetadata(t, coll, len(expected), 1)
+
+		var listed []string
+		for _, s := range coll.Data {
+			listed = append(listed, s.Name)
+		}
+		if fmt.Sprint(listed) != fmt.Sprint(expected) {
+			t.Errorf("prefix %q: expected %v, got %v", prefix, expected, listed)
+		}
+	}
+
+	coll, err := st.ListStates(ctx, "org/app", 2, 2)
+	if err != nil {
+		t.Fatalf("failed to list states: %v", err)
+	}
+	checkMetadata(t, coll, 3, 2)
+	if len(coll.Data) != 1 || coll.Data[0].Name != "org/app/prod" {
+		t.Errorf("expected org/app/prod alone on page 2, got %d states", len(coll.Data))
+	}
+}
+
+func testListStateSerials(t *testing.T, st storage.Storage) {
+	for _, s := range []int64{3, 1, 5, 2, 4} {
+		insert(t, st, "foo", s, "lineage")
+	}
+	insert(t, st, "bar", 1, "lineage")
+
+	var serials []int64
+	for page, expected := range []int{2, 2, 1, 0} {
+		coll, err := st.ListStateSerials(ctx, "foo", page+1, 2)
+		if err != nil {
+			t.Fatalf("failed to list page %d: %v", page+1, err)
+		}
+		checkMetadata(t, coll, 5, page+1)
+		if len(coll.Data) != expected {
+			t.Errorf("expected %d serials on page %d, got %d", expected, page+1, len(coll.Data))
+		}
+		for _, s := range coll.Data {
+			if s.Name != "foo" {
+				t.Errorf("expected serials of foo, got %s", s.Name)
+			}
+			serials = append(serials, s.Serial)
+		}
+	}
+
+	for i, s := range serials {
+		if s != int64(i+1) {
+			t.Errorf("expected serials in ascending order, got %v", serials)
+			break
+		}
+	}
+}
+
+func testRemoveState(t *testing.T, st storage.Storage) {
+	insert(t, st, "foo", 1, "lineage")
+	insert(t, st, "foo", 2, "lineage")
+	insert(t, st, "bar", 1, "lineage")
+
+	err := st.RemoveState(ctx, "foo")
+	if err != nil {
+		t.Fatalf("failed to remove state: %v", err)
+	}
+
+	if _, err = st.GetState(ctx, "foo", 0); err != storage.ErrNoDocuments {
+		t.Errorf("expected ErrNoDocuments after removal, got %v", err)
+	}
+	if _, err = st.GetState(ctx, "foo", 1); err != storage.ErrNoDocuments {
+		t.Errorf("expected all serials to be removed, got %v", err)
+	}
+
+	coll, err := st.ListStates(ctx, "", 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list states: %v", err)
+	}
+	checkMetadata(t, coll, 1, 1)
+	if len(coll.Data) != 1 || coll.Data[0].Name != "bar" {
+		t.Errorf("expected only bar to be listed, got %+v", coll.Data)
+	}
+
+	coll, err = st.ListStateSerials(ctx, "foo", 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list state serials: %v", err)
+	}
+	checkMetadata(t, coll, 0, 1)
+
+	trash, err := st.ListTrash(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list trash: %v", err)
+	}
+	if len(trash.Metadata) != 1 || trash.Metadata[0].Total != 1 {
+		t.Errorf("expected 1 state in the trash, got %+v", trash.Metadata)
+	}
+	if len(trash.Data) != 1 {
+		t.Fatalf("expected 1 deleted state, got %d", len(trash.Data))
+	}
+	if d := trash.Data[0]; d.Name != "foo" || d.Serial != 2 || d.DeletedAt.IsZero() {
+		t.Errorf("expected foo serial 2 with a deletion date, got %+v", d)
+	}
+
+	if err = st.RemoveState(ctx, "foo"); err != storage.ErrNoDocuments {
+		t.Errorf("removing a deleted state: expected ErrNoDocuments, got %v", err)
+	}
+	err = st.InsertState(ctx, NewState(3, "lineage"), Timestamp, "direct", "foo", storage.InsertConditions{})
+	if err != storage.ErrStateDeleted {
+		t.Errorf("pushing a deleted state: expected ErrStateDeleted, got %v", err)
+	}
+}
+
+func testRestoreState(t *testing.T, st storage.Storage) {
+	insert(t, st, "foo", 1, "lineage")
+	insert(t, st, "foo", 2, "lineage")
+
+	if err := st.RemoveState(ctx, "foo"); err != nil {
+		t.Fatalf("failed to remove state: %v", err)
+	}
+	if err := st.RestoreState(ctx, "foo"); err != nil {
+		t.Fatalf("failed to restore state: %v", err)
+	}
+
+	state, err := st.GetState(ctx, "foo", 0)
+	if err != nil {
+		t.Fatalf("failed to get restored state: %v", err)
+	}
+	if state.Serial != 2 {
+		t.Errorf("expected serial 2, got %d", state.Serial)
+	}
+
+	coll, err := st.ListStateSerials(ctx, "foo", 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list state serials: %v", err)
+	}
+	checkMetadata(t, coll, 2, 1)
+
+	trash, err := st.ListTrash(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list trash: %v", err)
+	}
+	if len(trash.Data) != 0 {
+		t.Errorf("expected an empty trash, got %d states", len(trash.Data))
+	}
+
+	if err = st.RestoreState(ctx, "foo"); err != storage.ErrNoDocuments {
+		t.Errorf("restoring a live state: expected ErrNoDocuments, got %v", err)
+	}
+
+	// The restored state can be pushed and removed again
+	insert(t, st, "foo", 3, "lineage")
+	if err = st.RemoveState(ctx, "foo"); err != nil {
+		t.Fatalf("failed to remove restored state: %v", err)
+	}
+	if err = st.RestoreState(ctx, "foo"); err != nil {
+		t.Fatalf("failed to restore state again: %v", err)
+	}
+	coll, err = st.ListStateSerials(ctx, "foo", 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list state serials: %v", err)
+	}
+	checkMetadata(t, coll, 3, 1)
+}
+
+func testPurgeState(t *testing.T, st storage.Storage) {
+	insert(t, st, "foo", 1, "lineage")
+	insert(t, st, "foo", 2, "lineage")
+	insert(t, st, "bar", 1, "lineage")
+
+	if err := st.PurgeState(ctx, "foo"); err != storage.ErrNoDocuments {
+		t.Errorf("purging a live state: expected ErrNoDocuments, got %v", err)
+	}
+
+	_, err := st.LockState(ctx, "foo", storage.LockInfo{ID: "lock"})
+	if err != nil {
+		t.Fatalf("failed to lock state: %v", err)
+	}
+	if err = st.RemoveState(ctx, "foo"); err != nil {
+		t.Fatalf("failed to remove state: %v", err)
+	}
+	if err = st.PurgeState(ctx, "foo"); err != nil {
+		t.Fatalf("failed to purge state: %v", err)
+	}
+
+	if _, err = st.GetLockStatus(ctx, "foo"); err != storage.ErrNoDocuments {
+		t.Errorf("expected the lock to be purged, got %v", err)
+	}
+	if err = st.RestoreState(ctx, "foo"); err != storage.ErrNoDocuments {
+		t.Errorf("restoring a purged state: expected ErrNoDocuments, got %v", err)
+	}
+
+	trash, err := st.ListTrash(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list trash: %v", err)
+	}
+	if len(trash.Data) != 0 {
+		t.Errorf("expected an empty trash, got %d states", len(trash.Data))
+	}
+
+	// The name can be reused, without the purged serials
+	insert(t, st, "foo", 1, "other")
+	coll, err := st.ListStateSerials(ctx, "foo", 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list state serials: %v", err)
+	}
+	checkMetadata(t, coll, 1, 1)
+	if len(coll.Data) != 1 || coll.Data[0].Lineage != "other" {
+		t.Errorf("expected only the new serial, got %+v", coll.Data)
+	}
+
+	if _, err = st.GetState(ctx, "bar", 0); err != nil {
+		t.Errorf("expected bar to be kept, got %v", err)
+	}
+}
+
+func testNotInTrash(t *testing.T, st storage.Storage) {
+	insert(t, st, "foo", 1, "lineage")
+	if _, err := st.LockState(ctx, "foo", storage.LockInfo{ID: "lock"}); err != nil {
+		t.Fatalf("failed to lock state: %v", err)
+	}
+
+	for _, name := range []string{"foo", "unknown"} {
+		if err := st.PurgeState(ctx, name); err != storage.ErrNoDocuments {
+			t.Errorf("purging %s: expected ErrNoDocuments, got %v", name, err)
+		}
+		if err := st.RestoreState(ctx, name); err != storage.ErrNoDocuments {
+			t.Errorf("restoring %s: expected ErrNoDocuments, got %v", name, err)
+		}
+	}
+
+	// The live state is left untouched
+	if _, err := st.GetState(ctx, "foo", 1); err != nil {
+		t.Errorf("expected foo to be kept, got %v", err)
+	}
+	if _, err := st.GetLockStatus(ctx, "foo"); err != nil {
+		t.Errorf("expected the lock of foo to be kept, got %v", err)
+	}
+	trash, err := st.ListTrash(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list trash: %v", err)
+	}
+	if len(trash.Data) != 0 {
+		t.Errorf("expected an empty trash, got %d states", len(trash.Data))
+	}
+}
+
+func testLock(t *testing.T, st storage.Storage) {
+	insert(t, st, "foo", 1, "lineage")
+
+	created := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	lock := storage.LockInfo{
+		ID:        "lock-id",
+		Operation: "OperationTypeApply",
+		Who:       "user@host",
+		Version:   "0.11.13",
+		Created:   &created,
+	}
+
+	holder, err := st.LockState(ctx, "foo", lock)
+	if err != nil {
+		t.Fatalf("failed to lock state: %v", err)
+	}
+	if holder.ID != lock.ID {
+		t.Errorf("expected LockState to return the new lock, got %+v", holder)
+	}
+
+	other := storage.LockInfo{ID: "other-id"}
+	holder, err = st.LockState(ctx, "foo", other)
+	if err != storage.ErrLocked {
+		t.Fatalf("expected ErrLocked when locking a locked state, got %v", err)
+	}
+	if holder.ID != lock.ID || holder.Who != lock.Who {
+		t.Errorf("expected LockState to return the current holder, got %+v", holder)
+	}
+
+	current, err := st.GetLockStatus(ctx, "foo")
+	if err != nil {
+		t.Fatalf("failed to get lock status: %v", err)
+	}
+	if current.ID != lock.ID || current.Who != lock.Who || current.Operation != lock.Operation {
+		t.Errorf("expected lock %+v, got %+v", lock, current)
+	}
+	if current.Path != "foo" {
+		t.Errorf("expected lock path to be the state name, got %s", current.Path)
+	}
+	if current.Created == nil || !current.Created.Equal(created) {
+		t.Errorf("expected lock creation time %v, got %v", created, current.Created)
+	}
+
+	state, err := st.GetState(ctx, "foo", 0)
+	if err != nil {
+		t.Fatalf("failed to get state: %v", err)
+	}
+	if !state.Locked || state.LockInfo.ID != lock.ID {
+		t.Errorf("expected state to be locked by %s, got locked %v by %s",
+			lock.ID, state.Locked, state.LockInfo.ID)
+	}
+
+	holder, err = st.UnlockState(ctx, "foo", other)
+	if err != storage.ErrLockIDMismatch {
+		t.Fatalf("expected ErrLockIDMismatch when unlocking with another ID, got %v", err)
+	}
+	if holder.ID != lock.ID {
+		t.Errorf("expected UnlockState to return the current holder, got %+v", holder)
+	}
+	if _, err = st.GetLockStatus(ctx, "foo"); err != nil {
+		t.Errorf("expected the lock to be kept after a mismatching unlock, got %v", err)
+	}
+
+	_, err = st.UnlockState(ctx, "foo", lock)
+	if err != nil {
+		t.Fatalf("failed to unlock state: %v", err)
+	}
+	if _, err = st.GetLockStatus(ctx, "foo"); err != storage.ErrNoDocuments {
+		t.Errorf("expected ErrNoDocuments after unlock, got %v", err)
+	}
+
+	state, err = st.GetState(ctx, "foo", 0)
+	if err != nil {
+		t.Fatalf("failed to get state: %v", err)
+	}
+	if state.Locked {
+		t.Errorf("expected state to be unlocked")
+	}
+
+	if _, err = st.UnlockState(ctx, "foo", lock); err != nil {
+		t.Errorf("expected unlocking an unlocked state to succeed, got %v", err)
+	}
+
+	// The state can be locked again once unlocked
+	if _, err = st.LockState(ctx, "foo", other); err != nil {
+		t.Errorf("failed to lock an unlocked state: %v", err)
+	}
+
+	// States can be locked before their first push
+	_, err = st.LockState(ctx, "new", lock)
+	if err != nil {
+		t.Fatalf("failed to lock a state without serials: %v", err)
+	}
+	if _, err = st.GetLockStatus(ctx, "new"); err != nil {
+		t.Errorf("failed to get lock status of a state without serials: %v", err)
+	}
+}
+
+// testConcurrentLock checks that when several clients try to lock a state
+// at the same time, exactly one of them gets the lock, and the others
+// are told who holds it.
+func testConcurrentLock(t *testing.T, st storage.Storage) {
+	const clients = 10
+
+	var wg sync.WaitGroup
+	errs := make([]error, clients)
+	holders := make([]storage.LockInfo, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			holders[i], errs[i] = st.LockState(ctx, "foo", storage.LockInfo{
+				ID: fmt.Sprintf("lock-%d", i),
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	current, err := st.GetLockStatus(ctx, "foo")
+	if err != nil {
+		t.Fatalf("failed to get lock status: %v", err)
+	}
+
+	winners := 0
+	for i, err := range errs {
+		switch err {
+		case nil:
+			winners++
+			if current.ID != fmt.Sprintf("lock-%d", i) {
+				t.Errorf("lock-%d was granted, but the lock is held by %s", i, current.ID)
+			}
+		case storage.ErrLocked:
+			if holders[i].ID != current.ID {
+				t.Errorf("lock-%d was told the lock is held by %s, but it is held by %s",
+					i, holders[i].ID, current.ID)
+			}
+		default:
+			t.Errorf("lock-%d failed: %v", i, err)
+		}
+	}
+
+	if winners != 1 {
+		t.Errorf("expected exactly one client to get the lock, got %d", winners)
+	}
+}
+
+func testForceUnlock(t *testing.T, st storage.Storage) {
+	if _, err := st.ForceUnlockState(ctx, "foo"); err != storage.ErrNoDocuments {
+		t.Errorf("expected ErrNoDocuments when force-unlocking an unlocked state, got %v", err)
+	}
+
+	_, err := st.LockState(ctx, "foo", storage.LockInfo{ID: "lock-id", Who: "user@host"})
+	if err != nil {
+		t.Fatalf("failed to lock state: %v", err)
+	}
+
+	removed, err := st.ForceUnlockState(ctx, "foo")
+	if err != nil {
+		t.Fatalf("failed to force-unlock state: %v", err)
+	}
+	if removed.ID != "lock-id" || removed.Who != "user@host" {
+		t.Errorf("expected ForceUnlockState to return the removed lock, got %+v", removed)
+	}
+	if _, err = st.GetLockStatus(ctx, "foo"); err != storage.ErrNoDocuments {
+		t.Errorf("expected ErrNoDocuments after force-unlock, got %v", err)
+	}
+}
+
+func testInsertLockConditions(t *testing.T, st storage.Storage) {
+	locked := storage.InsertConditions{CheckLock: true, LockID: "lock-id"}
+	required := storage.InsertConditions{CheckLock: true, LockID: "lock-id", RequireLock: true}
+
+	err := st.InsertState(ctx, NewState(1, "lineage"), Timestamp, "direct", "foo", required)
+	if err != storage.ErrNotLocked {
+		t.Errorf("expected ErrNotLocked when pushing to an unlocked state, got %v", err)
+	}
+	if err = st.InsertState(ctx, NewState(1, "lineage"), Timestamp, "direct", "foo", locked); err != nil {
+		t.Fatalf("expected pushing to an unlocked state to succeed, got %v", err)
+	}
+
+	if _, err = st.LockState(ctx, "foo", storage.LockInfo{ID: "other-id"}); err != nil {
+		t.Fatalf("failed to lock state: %v", err)
+	}
+	for _, cond := range []storage.InsertConditions{locked, required} {
+		err = st.InsertState(ctx, NewState(2, "lineage"), Timestamp, "direct", "foo", cond)
+		if err != storage.ErrLocked {
+			t.Errorf("expected ErrLocked when pushing with another lock ID, got %v", err)
+		}
+	}
+	if state, _ := st.GetState(ctx, "foo", 0); state.Serial != 1 {
+		t.Errorf("expected rejected pushes not to be written, got serial %d", state.Serial)
+	}
+
+	if _, err = st.ForceUnlockState(ctx, "foo"); err != nil {
+		t.Fatalf("failed to force-unlock state: %v", err)
+	}
+	if _, err = st.LockState(ctx, "foo", storage.LockInfo{ID: "lock-id"}); err != nil {
+		t.Fatalf("failed to lock state: %v", err)
+	}
+	if err = st.InsertState(ctx, NewState(2, "lineage"), Timestamp, "direct", "foo", required); err != nil {
+		t.Errorf("expected pushing with the lock ID to succeed, got %v", err)
+	}
+}
+
+func testInsertHistoryConditions(t *testing.T, st storage.Storage) {
+	cond := storage.InsertConditions{CheckHistory: true}
+
+	if err := st.InsertState(ctx, NewState(2, "lineage"), Timestamp, "direct", "foo", cond); err != nil {
+		t.Fatalf("expected the first push to succeed, got %v", err)
+	}
+
+	changed := NewState(2, "lineage")
+	changed.Modules[0].Resources["null_resource.foo"] = &terraform.ResourceState{Type: "null_resource"}
+
+	tests := []struct {
+		desc   string
+		state  storage.State
+		reason string
+	}{
+		{"another lineage", NewState(3, "other"), storage.ConflictLineageMismatch},
+		{"an older serial", NewState(1, "lineage"), storage.ConflictSerialRegression},
+		{"the same serial with another content", changed, storage.ConflictSerialContent},
+		{"the same serial with the same content", NewState(2, "lineage"), ""},
+		{"a newer serial", NewState(3, "lineage"), ""},
+	}
+	for _, tt := range tests {
+		err := st.InsertState(ctx, tt.state, Timestamp, "direct", "foo", cond)
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("expected pushing %s to succeed, got %v", tt.desc, err)
+			}
+			continue
+		}
+
+		conflict, ok := err.(*storage.ConflictError)
+		if !ok {
+			t.Errorf("expected a conflict when pushing %s, got %v", tt.desc, err)
+			continue
+		}
+		if conflict.Reason != tt.reason {
+			t.Errorf("expected reason %s when pushing %s, got %s", tt.reason, tt.desc, conflict.Reason)
+		}
+		if conflict.CurrentSerial != 2 || conflict.CurrentLineage != "lineage" {
+			t.Errorf("expected the conflict to report serial 2 of lineage, got %+v", conflict)
+		}
+	}
+
+	// The history is not checked without the condition
+	err := st.InsertState(ctx, NewState(1, "other"), Timestamp, "direct", "foo", storage.InsertConditions{})
+	if err != nil {
+		t.Errorf("expected an unconditional push to succeed, got %v", err)
+	}
+}
+
+// testConcurrentInsert checks that when several clients push different
+// contents for the same serial at the same time, exactly one of them
+// succeeds, and the others get a conflict.
+func testConcurrentInsert(t *testing.T, st storage.Storage) {
+	const clients = 10
+
+	insert(t, st, "foo", 1, "lineage")
+
+	var wg sync.WaitGroup
+	errs := make([]error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			state := NewState(2, "lineage")
+			state.Modules[0].Outputs = map[string]*terraform.OutputState{
+				"client": {Type: "string", Value: fmt.Sprintf("%d", i)},
+			}
+			errs[i] = st.InsertState(ctx, state, Timestamp, "direct", "foo",
+				storage.InsertConditions{CheckHistory: true})
+		}(i)
+	}
+	wg.Wait()
+
+	winners := 0
+	for i, err := range errs {
+		if err == nil {
+			winners++
+		} else if _, ok := err.(*storage.ConflictError); !ok {
+			t.Errorf("client %d failed: %v", i, err)
+		}
+	}
+	if winners != 1 {
+		t.Errorf("expected exactly one client to push serial 2, got %d", winners)
+	}
+}
+
+func testGetResource(t *testing.T, st storage.Storage) {
+	state := NewState(1, "lineage")
+	state.Modules[0].Resources["null_resource.foo"] = &terraform.ResourceState{
+		Type: "null_resource",
+		Primary: &terraform.InstanceState{
+			ID: "1234",
+		},
+	}
+	state.Modules = append(state.Modules, &terraform.ModuleState{
+		Path: []string{"root", "child"},
+		Resources: map[string]*terraform.ResourceState{
+			"null_resource.bar": {
+				Type: "null_resource",
+				Primary: &terraform.InstanceState{
+					ID: "5678",
+				},
+			},
+		},
+	})
+
+	err := st.InsertState(ctx, state, Timestamp, "direct", "foo", storage.InsertConditions{})
+	if err != nil {
+		t.Fatalf("failed to insert state: %v", err)
+	}
+
+	res, err := st.GetResource(ctx, "foo", "root", "null_resource.foo")
+	if err != nil {
+		t.Fatalf("failed to get resource: %v", err)
+	}
+	if res.V3 == nil || res.V3.Type != "null_resource" || res.V3.Primary == nil || res.V3.Primary.ID != "1234" {
+		t.Errorf("unexpected resource %+v", res.V3)
+	}
+
+	res, err = st.GetResource(ctx, "foo", "child", "null_resource.bar")
+	if err != nil {
+		t.Fatalf("failed to get resource in module: %v", err)
+	}
+	if res.V3 == nil || res.V3.Primary == nil || res.V3.Primary.ID != "5678" {
+		t.Errorf("unexpected resource %+v", res.V3)
+	}
+
+	if _, err = st.GetResource(ctx, "foo", "root", "null_resource.missing"); err != storage.ErrNoDocuments {
+		t.Errorf("expected ErrNoDocuments for a missing resource, got %v", err)
+	}
+	if _, err = st.GetResource(ctx, "foo", "missing", "null_resource.foo"); err != storage.ErrNoDocuments {
+		t.Errorf("expected ErrNoDocuments for a missing module, got %v", err)
+	}
+}
+
+func testStateV4(t *testing.T, st storage.Storage) {
+	err := st.InsertState(ctx, NewStateV4(1, "lineage"), Timestamp, "direct", "foo", storage.InsertConditions{})
+	if err != nil {
+		t.Fatalf("failed to insert state: %v", err)
+	}
+
+	check := func(what string, state *storage.State) {
+		if state.Version != 4 || state.Serial != 1 {
+			t.Errorf("%s: expected version 4 serial 1, got version %d serial %d", what, state.Version, state.Serial)
+		}
+		if len(state.Modules) != 0 {
+			t.Errorf("%s: expected no modules, got %d", what, len(state.Modules))
+		}
+		if o, ok := state.Outputs["id"]; !ok || string(o.Value) != `"1234"` {
+			t.Errorf("%s: unexpected outputs %+v", what, state.Outputs)
+		}
+		if len(state.Resources) != 1 || len(state.Resources[0].Instances) != 1 {
+			t.Fatalf("%s: expected 1 resource with 1 instance, got %+v", what, state.Resources)
+		}
+		var attrs map[string]interface{}
+		if err := json.Unmarshal(state.Resources[0].Instances[0].Attributes, &attrs); err != nil {
+			t.Fatalf("%s: failed to unmarshal attributes: %v", what, err)
+		}
+		if triggers, ok := attrs["triggers"].(map[string]interface{}); !ok || triggers["count"] != "1" {
+			t.Errorf("%s: unexpected attributes %v", what, attrs)
+		}
+	}
+
+	state, err := st.GetState(ctx, "foo", 0)
+	if err != nil {
+		t.Fatalf("failed to get state: %v", err)
+	}
+	check("GetState", &state)
+
+	coll, err := st.ListStates(ctx, "", 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list states: %v", err)
+	}
+	if len(coll.Data) != 1 {
+		t.Fatalf("expected 1 state, got %d", len(coll.Data))
+	}
+	check("ListStates", coll.Data[0])
+
+	coll, err = st.ListStateSerials(ctx, "foo", 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list state serials: %v", err)
+	}
+	if len(coll.Data) != 1 {
+		t.Fatalf("expected 1 serial, got %d", len(coll.Data))
+	}
+	check("ListStateSerials", coll.Data[0])
+}
+
+func testGetResourceV4(t *testing.T, st storage.Storage) {
+	state := NewStateV4(1, "lineage")
+	state.Resources = append(state.Resources,
+		&storage.ResourceV4{
+			Mode:     storage.ResourceModeData,
+			Type:     "null_data_source",
+			Name:     "foo",
+			Provider: `provider["registry.terraform.io/hashicorp/null"]`,
+			Instances: []*storage.InstanceV4{
+				{Attributes: json.RawMessage(`{"id":"data"}`)},
+			},
+		},
+		&storage.ResourceV4{
+			Module:   "module.child",
+			Mode:     storage.ResourceModeManaged,
+			Type:     "null_resource",
+			Name:     "bar",
+			EachMode: "list",
+			Provider: `provider["registry.terraform.io/hashicorp/null"]`,
+			Instances: []*storage.InstanceV4{
+				{IndexKey: json.RawMessage(`0`), Attributes: json.RawMessage(`{"id":"5678"}`)},
+				{IndexKey: json.RawMessage(`1`), Attributes: json.RawMessage(`{"id":"9012"}`)},
+			},
+		},
+	)
+
+	err := st.InsertState(ctx, state, Timestamp, "direct", "foo", storage.InsertConditions{})
+	if err != nil {
+		t.Fatalf("failed to insert state: %v", err)
+	}
+
+	res, err := st.GetResource(ctx, "foo", "root", "null_resource.foo")
+	if err != nil {
+		t.Fatalf("failed to get resource: %v", err)
+	}
+	if res.V4 == nil || res.V4.Type != "null_resource" || len(res.V4.Instances) != 1 {
+		t.Errorf("unexpected resource %+v", res.V4)
+	}
+
+	res, err = st.GetResource(ctx, "foo", "root", "data.null_data_source.foo")
+	if err != nil {
+		t.Fatalf("failed to get data source: %v", err)
+	}
+	if res.V4 == nil || res.V4.Mode != storage.ResourceModeData {
+		t.Errorf("unexpected data source %+v", res.V4)
+	}
+
+	for _, module := range []string{"child", "module.child"} {
+		res, err = st.GetResource(ctx, "foo", module, "null_resource.bar")
+		if err != nil {
+			t.Fatalf("failed to get resource in module %s: %v", module, err)
+		}
+		if res.V4 == nil || len(res.V4.Instances) != 2 || string(res.V4.Instances[1].IndexKey) != "1" {
+			t.Errorf("unexpected resource %+v", res.V4)
+		}
+	}
+
+	if _, err = st.GetResource(ctx, "foo", "root", "null_resource.bar"); err != storage.ErrNoDocuments {
+		t.Errorf("expected ErrNoDocuments for a resource in another module, got %v", err)
+	}
+	if _, err = st.GetResource(ctx, "foo", "root", "null_data_source.foo"); err != storage.ErrNoDocuments {
+		t.Errorf("expected ErrNoDocuments for a data source without its prefix, got %v", err)
+	}
+}
+
+func testRawDocument(t *testing.T, st storage.Storage) {
+	// Unknown fields and formatting must be kept
+	raw := []byte("{\n  \"version\": 4,\n  \"serial\": 1,\n  \"lineage\": \"lineage\",\n  \"unknown\": {\"b\": 1, \"a\": 2}\n}\n")
+	state := storage.State{
+		Version: 4,
+		Serial:  1,
+		Lineage: "lineage",
+		Raw:     raw,
+		MD5:     "md5sum",
+	}
+	err := st.InsertState(ctx, state, Timestamp, "direct", "foo", storage.InsertConditions{})
+	if err != nil {
+		t.Fatalf("failed to insert state: %v", err)
+	}
+
+	check := func(serial int) {
+		got, err := st.GetState(ctx, "foo", serial)
+		if err != nil {
+			t.Fatalf("failed to get state: %v", err)
+		}
+		if !bytes.Equal(got.Raw, raw) {
+			t.Errorf("serial %d: expected raw document %q, got %q", serial, raw, got.Raw)
+		}
+		if got.MD5 != "md5sum" {
+			t.Errorf("serial %d: expected checksum md5sum, got %q", serial, got.MD5)
+		}
+		if got.Lineage != "lineage" {
+			t.Errorf("serial %d: expected the state to be decoded, got lineage %q", serial, got.Lineage)
+		}
+	}
+	check(0)
+	insert(t, st, "foo", 2, "lineage")
+	check(1)
+
+	// Without a raw document, the state is served without TerraDB's fields
+	got, err := st.GetState(ctx, "foo", 0)
+	if err != nil {
+		t.Fatalf("failed to get state: %v", err)
+	}
+	if got.Raw != nil {
+		t.Errorf("expected no raw document, got %q", got.Raw)
+	}
+	doc, err := got.Document()
+	if err != nil {
+		t.Fatalf("failed to get document: %v", err)
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(doc, &fields); err != nil {
+		t.Fatalf("failed to unmarshal document: %v", err)
+	}
+	if _, ok := fields["name"]; ok || fields["serial"] != float64(2) {
+		t.Errorf("unexpected document %s", doc)
+	}
+}
+
+func testTokens(t *testing.T, st storage.Storage) {
+	coll, err := st.ListTokens(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list tokens: %v", err)
+	}
+	if len(coll.Metadata) != 0 || len(coll.Data) != 0 {
+		t.Errorf("expected no tokens, got %+v", coll)
+	}
+
+	if _, err = st.GetToken(ctx, "missing"); err != storage.ErrNoDocuments {
+		t.Errorf("getting a missing token: expected ErrNoDocuments, got %v", err)
+	}
+	if err = st.RemoveToken(ctx, "missing"); err != storage.ErrNoDocuments {
+		t.Errorf("removing a missing token: expected ErrNoDocuments, got %v", err)
+	}
+
+	createdAt := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	expiresAt := createdAt.Add(24 * time.Hour)
+	for i := 3; i > 0; i-- {
+		token := storage.Token{
+			ID:        fmt.Sprintf("token%d", i),
+			Name:      fmt.Sprintf("CI %d", i),
+			Hash:      "hash",
+			Scopes:    []string{"read", "lock"},
+			Prefix:    "org/",
+			CreatedAt: createdAt,
+			CreatedBy: "admin",
+		}
+		if i == 1 {
+			token.ExpiresAt = &expiresAt
+		}
+		if err = st.InsertToken(ctx, token); err != nil {
+			t.Fatalf("failed to insert token: %v", err)
+		}
+	}
+
+	token, err := st.GetToken(ctx, "token1")
+	if err != nil {
+		t.Fatalf("failed to get token: %v", err)
+	}
+	if token.Name != "CI 1" || token.Hash != "hash" || token.Prefix != "org/" || token.CreatedBy != "admin" {
+		t.Errorf("unexpected token %+v", token)
+	}
+	if len(token.Scopes) != 2 || token.Scopes[0] != "read" || token.Scopes[1] != "lock" {
+		t.Errorf("expected scopes [read lock], got %v", token.Scopes)
+	}
+	if !token.CreatedAt.Equal(createdAt) {
+		t.Errorf("expected creation date %s, got %s", createdAt, token.CreatedAt)
+	}
+	if token.ExpiresAt == nil || !token.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("expected expiry date %s, got %v", expiresAt, token.ExpiresAt)
+	}
+
+	token, err = st.GetToken(ctx, "token2")
+	if err != nil {
+		t.Fatalf("failed to get token: %v", err)
+	}
+	if token.ExpiresAt != nil {
+		t.Errorf("expected no expiry date, got %s", token.ExpiresAt)
+	}
+
+	// Tokens are listed in ID order
+	for page, want := range [][]string{{"token1", "token2"}, {"token3"}} {
+		coll, err = st.ListTokens(ctx, page+1, 2)
+		if err != nil {
+			t.Fatalf("failed to list tokens: %v", err)
+		}
+		if len(coll.Metadata) != 1 || coll.Metadata[0].Total != 3 || coll.Metadata[0].Page != page+1 {
+			t.Errorf("page %d: unexpected metadata %+v", page+1, coll.Metadata)
+		}
+		var got []string
+		for _, tok := range coll.Data {
+			got = append(got, tok.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("page %d: expected tokens %v, got %v", page+1, want, got)
+		}
+	}
+
+	if err = st.RemoveToken(ctx, "token2"); err != nil {
+		t.Fatalf("failed to remove token: %v", err)
+	}
+	if _, err = st.GetToken(ctx, "token2"); err != storage.ErrNoDocuments {
+		t.Errorf("getting a removed token: expected ErrNoDocuments, got %v", err)
+	}
+	coll, err = st.ListTokens(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list tokens: %v", err)
+	}
+	if len(coll.Data) != 2 {
+		t.Errorf("expected 2 tokens, got %d", len(coll.Data))
+	}
+}
+
+func testACLs(t *testing.T, st storage.Storage) {
+	coll, err := st.ListACLs(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list ACLs: %v", err)
+	}
+	if len(coll.Metadata) != 0 || len(coll.Data) != 0 {
+		t.Errorf("expected no ACLs, got %+v", coll)
+	}
+	if err = st.RemoveACL(ctx, "missing"); err != storage.ErrNoDocuments {
+		t.Errorf("removing a missing ACL: expected ErrNoDocuments, got %v", err)
+	}
+
+	for i := 3; i > 0; i-- {
+		acl := storage.ACL{
+			ID:        fmt.Sprintf("acl%d", i),
+			Principal: fmt.Sprintf("group:team%d", i),
+			Pattern:   fmt.Sprintf("team%d/**", i),
+			Scopes:    []string{"read"},
+		}
+		if err = st.InsertACL(ctx, acl); err != nil {
+			t.Fatalf("failed to insert ACL: %v", err)
+		}
+	}
+
+	// Inserting an ACL with the same ID replaces it
+	err = st.InsertACL(ctx, storage.ACL{
+		ID:        "acl1",
+		Principal: "group:team1",
+		Pattern:   "team1/**",
+		Scopes:    []string{"read", "write"},
+	})
+	if err != nil {
+		t.Fatalf("failed to replace ACL: %v", err)
+	}
+
+	// ACLs are listed in ID order
+	for page, want := range [][]string{{"acl1", "acl2"}, {"acl3"}} {
+		coll, err = st.ListACLs(ctx, page+1, 2)
+		if err != nil {
+			t.Fatalf("failed to list ACLs: %v", err)
+		}
+		if len(coll.Metadata) != 1 || coll.Metadata[0].Total != 3 || coll.Metadata[0].Page != page+1 {
+			t.Errorf("page %d: unexpected metadata %+v", page+1, coll.Metadata)
+		}
+		var got []string
+		for _, acl := range coll.Data {
+			got = append(got, acl.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("page %d: expected ACLs %v, got %v", page+1, want, got)
+		}
+		if page == 0 && len(coll.Data) > 0 {
+			acl := coll.Data[0]
+			if acl.Principal != "group:team1" || acl.Pattern != "team1/**" || fmt.Sprint(acl.Scopes) != "[read write]" {
+				t.Errorf("unexpected ACL %+v", acl)
+			}
+		}
+	}
+
+	if err = st.RemoveACL(ctx, "acl2"); err != nil {
+		t.Fatalf("failed to remove ACL: %v", err)
+	}
+	coll, err = st.ListACLs(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list ACLs: %v", err)
+	}
+	if len(coll.Data) != 2 {
+		t.Errorf("expected 2 ACLs, got %d", len(coll.Data))
+	}
+}
+
+func testAuditRecords(t *testing.T, st storage.Storage) {
+	coll, err := st.ListAuditRecords(ctx, storage.AuditFilter{}, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit records: %v", err)
+	}
+	if len(coll.Metadata) != 0 || len(coll.Data) != 0 {
+		t.Errorf("expected no audit records, got %+v", coll)
+	}
+
+	start := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	records := []storage.AuditRecord{
+		{Action: "lock_state", Outcome: "success", Principal: "alice", Name: "prod", LockID: "lock1"},
+		{Action: "insert_state", Outcome: "success", Principal: "alice", Name: "prod", Serial: 2},
+		{Action: "force_unlock_state", Outcome: "success", Principal: "alice", Name: "prod", LockID: "lock1", Reason: "stale lock"},
+		{Action: "remove_state", Outcome: "denied", Principal: "bob", Name: "prod"},
+		{Action: "remove_state", Outcome: "success", Principal: "carol", Name: "dev"},
+	}
+	for i, record := range records {
+		record.ID = fmt.Sprintf("record%d", i)
+		record.Time = start.Add(time.Duration(i) * time.Minute)
+		record.Status = 200
+		record.SourceIP = "192.0.2.1"
+		if err = st.InsertAuditRecord(ctx, record); err != nil {
+			t.Fatalf("failed to insert audit record: %v", err)
+		}
+	}
+
+	// Audit records are listed most recent first
+	for page, want := range [][]string{{"record4", "record3"}, {"record2", "record1"}, {"record0"}} {
+		coll, err = st.ListAuditRecords(ctx, storage.AuditFilter{}, page+1, 2)
+		if err != nil {
+			t.Fatalf("failed to list audit records: %v", err)
+		}
+		if len(coll.Metadata) != 1 || coll.Metadata[0].Total != 5 || coll.Metadata[0].Page != page+1 {
+			t.Errorf("page %d: unexpected metadata %+v", page+1, coll.Metadata)
+		}
+		var got []string
+		for _, record := range coll.Data {
+			got = append(got, record.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("page %d: expected audit records %v, got %v", page+1, want, got)
+		}
+	}
+
+	coll, err = st.ListAuditRecords(ctx, storage.AuditFilter{Action: "insert_state"}, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit records: %v", err)
+	}
+	if len(coll.Data) != 1 {
+		t.Fatalf("expected 1 insert_state audit record, got %d", len(coll.Data))
+	}
+	record := coll.Data[0]
+	if record.Principal != "alice" || record.Name != "prod" || record.Serial != 2 ||
+		record.Outcome != "success" || record.Status != 200 || record.SourceIP != "192.0.2.1" ||
+		!record.Time.Equal(start.Add(time.Minute)) {
+		t.Errorf("unexpected audit record %+v", record)
+	}
+
+	coll, err = st.ListAuditRecords(ctx, storage.AuditFilter{Action: "force_unlock_state"}, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit records: %v", err)
+	}
+	if len(coll.Data) != 1 || coll.Data[0].Reason != "stale lock" {
+		t.Errorf("expected the force-unlock audit record to keep its reason, got %+v", coll.Data)
+	}
+
+	for _, tt := range []struct {
+		filter storage.AuditFilter
+		want   []string
+	}{
+		{storage.AuditFilter{Name: "prod"}, []string{"record3", "record2", "record1", "record0"}},
+		{storage.AuditFilter{Principal: "bob"}, []string{"record3"}},
+		{storage.AuditFilter{Outcome: "success", Name: "prod"}, []string{"record2", "record1", "record0"}},
+		{storage.AuditFilter{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, []string{"record3", "record2", "record1"}},
+		{storage.AuditFilter{Principal: "nobody"}, nil},
+	} {
+		coll, err = st.ListAuditRecords(ctx, tt.filter, 1, 10)
+		if err != nil {
+			t.Fatalf("failed to list audit records: %v", err)
+		}
+		var got []string
+		for _, record := range coll.Data {
+			got = append(got, record.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("filter %+v: expected audit records %v, got %v", tt.filter, tt.want, got)
+		}
+		if len(tt.want) > 0 && (len(coll.Metadata) != 1 || coll.Metadata[0].Total != len(tt.want)) {
+			t.Errorf("filter %+v: unexpected metadata %+v", tt.filter, coll.Metadata)
+		}
+	}
+}
+
+func testWebhooks(t *testing.T, st storage.Storage) {
+	coll, err := st.ListWebhooks(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list webhooks: %v", err)
+	}
+	if len(coll.Metadata) != 0 || len(coll.Data) != 0 {
+		t.Errorf("expected no webhooks, got %+v", coll)
+	}
+	if err = st.RemoveWebhook(ctx, "missing"); err != storage.ErrNoDocuments {
+		t.Errorf("removing a missing webhook: expected ErrNoDocuments, got %v", err)
+	}
+
+	createdAt := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 3; i > 0; i-- {
+		webhook := storage.Webhook{
+			ID:        fmt.Sprintf("webhook%d", i),
+			URL:       fmt.Sprintf("https://hooks%d.example.com/terradb", i),
+			Patterns:  []string{"prod/**"},
+			Events:    []string{"state.pushed"},
+			Secret:    "secret",
+			CreatedAt: createdAt,
+			CreatedBy: "admin",
+		}
+		if err = st.InsertWebhook(ctx, webhook); err != nil {
+			t.Fatalf("failed to insert webhook: %v", err)
+		}
+	}
+
+	// Webhooks are listed in ID order
+	for page, want := range [][]string{{"webhook1", "webhook2"}, {"webhook3"}} {
+		coll, err = st.ListWebhooks(ctx, page+1, 2)
+		if err != nil {
+			t.Fatalf("failed to list webhooks: %v", err)
+		}
+		if len(coll.Metadata) != 1 || coll.Metadata[0].Total != 3 || coll.Metadata[0].Page != page+1 {
+			t.Errorf("page %d: unexpected metadata %+v", page+1, coll.Metadata)
+		}
+		var got []string
+		for _, webhook := range coll.Data {
+			got = append(got, webhook.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("page %d: expected webhooks %v, got %v", page+1, want, got)
+		}
+		if page == 0 && len(coll.Data) > 0 {
+			webhook := coll.Data[0]
+			if webhook.URL != "https://hooks1.example.com/terradb" || webhook.Secret != "secret" ||
+				fmt.Sprint(webhook.Patterns) != "[prod/**]" || fmt.Sprint(webhook.Events) != "[state.pushed]" ||
+				!webhook.CreatedAt.Equal(createdAt) {
+				t.Errorf("unexpected webhook %+v", webhook)
+			}
+		}
+	}
+
+	if err = st.RemoveWebhook(ctx, "webhook2"); err != nil {
+		t.Fatalf("failed to remove webhook: %v", err)
+	}
+	coll, err = st.ListWebhooks(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list webhooks: %v", err)
+	}
+	if len(coll.Data) != 2 {
+		t.Errorf("expected 2 webhooks, got %d", len(coll.Data))
+	}
+}
+
+func testDeliveries(t *testing.T, st storage.Storage) {
+	coll, err := st.ListDeliveries(ctx, storage.DeliveryFilter{}, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list deliveries: %v", err)
+	}
+	if len(coll.Metadata) != 0 || len(coll.Data) != 0 {
+		t.Errorf("expected no deliveries, got %+v", coll)
+	}
+
+	start := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		delivery := storage.Delivery{
+			ID:          fmt.Sprintf("delivery%d", i),
+			WebhookID:   fmt.Sprintf("webhook%d", i%2),
+			Event:       "state.pushed",
+			Payload:     json.RawMessage(fmt.Sprintf(`{"serial":%d}`, i)),
+			CreatedAt:   start.Add(time.Duration(i) * time.Minute),
+			Status:      storage.DeliveryPending,
+			NextAttempt: start.Add(time.Duration(i) * time.Minute),
+		}
+		if err = st.InsertDelivery(ctx, delivery); err != nil {
+			t.Fatalf("failed to insert delivery: %v", err)
+		}
+	}
+
+	// Inserting a delivery with the same ID replaces it
+	deliveredAt := start.Add(time.Hour)
+	err = st.InsertDelivery(ctx, storage.Delivery{
+		ID:          "delivery1",
+		WebhookID:   "webhook1",
+		Event:       "state.pushed",
+		Payload:     json.RawMessage(`{"serial":1}`),
+		CreatedAt:   start.Add(time.Minute),
+		Status:      storage.DeliveryDelivered,
+		Attempts:    2,
+		LastStatus:  500,
+		LastError:   "500 Internal Server Error",
+		DeliveredAt: &deliveredAt,
+	})
+	if err != nil {
+		t.Fatalf("failed to replace delivery: %v", err)
+	}
+
+	// Deliveries are listed most recent first
+	for page, want := range [][]string{{"delivery3", "delivery2"}, {"delivery1", "delivery0"}} {
+		coll, err = st.ListDeliveries(ctx, storage.DeliveryFilter{}, page+1, 2)
+		if err != nil {
+			t.Fatalf("failed to list deliveries: %v", err)
+		}
+		if len(coll.Metadata) != 1 || coll.Metadata[0].Total != 4 || coll.Metadata[0].Page != page+1 {
+			t.Errorf("page %d: unexpected metadata %+v", page+1, coll.Metadata)
+		}
+		var got []string
+		for _, delivery := range coll.Data {
+			got = append(got, delivery.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("page %d: expected deliveries %v, got %v", page+1, want, got)
+		}
+	}
+
+	for _, tt := range []struct {
+		filter storage.DeliveryFilter
+		want   []string
+	}{
+		{storage.DeliveryFilter{WebhookID: "webhook0"}, []string{"delivery2", "delivery0"}},
+		{storage.DeliveryFilter{Status: storage.DeliveryPending}, []string{"delivery3", "delivery2", "delivery0"}},
+		{storage.DeliveryFilter{WebhookID: "webhook1", Status: storage.DeliveryDelivered}, []string{"delivery1"}},
+		{storage.DeliveryFilter{Status: storage.DeliveryFailed}, nil},
+	} {
+		coll, err = st.ListDeliveries(ctx, tt.filter, 1, 10)
+		if err != nil {
+			t.Fatalf("failed to list deliveries: %v", err)
+		}
+		var got []string
+		for _, delivery := range coll.Data {
+			got = append(got, delivery.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("filter %+v: expected deliveries %v, got %v", tt.filter, tt.want, got)
+		}
+	}
+
+	coll, err = st.ListDeliveries(ctx, storage.DeliveryFilter{Status: storage.DeliveryDelivered}, 1, 10)
+	if err != nil {
+		t.Fatalf("failed to list deliveries: %v", err)
+	}
+	if len(coll.Data) != 1 {
+		t.Fatalf("expected 1 delivered delivery, got %d", len(coll.Data))
+	}
+	delivery := coll.Data[0]
+	if delivery.Attempts != 2 || delivery.LastStatus != 500 ||
+		delivery.DeliveredAt == nil || !delivery.DeliveredAt.Equal(deliveredAt) {
+		t.Errorf("unexpected delivery %+v", delivery)
+	}
+
+	// Storages may reformat the payload
+	var payload struct {
+		Serial int `json:"serial"`
+	}
+	if err = json.Unmarshal(delivery.Payload, &payload); err != nil || payload.Serial != 1 {
+		t.Errorf("unexpected payload %s", delivery.Payload)
+	}
+}
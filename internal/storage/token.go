@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"time"
+)
+
+// Token is an API token. Only the hash of its secret is stored.
+type Token struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Hash string `json:"hash,omitempty"`
+
+	// Scopes are the permissions granted by the token,
+	// on the states whose names start with Prefix
+	Scopes []string `json:"scopes"`
+	Prefix string   `json:"prefix,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by"`
+
+	// ExpiresAt is nil for tokens which never expire
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// TokenCollection is a collection of Token, with metadata
+type TokenCollection struct {
+	Metadata []*Metadata `json:"metadata"`
+	Data     []*Token    `json:"data"`
+}
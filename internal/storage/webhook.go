@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Webhook subscribes a URL to the events
+// of the states whose names match Patterns
+type Webhook struct {
+	ID       string   `json:"id"`
+	URL      string   `json:"url"`
+	Patterns []string `json:"patterns"`
+	Events   []string `json:"events"`
+
+	// Secret signs the payloads, with HMAC-SHA256
+	Secret string `json:"secret,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by"`
+}
+
+// WebhookCollection is a collection of Webhook, with metadata
+type WebhookCollection struct {
+	Metadata []*Metadata `json:"metadata"`
+	Data     []*Webhook  `json:"data"`
+}
+
+// Statuses of the deliveries
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Delivery is the call of a webhook for an event.
+// Pending deliveries are retried until they succeed,
+// or fail too many times.
+type Delivery struct {
+	// ID starts with the time of the delivery,
+	// so that IDs sort in chronological order
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhook_id"`
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+
+	// LastStatus and LastError report the last attempt
+	LastStatus int    `json:"last_status,omitempty"`
+	LastError  string `json:"last_error,omitempty"`
+
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// DeliveryCollection is a collection of Delivery, with metadata
+type DeliveryCollection struct {
+	Metadata []*Metadata `json:"metadata"`
+	Data     []*Delivery `json:"data"`
+}
+
+// DeliveryFilter selects deliveries.
+// Empty fields select all the deliveries.
+type DeliveryFilter struct {
+	WebhookID string
+	Status    string
+}
+
+// Match tells whether a delivery is selected by the filter
+func (f DeliveryFilter) Match(delivery *Delivery) bool {
+	switch {
+	case f.WebhookID != "" && delivery.WebhookID != f.WebhookID:
+		return false
+	case f.Status != "" && delivery.Status != f.Status:
+		return false
+	}
+	return true
+}
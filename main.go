@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	log "github.com/sirupsen/logrus"
@@ -12,19 +14,68 @@ import (
 )
 
 var opts struct {
-	Version bool `short:"V" long:"version" description:"Display version."`
+	Version bool   `short:"V" long:"version" description:"Display version."`
+	Storage string `long:"storage" description:"Storage backend" env:"TERRADB_STORAGE" choice:"mongodb" choice:"postgres" choice:"memory" choice:"bolt" choice:"git" default:"mongodb"`
 	MongoDB struct {
-		URL      string `long:"mongodb-url" description:"MongoDB URL" env:"MONGODB_URL"`
-		Username string `long:"mongodb-username" description:"MongoDB Username" env:"MONGODB_USERNAME"`
-		Password string `long:"mongodb-password" description:"MongoDB Password" env:"MONGODB_PASSWORD"`
+		URL              string `long:"mongodb-url" description:"MongoDB URL" env:"MONGODB_URL"`
+		Username         string `long:"mongodb-username" description:"MongoDB Username" env:"MONGODB_USERNAME"`
+		Password         string `long:"mongodb-password" description:"MongoDB Password" env:"MONGODB_PASSWORD"`
+		BlobThreshold    int    `long:"mongodb-blob-threshold" description:"Size in bytes above which state bodies are stored in GridFS (0 to disable)" env:"MONGODB_BLOB_THRESHOLD" default:"4194304"`
+		Compression      string `long:"mongodb-compression" description:"Compression of the state bodies stored in GridFS" env:"MONGODB_COMPRESSION" choice:"none" choice:"gzip" default:"none"`
+		SnapshotInterval int    `long:"mongodb-snapshot-interval" description:"Store serials in full every N serials, and as deltas in between (0 to always store them in full)" env:"MONGODB_SNAPSHOT_INTERVAL" default:"0"`
+		TLSCAFile        string `long:"mongodb-tls-ca-file" description:"CA file verifying the certificate of the MongoDB server" env:"MONGODB_TLS_CA_FILE"`
+		TLSCertFile      string `long:"mongodb-tls-cert-file" description:"Client certificate file authenticating to the MongoDB server" env:"MONGODB_TLS_CERT_FILE"`
+		TLSKeyFile       string `long:"mongodb-tls-key-file" description:"Key file of the client certificate, if not in the certificate file" env:"MONGODB_TLS_KEY_FILE"`
 	} `group:"MongoDB options"`
+	PostgreSQL struct {
+		URL      string `long:"postgres-url" description:"PostgreSQL URL" env:"POSTGRES_URL"`
+		Username string `long:"postgres-username" description:"PostgreSQL Username" env:"POSTGRES_USERNAME"`
+		Password string `long:"postgres-password" description:"PostgreSQL Password" env:"POSTGRES_PASSWORD"`
+	} `group:"PostgreSQL options"`
+	Bolt struct {
+		Path string `long:"bolt-path" description:"Path to the Bolt database file" env:"BOLT_PATH" default:"terradb.db"`
+	} `group:"Bolt options"`
+	Git struct {
+		Path string `long:"git-path" description:"Path to the Git repository" env:"GIT_PATH" default:"terradb-states"`
+	} `group:"Git options"`
+	Encryption struct {
+		Key         string   `long:"encryption-key" description:"Base64-encoded master key encrypting the state bodies" env:"TERRADB_ENCRYPTION_KEY"`
+		KeyFile     string   `long:"encryption-key-file" description:"File holding the base64-encoded master key encrypting the state bodies" env:"TERRADB_ENCRYPTION_KEY_FILE"`
+		OldKeyFiles []string `long:"encryption-old-key-file" description:"File holding a former master key, to decrypt the states encrypted with it (can be repeated)" env:"TERRADB_ENCRYPTION_OLD_KEY_FILES" env-delim:","`
+		Rotate      bool     `long:"rotate-encryption-key" description:"Re-encrypt all serials with the master key and exit"`
+	} `group:"Encryption options"`
 	API struct {
-		Address  string `long:"api-address" description:"Address on to bind the API server" env:"API_ADDRESS" default:"127.0.0.1"`
-		Port     string `long:"api-port" description:"Port on to listen" env:"API_PORT" default:"8080"`
-		PageSize int    `long:"page-size" description:"Page size for list results" env:"API_PAGE_SIZE" default:"100"`
-		Username string `long:"terradb-username" description:"Restrict API access with basic auth" env:"TERRADB_USERNAME"`
-		Password string `long:"terradb-password" description:"Restrict API access with basic auth" env:"TERRADB_PASSWORD"`
+		Address            string        `long:"api-address" description:"Address on to bind the API server" env:"API_ADDRESS" default:"127.0.0.1"`
+		Port               string        `long:"api-port" description:"Port on to listen" env:"API_PORT" default:"8080"`
+		PageSize           int           `long:"page-size" description:"Page size for list results" env:"API_PAGE_SIZE" default:"100"`
+		Timeout            time.Duration `long:"storage-timeout" description:"Timeout of storage operations for each API request (0 to disable)" env:"API_STORAGE_TIMEOUT" default:"5s"`
+		RequireLock        bool          `long:"require-lock" description:"Reject state writes from clients which do not hold the state lock" env:"API_REQUIRE_LOCK"`
+		TrashRetention     time.Duration `long:"trash-retention" description:"Purge deleted states after this duration (0 to keep them forever)" env:"API_TRASH_RETENTION" default:"0"`
+		CompactionInterval time.Duration `long:"compaction-interval" description:"Compact the serials stored as deltas at this interval (0 to disable)" env:"API_COMPACTION_INTERVAL" default:"24h"`
+		Username           string        `long:"terradb-username" description:"Restrict API access with basic auth" env:"TERRADB_USERNAME"`
+		Password           string        `long:"terradb-password" description:"Restrict API access with basic auth" env:"TERRADB_PASSWORD"`
+		ReaderUsername     string        `long:"terradb-reader-username" description:"Grant read-only API access with basic auth, with secrets redacted" env:"TERRADB_READER_USERNAME"`
+		ReaderPassword     string        `long:"terradb-reader-password" description:"Grant read-only API access with basic auth, with secrets redacted" env:"TERRADB_READER_PASSWORD"`
+		RedactPatterns     []string      `long:"redact-pattern" description:"Pattern of the attribute names redacted for callers which cannot read secrets (can be repeated)" env:"API_REDACT_PATTERNS" env-delim:"," default:"*password" default:"*private_key" default:"*secret" default:"*secret_key" default:"*token"`
+		HtpasswdFile       string        `long:"htpasswd-file" description:"Authenticate users with basic auth against the bcrypt hashes of an htpasswd file, reloaded on change or SIGHUP" env:"TERRADB_HTPASSWD_FILE"`
+		ACLFile            string        `long:"acl-file" description:"JSON file of ACLs inserted on start" env:"API_ACL_FILE"`
+		AuditFile          string        `long:"audit-file" description:"Mirror the audit records of the mutating API calls to a JSON-lines file" env:"API_AUDIT_FILE"`
 	} `group:"API server options"`
+	JWT struct {
+		JWKS         string   `long:"jwt-jwks" description:"File or HTTPS URL of the JSON Web Key Set verifying the accepted JWTs" env:"JWT_JWKS"`
+		Issuer       string   `long:"jwt-issuer" description:"Expected issuer (iss claim) of the JWTs, required with --jwt-jwks" env:"JWT_ISSUER"`
+		Audience     string   `long:"jwt-audience" description:"Expected audience (aud claim) of the JWTs, required with --jwt-jwks" env:"JWT_AUDIENCE"`
+		UserClaim    string   `long:"jwt-user-claim" description:"Claim naming the user" env:"JWT_USER_CLAIM" default:"sub"`
+		GroupClaims  []string `long:"jwt-group-claim" description:"Claim whose values are the groups of the user (can be repeated)" env:"JWT_GROUP_CLAIMS" env-delim:"," default:"groups"`
+		RoleMappings []string `long:"jwt-role-mapping" description:"Grant a role (reader, writer or admin) to the users with a claim matching a pattern, as <claim>=<pattern>:<role> (can be repeated)" env:"JWT_ROLE_MAPPINGS" env-delim:";"`
+	} `group:"JWT authentication options"`
+	TLS struct {
+		CertFile           string   `long:"tls-cert" description:"Certificate file of the API server, which serves HTTPS when set, reloaded on change" env:"TLS_CERT"`
+		KeyFile            string   `long:"tls-key" description:"Key file of the API server certificate, if not in the certificate file" env:"TLS_KEY"`
+		ClientCAFile       string   `long:"tls-client-ca" description:"CA file verifying client certificates, whose common name or first SAN authenticates the caller" env:"TLS_CLIENT_CA"`
+		RequireClientCert  bool     `long:"tls-require-client-cert" description:"Reject the connections without a valid client certificate" env:"TLS_REQUIRE_CLIENT_CERT"`
+		ClientRoleMappings []string `long:"tls-client-role-mapping" description:"Grant a role (reader, writer or admin) to the client certificates whose name matches a pattern, as <pattern>:<role> (can be repeated)" env:"TLS_CLIENT_ROLE_MAPPINGS" env-delim:";"`
+	} `group:"TLS options"`
 }
 
 // VERSION is TerraDB's version number
@@ -47,20 +98,118 @@ func main() {
 		os.Exit(0)
 	}
 
-	st, err = storage.NewMongoDB(&storage.MongoDBConfig{
-		URL:      opts.MongoDB.URL,
-		Username: opts.MongoDB.Username,
-		Password: opts.MongoDB.Password,
-	})
+	switch opts.Storage {
+	case "memory":
+		log.Warning("Using in-memory storage: states will be lost on exit.")
+		st = storage.NewMemory()
+	case "bolt":
+		st, err = storage.NewBolt(&storage.BoltConfig{
+			Path: opts.Bolt.Path,
+		})
+	case "git":
+		st, err = storage.NewGit(&storage.GitConfig{
+			Path: opts.Git.Path,
+		})
+	case "postgres":
+		st, err = storage.NewPostgreSQL(&storage.PostgreSQLConfig{
+			URL:      opts.PostgreSQL.URL,
+			Username: opts.PostgreSQL.Username,
+			Password: opts.PostgreSQL.Password,
+		})
+	default:
+		st, err = storage.NewMongoDB(&storage.MongoDBConfig{
+			URL:              opts.MongoDB.URL,
+			Username:         opts.MongoDB.Username,
+			Password:         opts.MongoDB.Password,
+			BlobThreshold:    opts.MongoDB.BlobThreshold,
+			Compression:      opts.MongoDB.Compression,
+			SnapshotInterval: opts.MongoDB.SnapshotInterval,
+			TLSCAFile:        opts.MongoDB.TLSCAFile,
+			TLSCertFile:      opts.MongoDB.TLSCertFile,
+			TLSKeyFile:       opts.MongoDB.TLSKeyFile,
+		})
+	}
 	if err != nil {
 		log.Fatalf("failed to setup storage: %s", err)
 	}
 
+	if opts.Encryption.Key != "" || opts.Encryption.KeyFile != "" {
+		keyring, err := loadKeyring()
+		if err != nil {
+			log.Fatalf("failed to load encryption keys: %s", err)
+		}
+		est := storage.NewEncrypted(st, keyring)
+		if opts.Storage == "git" {
+			log.Warning("The Git history keeps the serials stored before encryption was enabled, in clear")
+		}
+
+		if opts.Encryption.Rotate {
+			serials, err := est.Rotate(context.Background())
+			if err != nil {
+				log.Fatalf("failed to rotate encryption key: %s", err)
+			}
+			log.Infof("Re-encrypted %d serials", serials)
+			os.Exit(0)
+		}
+		st = est
+	} else if opts.Encryption.Rotate {
+		log.Fatal("rotating the encryption key requires a master key")
+	}
+
 	api.StartServer(&api.API{
-		Address:  opts.API.Address,
-		Port:     opts.API.Port,
-		PageSize: opts.API.PageSize,
-		Username: opts.API.Username,
-		Password: opts.API.Password,
+		Address:            opts.API.Address,
+		Port:               opts.API.Port,
+		PageSize:           opts.API.PageSize,
+		Timeout:            opts.API.Timeout,
+		RequireLock:        opts.API.RequireLock,
+		TrashRetention:     opts.API.TrashRetention,
+		CompactionInterval: opts.API.CompactionInterval,
+		Username:           opts.API.Username,
+		Password:           opts.API.Password,
+		ReaderUsername:     opts.API.ReaderUsername,
+		ReaderPassword:     opts.API.ReaderPassword,
+		RedactPatterns:     opts.API.RedactPatterns,
+		ACLFile:            opts.API.ACLFile,
+		HtpasswdFile:       opts.API.HtpasswdFile,
+		AuditFile:          opts.API.AuditFile,
+		JWT: api.JWTConfig{
+			JWKS:         opts.JWT.JWKS,
+			Issuer:       opts.JWT.Issuer,
+			Audience:     opts.JWT.Audience,
+			UserClaim:    opts.JWT.UserClaim,
+			GroupClaims:  opts.JWT.GroupClaims,
+			RoleMappings: opts.JWT.RoleMappings,
+		},
+		TLS: api.TLSConfig{
+			CertFile:           opts.TLS.CertFile,
+			KeyFile:            opts.TLS.KeyFile,
+			ClientCAFile:       opts.TLS.ClientCAFile,
+			RequireClientCert:  opts.TLS.RequireClientCert,
+			ClientRoleMappings: opts.TLS.ClientRoleMappings,
+		},
 	}, st)
 }
+
+// loadKeyring loads the master key and the former master keys
+func loadKeyring() (keyring *storage.Keyring, err error) {
+	var key []byte
+	if opts.Encryption.KeyFile != "" {
+		key, err = storage.LoadKeyFile(opts.Encryption.KeyFile)
+	} else {
+		key, err = storage.ParseKey(opts.Encryption.Key)
+	}
+	if err != nil {
+		return
+	}
+
+	var old [][]byte
+	for _, f := range opts.Encryption.OldKeyFiles {
+		k, err := storage.LoadKeyFile(f)
+		if err != nil {
+			return nil, err
+		}
+		old = append(old, k)
+	}
+
+	return storage.NewKeyring(key, old...)
+}
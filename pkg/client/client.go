@@ -4,11 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 
 	"github.com/camptocamp/terradb/internal/storage"
 )
 
 // Client is a TerraDB client.
+// State names may contain slashes, which are escaped in the request paths.
 type Client struct {
 	httpClient *http.Client
 	URL        string
@@ -21,7 +23,18 @@ func NewClient(url string) *Client {
 
 // ListStates lists all state names in TerraDB.
 func (c *Client) ListStates() (states storage.StateCollection, err error) {
-	err = c.get(&states, "states", nil)
+	return c.ListStatesWithPrefix("")
+}
+
+// ListStatesWithPrefix lists the state names starting with prefix,
+// e.g. org/project/ for the states of a project.
+func (c *Client) ListStatesWithPrefix(prefix string) (states storage.StateCollection, err error) {
+	var params map[string]string
+	if prefix != "" {
+		params = map[string]string{"prefix": prefix}
+	}
+
+	err = c.get(&states, "states", params)
 	if err != nil {
 		return states, fmt.Errorf("failed to retrieve states: %v", err)
 	}
@@ -29,14 +42,16 @@ func (c *Client) ListStates() (states storage.StateCollection, err error) {
 	return
 }
 
-// GetState returns a TerraDB state from its name and serial.
+// GetState returns a TerraDB state from its name and serial,
+// along with its metadata.
 // Use 0 as serial to return the latest version of the state.
 func (c *Client) GetState(name string, serial int) (st storage.State, err error) {
 	params := map[string]string{
-		"serial": fmt.Sprintf("%v", serial),
+		"serial":   fmt.Sprintf("%v", serial),
+		"metadata": "true",
 	}
 
-	err = c.get(&st, "states/"+name, params)
+	err = c.get(&st, "states/"+url.PathEscape(name), params)
 	if err != nil {
 		return st, fmt.Errorf("failed to retrieve state: %v", err)
 	}
@@ -46,7 +61,7 @@ func (c *Client) GetState(name string, serial int) (st storage.State, err error)
 
 // ListStateSerials lists all state serials and last_modified times for a given name.
 func (c *Client) ListStateSerials(name string) (coll storage.StateCollection, err error) {
-	err = c.get(&coll, "states/"+name+"/serials", nil)
+	err = c.get(&coll, "states/"+url.PathEscape(name)+"/serials", nil)
 	if err != nil {
 		return coll, fmt.Errorf("failed to retrieve state serials: %v", err)
 	}
@@ -56,7 +71,7 @@ func (c *Client) ListStateSerials(name string) (coll storage.StateCollection, er
 
 // GetResource returns a TerraDB resource from its state, module and name.
 func (c *Client) GetResource(state, module, name string) (st storage.Resource, err error) {
-	err = c.get(&st, "resources/"+state+"/"+module+"/"+name, nil)
+	err = c.get(&st, "resources/"+url.PathEscape(state)+"/"+url.PathEscape(module)+"/"+url.PathEscape(name), nil)
 	if err != nil {
 		return st, fmt.Errorf("failed to retrieve resource: %v", err)
 	}